@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//maxAPIRequestLength bounds the body of the requests made to the API
+const maxAPIRequestLength = 65536
+
+//APIServer serves a REST API for dashboards and other integrations, carrying out the same commands as the subcommands.
+//Every request needs the API key, either in the X-API-Key header or as a bearer token
+type APIServer struct {
+	handler commandHandler
+	apiKey  string
+}
+
+//startAPIServer serves the API on address, which has to be a loopback address so that the API is never exposed to
+//the network
+func startAPIServer(address string, handler commandHandler) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errors.New("the API can only be bound to localhost, not " + host)
+	}
+	apiKey, err := loadOrCreateAPIKey()
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	log.Println("Serving the API on", listener.Addr().String(), "with the key in", getAPIKeyFile())
+	go http.Serve(listener, APIServer{handler: handler, apiKey: apiKey})
+	return nil
+}
+
+func getAPIKeyFile() string {
+	return getGlobalConfigFolder() + "/api_key"
+}
+
+//loadOrCreateAPIKey returns the API key stored in the global config folder, generating one the first time
+func loadOrCreateAPIKey() (string, error) {
+	apiKeyFile := getAPIKeyFile()
+	apiKeyBytes, err := ioutil.ReadFile(apiKeyFile)
+	if err == nil && len(strings.TrimSpace(string(apiKeyBytes))) > 0 {
+		return strings.TrimSpace(string(apiKeyBytes)), nil
+	}
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	apiKey := hex.EncodeToString(randomBytes)
+	err = ioutil.WriteFile(apiKeyFile, []byte(apiKey+"\n"), 0600)
+	return apiKey, err
+}
+
+func (server APIServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	if !server.isAuthorized(request) {
+		writeAPIError(writer, http.StatusUnauthorized, errors.New("missing or invalid API key"))
+		return
+	}
+	if request.Method == http.MethodGet && strings.Trim(request.URL.Path, "/") == "api/events" {
+		server.streamEvents(writer, request)
+		return
+	}
+	controlRequest, status, err := getAPIControlRequest(request)
+	if err != nil {
+		writeAPIError(writer, status, err)
+		return
+	}
+	data, err := server.handler.execute(controlRequest)
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, err)
+		return
+	}
+	writer.Write(data)
+}
+
+//streamEvents sends every event to the client as a server-sent event until it disconnects. A client reconnecting with
+//the Last-Event-ID header, or the since query parameter, first receives the recent events it missed
+func (server APIServer) streamEvents(writer http.ResponseWriter, request *http.Request) {
+	flusher, canFlush := writer.(http.Flusher)
+	if !canFlush {
+		writeAPIError(writer, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	sinceID := uint64(math.MaxUint64)
+	for _, since := range []string{request.Header.Get("Last-Event-ID"), request.URL.Query().Get("since")} {
+		if parsedID, err := strconv.ParseUint(since, 10, 64); err == nil {
+			sinceID = parsedID
+		}
+	}
+	subscriber, missedEvents := events.subscribe(sinceID)
+	defer events.unsubscribe(subscriber)
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+	for _, event := range missedEvents {
+		writeServerSentEvent(writer, event)
+	}
+	flusher.Flush()
+	for {
+		select {
+		case event, open := <-subscriber:
+			if !open {
+				return
+			}
+			writeServerSentEvent(writer, event)
+			flusher.Flush()
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
+
+func writeServerSentEvent(writer io.Writer, event Event) {
+	eventJSON, _ := json.Marshal(event)
+	fmt.Fprintf(writer, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, eventJSON)
+}
+
+func (server APIServer) isAuthorized(request *http.Request) bool {
+	apiKey := request.Header.Get("X-API-Key")
+	if apiKey == "" {
+		apiKey = strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(apiKey), []byte(server.apiKey)) == 1
+}
+
+//getAPIControlRequest maps a request made to the API to the command it stands for. The routes are -
+//GET /api/status, GET /api/folders, POST /api/folders {"path"}, DELETE /api/folders/<id>, POST /api/folders/<id>/sync,
+//POST /api/sync, GET /api/folders/<id>/versions?file=<name>, POST /api/folders/<id>/restore {"file", "version"},
+//POST /api/folders/<id>/retention {"type", "value"}, POST /api/folders/<id>/mode {"mode"},
+//POST /api/folders/<id>/revert, POST /api/folders/<id>/devices {"device_id"}, GET /api/folders/<id>/ignore?path=<name>,
+//DELETE /api/folders/<id>/devices/<device id>, GET /api/devices, GET /api/peers, GET /api/transfers, GET /api/offers,
+//POST /api/offers/<id>/accept {"directory", "name"} and POST /api/offers/<id>/reject. GET /api/events is served
+//separately by streamEvents
+func getAPIControlRequest(request *http.Request) (ControlRequest, int, error) {
+	parts := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+	if len(parts) < 2 || len(parts) > 5 || parts[0] != "api" {
+		return ControlRequest{}, http.StatusNotFound, errors.New("not found")
+	}
+	route := request.Method + " " + parts[1]
+	if len(parts) > 2 {
+		route += "/<id>"
+		if len(parts) > 3 {
+			route += "/" + parts[3]
+		}
+		if len(parts) > 4 {
+			route += "/<id>"
+		}
+	}
+	body := make(map[string]string)
+	if request.Method == http.MethodPost && request.ContentLength != 0 {
+		err := json.NewDecoder(io.LimitReader(request.Body, maxAPIRequestLength)).Decode(&body)
+		if err != nil {
+			return ControlRequest{}, http.StatusBadRequest, errors.New("invalid request body")
+		}
+	}
+	for _, key := range []string{"path", "directory"} {
+		if body[key] != "" && !filepath.IsAbs(body[key]) {
+			return ControlRequest{}, http.StatusBadRequest, errors.New(key + " has to be an absolute path")
+		}
+	}
+	folderPath := ""
+	if parts[1] == "folders" && len(parts) > 3 {
+		folderPath = getGlobalConfig()[parts[2]]
+		if folderPath == "" {
+			return ControlRequest{}, http.StatusNotFound, errors.New("no folder with ID " + parts[2])
+		}
+	}
+	switch route {
+	case "GET status", "GET folders", "GET devices", "GET peers", "GET transfers", "GET offers":
+		return ControlRequest{Command: parts[1], Args: []string{}}, http.StatusOK, nil
+	case "POST folders":
+		return ControlRequest{Command: "add", Args: []string{body["path"]}}, http.StatusOK, nil
+	case "DELETE folders/<id>":
+		return ControlRequest{Command: "remove", Args: []string{parts[2]}}, http.StatusOK, nil
+	case "POST folders/<id>/sync":
+		return ControlRequest{Command: "sync", Args: []string{folderPath}}, http.StatusOK, nil
+	case "GET folders/<id>/versions":
+		filePath := getLocalPath(folderPath, request.URL.Query().Get("file"))
+		return ControlRequest{Command: "versions", Args: []string{filePath}}, http.StatusOK, nil
+	case "POST folders/<id>/restore":
+		filePath := getLocalPath(folderPath, body["file"])
+		return ControlRequest{Command: "restore", Args: []string{filePath, body["version"]}}, http.StatusOK, nil
+	case "POST folders/<id>/retention":
+		return ControlRequest{Command: "retention", Args: []string{folderPath, body["type"], body["value"]}}, http.StatusOK, nil
+	case "POST folders/<id>/mode":
+		return ControlRequest{Command: "mode", Args: []string{folderPath, body["mode"]}}, http.StatusOK, nil
+	case "GET folders/<id>/ignore":
+		path := getLocalPath(folderPath, request.URL.Query().Get("path"))
+		return ControlRequest{Command: "ignore", Args: []string{path}}, http.StatusOK, nil
+	case "POST folders/<id>/revert":
+		return ControlRequest{Command: "revert", Args: []string{folderPath}}, http.StatusOK, nil
+	case "POST folders/<id>/devices":
+		return ControlRequest{Command: "share", Args: []string{folderPath, body["device_id"]}}, http.StatusOK, nil
+	case "DELETE folders/<id>/devices/<id>":
+		return ControlRequest{Command: "unshare", Args: []string{folderPath, parts[4]}}, http.StatusOK, nil
+	case "POST sync":
+		return ControlRequest{Command: "sync", Args: []string{}}, http.StatusOK, nil
+	case "POST offers/<id>/accept":
+		return ControlRequest{Command: "accept", Args: []string{parts[2], body["directory"], body["name"]}}, http.StatusOK, nil
+	case "POST offers/<id>/reject":
+		return ControlRequest{Command: "reject", Args: []string{parts[2]}}, http.StatusOK, nil
+	}
+	return ControlRequest{}, http.StatusNotFound, errors.New("no route for " + request.Method + " " + request.URL.Path)
+}
+
+func writeAPIError(writer http.ResponseWriter, status int, err error) {
+	errorJSON, _ := json.Marshal(map[string]string{"error": err.Error()})
+	writer.WriteHeader(status)
+	writer.Write(errorJSON)
+}
@@ -2,26 +2,138 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
+//CLIController handles all the interaction with the user. When running headless as a daemon, messages are logged and
+//prompts are kept pending until they are answered over the control socket
 type CLIController struct {
-	userIO    sync.Mutex
-	ioWait    bool
-	inputChan chan string
+	userIO         sync.Mutex
+	ioWait         bool
+	inputChan      chan string
+	headless       bool
+	promptMutex    sync.Mutex
+	pendingPrompts map[uint32]*PendingPrompt
+	pendingOffers  map[uint32]*FolderOffer
+	lastPromptID   uint32
+}
+
+//PendingPrompt is a question asked by a headless instance which is waiting for an answer
+type PendingPrompt struct {
+	ID      uint32 `json:"id"`
+	Prompt  string `json:"prompt"`
+	AskedAt int64  `json:"asked_at"`
+	answer  chan string
+}
+
+//FolderOffer is a folder which a peer wants to sync, but which has not been added on this device yet
+type FolderOffer struct {
+	ID        uint32   `json:"id"`
+	Username  string   `json:"username"`
+	DeviceID  string   `json:"device_id"`
+	UniqueID  uint32   `json:"folder_id"`
+	Files     []string `json:"files"`
+	Md5Hashes []string `json:"md5_hashes"`
+	Dirs      []string `json:"dirs"`
+	OfferedAt int64    `json:"offered_at"`
+	answer    chan FolderOfferAnswer
+	//answered is closed once the offer is answered, so that a question asked on stdin can be given up
+	answered chan struct{}
+}
+
+//FolderOfferAnswer is the decision of the user on a FolderOffer. An accepted folder is created as Name inside
+//Directory
+type FolderOfferAnswer struct {
+	Accepted  bool   `json:"accepted"`
+	Directory string `json:"directory,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+//validate checks that an accepted folder can be created - Directory has to be an existing directory, and Name a plain
+//name which does not exist in it yet
+func (answer FolderOfferAnswer) validate() error {
+	if !answer.Accepted {
+		return nil
+	}
+	if fileStat, err := os.Stat(answer.Directory); err != nil || !fileStat.IsDir() {
+		return errors.New(answer.Directory + " is not a directory")
+	}
+	if answer.Name == "" || strings.ContainsAny(answer.Name, "/\\") || answer.Name == "." || answer.Name == ".." {
+		return errors.New("invalid folder name " + answer.Name)
+	}
+	if _, err := os.Stat(filepath.Join(answer.Directory, answer.Name)); !os.IsNotExist(err) {
+		return errors.New(filepath.Join(answer.Directory, answer.Name) + " already exists")
+	}
+	return nil
+}
+
+func newCLIController(inputChan chan string) *CLIController {
+	return &CLIController{
+		inputChan:      inputChan,
+		pendingPrompts: make(map[uint32]*PendingPrompt),
+		pendingOffers:  make(map[uint32]*FolderOffer),
+	}
+}
+
+func newHeadlessCLIController() *CLIController {
+	cliController := newCLIController(nil)
+	cliController.headless = true
+	return cliController
 }
 
 func (cliController *CLIController) getInput(prompt string) string {
+	text, _ := cliController.getInputWithin(prompt, 0)
+	return text
+}
+
+//getInputWithin asks for input like getInput, but gives up once timeout has passed without an answer, unless timeout
+//is 0. Returns false if the prompt was not answered in time
+func (cliController *CLIController) getInputWithin(prompt string, timeout time.Duration) (string, bool) {
+	return cliController.getInputUntil(prompt, timeout, nil)
+}
+
+//getInputUntil asks for input like getInputWithin, but also gives up once cancel is closed, as happens when the question
+//has been answered in another way
+func (cliController *CLIController) getInputUntil(prompt string, timeout time.Duration, cancel <-chan struct{}) (string, bool) {
+	if cliController.headless {
+		return cliController.waitForAnswerWithin(prompt, timeout, cancel)
+	}
 	cliController.lock()
+	defer cliController.unlock()
+	select {
+	case <-cancel:
+		return "", false
+	default:
+	}
 	cliController.ioWait = true
+	defer func() { cliController.ioWait = false }()
 	fmt.Println(prompt)
-	text := <-cliController.inputChan
-	cliController.ioWait = false
-	cliController.unlock()
-	return text
+	select {
+	case text := <-cliController.inputChan:
+		return text, true
+	case <-getTimeoutChan(timeout):
+		fmt.Println("No answer was given in time")
+		return "", false
+	case <-cancel:
+		fmt.Println("The question was answered elsewhere")
+		return "", false
+	}
+}
+
+//getTimeoutChan returns a channel which receives once timeout has passed, or never if timeout is 0
+func getTimeoutChan(timeout time.Duration) <-chan time.Time {
+	if timeout == 0 {
+		return nil
+	}
+	return time.After(timeout)
 }
 
 func (cliController *CLIController) getCommandInput(prompt string) string {
@@ -32,7 +144,158 @@ func (cliController *CLIController) getCommandInput(prompt string) string {
 	return trimmedText
 }
 
+//waitForAnswerWithin adds prompt to the pending prompts, and blocks till it is answered, till timeout has passed unless
+//timeout is 0, or till cancel is closed. A prompt which is not answered in time is removed from the pending prompts
+func (cliController *CLIController) waitForAnswerWithin(prompt string, timeout time.Duration, cancel <-chan struct{}) (string, bool) {
+	cliController.promptMutex.Lock()
+	cliController.lastPromptID++
+	pendingPrompt := &PendingPrompt{
+		ID:      cliController.lastPromptID,
+		Prompt:  prompt,
+		AskedAt: time.Now().UTC().Unix(),
+		answer:  make(chan string, 1),
+	}
+	cliController.pendingPrompts[pendingPrompt.ID] = pendingPrompt
+	cliController.promptMutex.Unlock()
+	log.Println("Waiting for an answer to prompt", pendingPrompt.ID, "-", prompt)
+	select {
+	case answer := <-pendingPrompt.answer:
+		return answer, true
+	case <-getTimeoutChan(timeout):
+	case <-cancel:
+	}
+	cliController.promptMutex.Lock()
+	defer cliController.promptMutex.Unlock()
+	delete(cliController.pendingPrompts, pendingPrompt.ID)
+	select {
+	case answer := <-pendingPrompt.answer:
+		//Answered just as the prompt timed out
+		return answer, true
+	default:
+		log.Println("Prompt", pendingPrompt.ID, "was not answered in time")
+		return "", false
+	}
+}
+
+func (cliController *CLIController) getPendingPrompts() []PendingPrompt {
+	cliController.promptMutex.Lock()
+	defer cliController.promptMutex.Unlock()
+	pendingPrompts := []PendingPrompt{}
+	for _, pendingPrompt := range cliController.pendingPrompts {
+		pendingPrompts = append(pendingPrompts, *pendingPrompt)
+	}
+	sort.Slice(pendingPrompts, func(i, j int) bool {
+		return pendingPrompts[i].ID < pendingPrompts[j].ID
+	})
+	return pendingPrompts
+}
+
+//answerPrompt answers the pending prompt with promptID, returning the prompt which was answered
+func (cliController *CLIController) answerPrompt(promptID uint32, answer string) (PendingPrompt, error) {
+	cliController.promptMutex.Lock()
+	defer cliController.promptMutex.Unlock()
+	pendingPrompt, exists := cliController.pendingPrompts[promptID]
+	if !exists {
+		return PendingPrompt{}, errors.New("no pending prompt with ID " + fmt.Sprint(promptID))
+	}
+	delete(cliController.pendingPrompts, promptID)
+	pendingPrompt.answer <- answer
+	return *pendingPrompt, nil
+}
+
+//getFolderOfferAnswer asks the user whether to accept a folder offered by a peer, and where to create it. The offer is
+//kept pending till it is accepted or rejected over the control socket or the API, or on stdin when not headless,
+//whichever answers first. A folder which is offered again by the same device while its offer is pending, as happens
+//when the device reconnects, is not offered twice - the repeated offer is left unaccepted
+func (cliController *CLIController) getFolderOfferAnswer(offer FolderOffer) FolderOfferAnswer {
+	cliController.promptMutex.Lock()
+	for _, pendingOffer := range cliController.pendingOffers {
+		if pendingOffer.DeviceID == offer.DeviceID && pendingOffer.UniqueID == offer.UniqueID {
+			cliController.promptMutex.Unlock()
+			log.Println(offer.Username, "offered folder", offer.UniqueID, "again, which is pending as offer", pendingOffer.ID)
+			return FolderOfferAnswer{}
+		}
+	}
+	cliController.lastPromptID++
+	offer.ID = cliController.lastPromptID
+	offer.OfferedAt = time.Now().UTC().Unix()
+	offer.answer = make(chan FolderOfferAnswer, 1)
+	offer.answered = make(chan struct{})
+	cliController.pendingOffers[offer.ID] = &offer
+	cliController.promptMutex.Unlock()
+	log.Println(offer.Username, "offered folder", offer.UniqueID, "as offer", offer.ID)
+	if !cliController.headless {
+		go cliController.askFolderOffer(offer)
+	}
+	return <-offer.answer
+}
+
+//askFolderOffer asks about a pending folder offer on stdin, giving up once the offer is answered in another way
+func (cliController *CLIController) askFolderOffer(offer FolderOffer) {
+	answer := FolderOfferAnswer{}
+	userResponse, answered := cliController.getInputUntil(offer.Username+" wants to sync a folder with the following details\n"+
+		"offer - "+fmt.Sprint(offer.ID)+"\nuniqueid - "+fmt.Sprint(offer.UniqueID)+"\n"+
+		"Files - "+strings.Join(offer.Files, ", ")+"\n"+
+		"Directories - "+strings.Join(offer.Dirs, ", ")+"\n"+
+		"MD5 Hashes - "+strings.Join(offer.Md5Hashes, ", ")+"\n"+
+		"Do you want to accept this folder?[y/n]", 0, offer.answered)
+	if !answered {
+		return
+	}
+	answer.Accepted = userResponse == "y"
+	//The folder is asked for again until it can be created
+	for answer.Accepted {
+		answer.Directory, answered = cliController.getInputUntil("Enter the directory where you want to create this folder", 0, offer.answered)
+		if !answered {
+			return
+		}
+		answer.Name, answered = cliController.getInputUntil("Enter the name of the folder you want to create", 0, offer.answered)
+		if !answered {
+			return
+		}
+		err := answer.validate()
+		if err == nil {
+			break
+		}
+		cliController.print(err.Error())
+	}
+	if _, err := cliController.answerOffer(offer.ID, answer); err != nil {
+		cliController.print("Offer " + fmt.Sprint(offer.ID) + " was already answered")
+	}
+}
+
+func (cliController *CLIController) getPendingOffers() []FolderOffer {
+	cliController.promptMutex.Lock()
+	defer cliController.promptMutex.Unlock()
+	pendingOffers := []FolderOffer{}
+	for _, pendingOffer := range cliController.pendingOffers {
+		pendingOffers = append(pendingOffers, *pendingOffer)
+	}
+	sort.Slice(pendingOffers, func(i, j int) bool {
+		return pendingOffers[i].ID < pendingOffers[j].ID
+	})
+	return pendingOffers
+}
+
+//answerOffer accepts or rejects the pending folder offer with offerID, returning the offer which was answered
+func (cliController *CLIController) answerOffer(offerID uint32, answer FolderOfferAnswer) (FolderOffer, error) {
+	cliController.promptMutex.Lock()
+	defer cliController.promptMutex.Unlock()
+	pendingOffer, exists := cliController.pendingOffers[offerID]
+	if !exists {
+		return FolderOffer{}, errors.New("no pending folder offer with ID " + fmt.Sprint(offerID))
+	}
+	delete(cliController.pendingOffers, offerID)
+	pendingOffer.answer <- answer
+	close(pendingOffer.answered)
+	return *pendingOffer, nil
+}
+
 func (cliController *CLIController) print(msg string) {
+	if cliController.headless {
+		log.Println(msg)
+		return
+	}
 	cliController.lock()
 	fmt.Println(msg)
 	cliController.unlock()
@@ -63,7 +326,12 @@ func (cliController *CLIController) startCli(folder FolderManager, peerManager P
 		text, _ := reader.ReadString('\n')
 		trimmedText := strings.Trim(text, "\n")
 		if cliController.ioWait {
-			cliController.inputChan <- trimmedText
+			select {
+			case cliController.inputChan <- trimmedText:
+			case <-time.After(time.Second):
+				//The prompt gave up waiting for an answer
+				fmt.Println("Ignoring ", text)
+			}
 			continue
 		}
 		switch trimmedText {
@@ -77,6 +345,27 @@ func (cliController *CLIController) startCli(folder FolderManager, peerManager P
 			cliController.print("Syncing " + folderPath)
 		case "print":
 			peerManager.printFileTransferStatus()
+		case "devices":
+			cliController.print(getTrustedDevicesStatus(peerManager.identity))
+		case "share":
+			folderPath := cliController.getCommandInput("Enter the folder path to be shared")
+			deviceID := cliController.getCommandInput("Enter the ID of the device to share it with")
+			handler := commandHandler{folderManager: folder, peerManager: peerManager}
+			absFolderPath, _ := filepath.Abs(folderPath)
+			_, err := handler.shareFolder(true, absFolderPath, deviceID)
+			if err != nil {
+				cliController.print(err.Error())
+				continue
+			}
+			cliController.print("Shared " + absFolderPath + " with " + deviceID)
+		case "ignore":
+			path := cliController.getCommandInput("Enter the path to be checked against .syncignore")
+			result, err := folder.checkIgnored(path)
+			if err != nil {
+				cliController.print(err.Error())
+				continue
+			}
+			cliController.print(result.String())
 		default:
 			if cliController.ioWait {
 				fmt.Println("Ignoring ", text)
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//waitForOffer returns the next folder offer raised by cliController
+func waitForOffer(t *testing.T, cliController *CLIController) FolderOffer {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if offers := cliController.getPendingOffers(); len(offers) > 0 {
+			return offers[0]
+		}
+	}
+	t.Fatal("no folder offer was raised")
+	return FolderOffer{}
+}
+
+func getOfferAnswer(cliController *CLIController, offer FolderOffer) chan FolderOfferAnswer {
+	answers := make(chan FolderOfferAnswer, 1)
+	go func() {
+		answers <- cliController.getFolderOfferAnswer(offer)
+	}()
+	return answers
+}
+
+func TestFolderOfferAnsweredOverAPIGivesUpStdin(t *testing.T) {
+	cliController := newCLIController(make(chan string))
+	answers := getOfferAnswer(cliController, FolderOffer{Username: "bob", DeviceID: "device", UniqueID: 1})
+	offer := waitForOffer(t, cliController)
+	apiAnswer := FolderOfferAnswer{Accepted: true, Directory: t.TempDir(), Name: "shared"}
+	if _, err := cliController.answerOffer(offer.ID, apiAnswer); err != nil {
+		t.Fatal(err)
+	}
+	if answer := <-answers; answer != apiAnswer {
+		t.Errorf("offer was answered with %+v, want %+v", answer, apiAnswer)
+	}
+	//The question on stdin must let go of the terminal
+	locked := make(chan bool)
+	go func() {
+		cliController.lock()
+		cliController.unlock()
+		locked <- true
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("question on stdin was not given up")
+	}
+}
+
+func TestFolderOfferAnsweredOnStdin(t *testing.T) {
+	inputChan := make(chan string)
+	cliController := newCLIController(inputChan)
+	answers := getOfferAnswer(cliController, FolderOffer{Username: "bob", DeviceID: "device", UniqueID: 1})
+	offer := waitForOffer(t, cliController)
+	directory := t.TempDir()
+	//Folders which cannot be created are asked for again
+	inputs := []string{"y", filepath.Join(directory, "missing"), "shared", directory, "..", directory, "shared"}
+	for _, input := range inputs {
+		inputChan <- input
+	}
+	want := FolderOfferAnswer{Accepted: true, Directory: directory, Name: "shared"}
+	if answer := <-answers; answer != want {
+		t.Errorf("offer was answered with %+v, want %+v", answer, want)
+	}
+	if _, err := cliController.answerOffer(offer.ID, FolderOfferAnswer{}); err == nil {
+		t.Error("offer answered on stdin could still be answered over the API")
+	}
+}
+
+func TestRepeatedFolderOfferIsNotAskedTwice(t *testing.T) {
+	for _, cliController := range []*CLIController{newCLIController(make(chan string)), newHeadlessCLIController()} {
+		offer := FolderOffer{Username: "bob", DeviceID: "device", UniqueID: 1}
+		answers := getOfferAnswer(cliController, offer)
+		pendingOffer := waitForOffer(t, cliController)
+		if answer := cliController.getFolderOfferAnswer(offer); answer.Accepted {
+			t.Error("repeated offer was accepted")
+		}
+		if offers := cliController.getPendingOffers(); len(offers) != 1 {
+			t.Errorf("%d offers are pending, want 1", len(offers))
+		}
+		cliController.answerOffer(pendingOffer.ID, FolderOfferAnswer{})
+		<-answers
+	}
+}
+
+func TestValidateFolderOfferAnswer(t *testing.T) {
+	directory := t.TempDir()
+	if err := os.Mkdir(filepath.Join(directory, "existing"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		answer FolderOfferAnswer
+		valid  bool
+	}{
+		{FolderOfferAnswer{}, true},
+		{FolderOfferAnswer{Accepted: true, Directory: directory, Name: "shared"}, true},
+		{FolderOfferAnswer{Accepted: true, Directory: filepath.Join(directory, "missing"), Name: "shared"}, false},
+		{FolderOfferAnswer{Accepted: true, Directory: directory, Name: ""}, false},
+		{FolderOfferAnswer{Accepted: true, Directory: directory, Name: ".."}, false},
+		{FolderOfferAnswer{Accepted: true, Directory: directory, Name: "a/b"}, false},
+		{FolderOfferAnswer{Accepted: true, Directory: directory, Name: "existing"}, false},
+	}
+	for _, test := range tests {
+		if err := test.answer.validate(); (err == nil) != test.valid {
+			t.Errorf("validating %+v gave %v", test.answer, err)
+		}
+	}
+}
@@ -0,0 +1,948 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+//Exit codes of the subcommands. exitNotRunning is used when a command needs the running instance and there is none,
+//and by status to report that syncIt is not running
+const (
+	exitOK         = 0
+	exitError      = 1
+	exitUsage      = 2
+	exitNotRunning = 3
+)
+
+var errNotRunning = errors.New("syncIt is not running")
+var errIndexedOnly = errors.New("syncIt is not running, the folder has been indexed and will be synced once it starts")
+
+//subcommandUsage lists the subcommands along with their arguments
+var subcommandUsage = [][]string{
+	{"add", "<path>", "Add a folder for syncing"},
+	{"sync", "<path>... | --all", "Sync added folders with the connected peers"},
+	{"status", "", "Show whether syncIt is running, along with the folders and peers"},
+	{"peers", "", "List the connected peers"},
+	{"folders", "", "List the added folders"},
+	{"remove", "<id>", "Stop syncing a folder, leaving its files in place"},
+	{"prompts", "", "List the questions the daemon is waiting to have answered"},
+	{"answer", "<prompt id> <answer>", "Answer a question asked by the daemon"},
+	{"offers", "", "List the folders offered by peers which are waiting to be accepted"},
+	{"accept", "<offer id> <directory> <name>", "Accept a folder offer, creating the folder as name inside directory"},
+	{"reject", "<offer id>", "Reject a folder offer"},
+	{"transfers", "", "List the files being sent and received"},
+	{"events", "", "Follow what the running instance is doing"},
+	{"versions", "<file>", "List the archived versions of a file in an added folder"},
+	{"restore", "<file> <version>", "Restore an archived version of a file, archiving the current copy"},
+	{"retention", "<path> last <count> | age <days> | staggered [days]", "Set which archived versions of a folder's files are kept"},
+	{"mode", "<path> send-receive | send-only | receive-only", "Set whether a folder sends its changes, receives changes or both"},
+	{"revert", "<path>", "Archive the local changes to a receive-only folder and receive the peer's copies again"},
+	{"devices", "", "List the devices paired with this one"},
+	{"share", "<path> <device id>", "Share a folder with a paired device"},
+	{"unshare", "<path> <device id>", "Stop sharing a folder with a device"},
+	{"ignore", "test <path>", "Check whether a path is excluded by the .syncignore of its folder"},
+}
+
+//FolderStatus describes a folder which has been added for syncing
+type FolderStatus struct {
+	ID         string          `json:"id"`
+	Path       string          `json:"path"`
+	Files      int             `json:"files"`
+	Dirs       int             `json:"dirs"`
+	LastSynced int64           `json:"last_synced"`
+	Mode       string          `json:"mode"`
+	Retention  RetentionPolicy `json:"retention"`
+	SharedWith []string        `json:"shared_with"`
+}
+
+//DeviceStatus describes a device which has been paired with this one
+type DeviceStatus struct {
+	DeviceID    string `json:"device_id"`
+	Username    string `json:"username"`
+	PairedAt    int64  `json:"paired_at"`
+	Connected   bool   `json:"connected"`
+	LastAddress string `json:"last_address,omitempty"`
+}
+
+//RevertResult is the result of the revert command, listing the files whose local changes were reverted
+type RevertResult struct {
+	Path  string   `json:"path"`
+	Files []string `json:"files"`
+}
+
+//InstanceStatus is the result of the status command
+type InstanceStatus struct {
+	Running  bool           `json:"running"`
+	Username string         `json:"username,omitempty"`
+	DeviceID string         `json:"device_id"`
+	Folders  []FolderStatus `json:"folders"`
+	Peers    []PeerStatus   `json:"peers"`
+}
+
+//commandHandler carries out the commands given through the subcommands. It runs inside the running instance, which
+//receives the commands over the control socket, or directly in the subcommand when there is no running instance
+type commandHandler struct {
+	folderManager FolderManager
+	peerManager   PeerManager
+	username      string
+	deviceID      string
+	running       bool
+}
+
+//execute carries out request, returning the JSON result
+func (handler commandHandler) execute(request ControlRequest) (json.RawMessage, error) {
+	var result interface{}
+	var err error
+	switch request.Command {
+	case "add":
+		if len(request.Args) != 1 {
+			return nil, errors.New("add needs a single folder path")
+		}
+		result, err = handler.addFolder(request.Args[0])
+	case "sync":
+		result, err = handler.syncFolders(request.Args)
+	case "remove":
+		if len(request.Args) != 1 {
+			return nil, errors.New("remove needs a single folder ID")
+		}
+		result, err = handler.removeFolder(request.Args[0])
+	case "folders":
+		result = handler.getFolderStatuses()
+	case "peers":
+		if !handler.running {
+			return nil, errNotRunning
+		}
+		result = handler.getPeerStatuses()
+	case "prompts":
+		if !handler.running {
+			return nil, errNotRunning
+		}
+		result = handler.folderManager.cliController.getPendingPrompts()
+	case "answer":
+		if !handler.running {
+			return nil, errNotRunning
+		}
+		if len(request.Args) != 2 {
+			return nil, errors.New("answer needs a prompt ID and the answer")
+		}
+		promptID, err := strconv.ParseUint(request.Args[0], 10, 32)
+		if err != nil {
+			return nil, errors.New("invalid prompt ID " + request.Args[0])
+		}
+		result, err = handler.folderManager.cliController.answerPrompt(uint32(promptID), request.Args[1])
+		if err != nil {
+			return nil, err
+		}
+	case "offers":
+		if !handler.running {
+			return nil, errNotRunning
+		}
+		result = handler.folderManager.cliController.getPendingOffers()
+	case "accept", "reject":
+		if !handler.running {
+			return nil, errNotRunning
+		}
+		result, err = handler.answerOffer(request.Command == "accept", request.Args)
+	case "transfers":
+		if !handler.running {
+			return nil, errNotRunning
+		}
+		result = handler.getTransferStatuses()
+	case "versions":
+		if len(request.Args) != 1 {
+			return nil, errors.New("versions needs a single file path")
+		}
+		uniqueID, fileName, err := handler.getFolderFile(request.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		result = handler.folderManager.getFileVersions(uniqueID, fileName)
+	case "restore":
+		if len(request.Args) != 2 {
+			return nil, errors.New("restore needs a file path and a version")
+		}
+		result, err = handler.restoreFile(request.Args[0], request.Args[1])
+	case "retention":
+		if len(request.Args) != 2 && len(request.Args) != 3 {
+			return nil, errors.New("retention needs a folder path, a policy and its value")
+		}
+		result, err = handler.setRetentionPolicy(request.Args[0], request.Args[1], strings.Join(request.Args[2:], ""))
+	case "mode":
+		if len(request.Args) != 2 {
+			return nil, errors.New("mode needs a folder path and the mode")
+		}
+		result, err = handler.setFolderMode(request.Args[0], request.Args[1])
+	case "revert":
+		if len(request.Args) != 1 {
+			return nil, errors.New("revert needs a single folder path")
+		}
+		result, err = handler.revertLocalChanges(request.Args[0])
+	case "devices":
+		result = handler.getDeviceStatuses()
+	case "share", "unshare":
+		if len(request.Args) != 2 {
+			return nil, errors.New(request.Command + " needs a folder path and a device ID")
+		}
+		result, err = handler.shareFolder(request.Command == "share", request.Args[0], request.Args[1])
+	case "ignore":
+		if len(request.Args) != 1 {
+			return nil, errors.New("ignore needs a single path")
+		}
+		result, err = handler.folderManager.checkIgnored(request.Args[0])
+	case "status":
+		result = InstanceStatus{
+			Running:  handler.running,
+			Username: handler.username,
+			DeviceID: handler.deviceID,
+			Folders:  handler.getFolderStatuses(),
+			Peers:    handler.getPeerStatuses(),
+		}
+	default:
+		return nil, errors.New("unknown command " + request.Command)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(result)
+}
+
+func (handler commandHandler) addFolder(folderPath string) (FolderStatus, error) {
+	fileStat, err := os.Stat(folderPath)
+	if err != nil {
+		return FolderStatus{}, err
+	}
+	if !fileStat.IsDir() {
+		return FolderStatus{}, errors.New(folderPath + " is not a directory")
+	}
+	if _, exists := handler.getFolderID(folderPath); exists {
+		return FolderStatus{}, errors.New(folderPath + " has already been added")
+	}
+	uniqueID := handler.folderManager.add(folderPath)
+	if uniqueID == 0 {
+		return FolderStatus{}, errors.New("could not create the config for " + folderPath)
+	}
+	return getFolderStatus(strconv.FormatInt(int64(uniqueID), 10), folderPath), nil
+}
+
+//syncFolders indexes and syncs the given folders, or all the added folders if none are given. Without a running
+//instance the folders are only indexed
+func (handler commandHandler) syncFolders(folderPaths []string) ([]FolderStatus, error) {
+	if len(folderPaths) == 0 {
+		folderPaths = handler.folderManager.getAllFolders()
+	}
+	for _, folderPath := range folderPaths {
+		if _, exists := handler.getFolderID(folderPath); !exists {
+			return nil, errors.New(folderPath + " has not been added, add it using syncit add")
+		}
+	}
+	statuses := []FolderStatus{}
+	for _, folderPath := range folderPaths {
+		handler.folderManager.sync(folderPath)
+		uniqueID, _ := handler.getFolderID(folderPath)
+		statuses = append(statuses, getFolderStatus(uniqueID, folderPath))
+	}
+	if !handler.running {
+		return nil, errIndexedOnly
+	}
+	return statuses, nil
+}
+
+func (handler commandHandler) removeFolder(uniqueIDString string) (FolderStatus, error) {
+	uniqueID, err := strconv.ParseUint(uniqueIDString, 10, 32)
+	if err != nil {
+		return FolderStatus{}, errors.New("invalid folder ID " + uniqueIDString)
+	}
+	folderPath := handler.folderManager.getFolderPath(uint32(uniqueID))
+	if folderPath == "" {
+		return FolderStatus{}, errors.New("no folder with ID " + uniqueIDString)
+	}
+	status := getFolderStatus(uniqueIDString, folderPath)
+	handler.folderManager.remove(uint32(uniqueID))
+	return status, nil
+}
+
+func (handler commandHandler) restoreFile(filePath string, versionID string) (FileVersion, error) {
+	uniqueID, fileName, err := handler.getFolderFile(filePath)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	for _, version := range handler.folderManager.getFileVersions(uniqueID, fileName) {
+		if version.Version == versionID {
+			return version, handler.folderManager.restoreFile(uniqueID, fileName, versionID)
+		}
+	}
+	return FileVersion{}, errors.New("no version " + versionID + " of " + filePath + ", list them using syncit versions")
+}
+
+func (handler commandHandler) setRetentionPolicy(folderPath string, policyType string, value string) (FolderStatus, error) {
+	uniqueIDString, exists := handler.getFolderID(folderPath)
+	if !exists {
+		return FolderStatus{}, errors.New(folderPath + " has not been added, add it using syncit add")
+	}
+	policy, err := getRetentionPolicy(policyType, value)
+	if err != nil {
+		return FolderStatus{}, err
+	}
+	uniqueID, _ := strconv.ParseUint(uniqueIDString, 10, 32)
+	handler.folderManager.setRetentionPolicy(uint32(uniqueID), policy)
+	return getFolderStatus(uniqueIDString, folderPath), nil
+}
+
+func (handler commandHandler) setFolderMode(folderPath string, mode string) (FolderStatus, error) {
+	uniqueIDString, exists := handler.getFolderID(folderPath)
+	if !exists {
+		return FolderStatus{}, errors.New(folderPath + " has not been added, add it using syncit add")
+	}
+	uniqueID, _ := strconv.ParseUint(uniqueIDString, 10, 32)
+	err := handler.folderManager.setFolderMode(uint32(uniqueID), mode)
+	if err != nil {
+		return FolderStatus{}, err
+	}
+	return getFolderStatus(uniqueIDString, folderPath), nil
+}
+
+func (handler commandHandler) revertLocalChanges(folderPath string) (RevertResult, error) {
+	uniqueIDString, exists := handler.getFolderID(folderPath)
+	if !exists {
+		return RevertResult{}, errors.New(folderPath + " has not been added, add it using syncit add")
+	}
+	uniqueID, _ := strconv.ParseUint(uniqueIDString, 10, 32)
+	revertedFiles, err := handler.folderManager.revertLocalChanges(uint32(uniqueID))
+	if err != nil {
+		return RevertResult{}, err
+	}
+	return RevertResult{Path: folderPath, Files: revertedFiles}, nil
+}
+
+//shareFolder shares the folder at folderPath with the device deviceID, or stops sharing it when shared is false
+func (handler commandHandler) shareFolder(shared bool, folderPath string, deviceID string) (FolderStatus, error) {
+	uniqueIDString, exists := handler.getFolderID(folderPath)
+	if !exists {
+		return FolderStatus{}, errors.New(folderPath + " has not been added, add it using syncit add")
+	}
+	uniqueID, _ := strconv.ParseUint(uniqueIDString, 10, 32)
+	isShared := handler.folderManager.isSharedWith(uint32(uniqueID), deviceID)
+	switch {
+	case shared && !isTrustedDevice(deviceID):
+		return FolderStatus{}, errors.New(deviceID + " has not been paired with this device, list the paired devices using syncit devices")
+	case shared:
+		handler.folderManager.shareFolder(uint32(uniqueID), deviceID)
+	case !isShared:
+		return FolderStatus{}, errors.New(folderPath + " is not shared with " + deviceID)
+	default:
+		handler.folderManager.unshareFolder(uint32(uniqueID), deviceID)
+	}
+	return getFolderStatus(uniqueIDString, folderPath), nil
+}
+
+//answerOffer accepts or rejects a pending folder offer. args holds the offer ID, followed by the directory and the name
+//of the folder to be created when accepting
+func (handler commandHandler) answerOffer(accepted bool, args []string) (FolderOffer, error) {
+	if (accepted && len(args) != 3) || (!accepted && len(args) != 1) {
+		return FolderOffer{}, errors.New("accept needs an offer ID, a directory and a folder name, reject only an offer ID")
+	}
+	offerID, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return FolderOffer{}, errors.New("invalid offer ID " + args[0])
+	}
+	answer := FolderOfferAnswer{Accepted: accepted}
+	if accepted {
+		answer.Directory, answer.Name = args[1], args[2]
+	}
+	if err := answer.validate(); err != nil {
+		return FolderOffer{}, err
+	}
+	return handler.folderManager.cliController.answerOffer(uint32(offerID), answer)
+}
+
+//getFolderID returns the ID of the added folder at folderPath, and whether there is one
+func (handler commandHandler) getFolderID(folderPath string) (string, bool) {
+	for uniqueID, addedFolderPath := range getGlobalConfig() {
+		if addedFolderPath == folderPath {
+			return uniqueID, true
+		}
+	}
+	return "", false
+}
+
+//getFolderFile finds the added folder containing the file at filePath, returning the ID of the folder along with the
+//name of the file in its index
+func (handler commandHandler) getFolderFile(filePath string) (uint32, string, error) {
+	for uniqueIDString, folderPath := range getGlobalConfig() {
+		relativePath, err := filepath.Rel(folderPath, filePath)
+		if err != nil || relativePath == "." || relativePath == ".." ||
+			strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+			continue
+		}
+		fileName := filepath.ToSlash(relativePath)
+		if fileName == ".syncIt" || strings.HasPrefix(fileName, ".syncIt/") {
+			return 0, "", errors.New(filePath + " is part of the syncIt config of " + folderPath)
+		}
+		uniqueID, _ := strconv.ParseUint(uniqueIDString, 10, 32)
+		return uint32(uniqueID), fileName, nil
+	}
+	return 0, "", errors.New(filePath + " is not inside an added folder")
+}
+
+func (handler commandHandler) getFolderStatuses() []FolderStatus {
+	statuses := []FolderStatus{}
+	for uniqueID, folderPath := range getGlobalConfig() {
+		statuses = append(statuses, getFolderStatus(uniqueID, folderPath))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Path < statuses[j].Path
+	})
+	return statuses
+}
+
+func (handler commandHandler) getPeerStatuses() []PeerStatus {
+	statuses := []PeerStatus{}
+	for _, peer := range handler.peerManager.getConnectedPeers() {
+		statuses = append(statuses, peer.getStatus())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Username < statuses[j].Username
+	})
+	return statuses
+}
+
+func (handler commandHandler) getDeviceStatuses() []DeviceStatus {
+	connectedDevices := make(map[string]bool)
+	for _, peer := range handler.peerManager.getConnectedPeers() {
+		connectedDevices[peer.deviceID] = true
+	}
+	statuses := []DeviceStatus{}
+	for deviceID, trustedDevice := range getTrustedDevices() {
+		statuses = append(statuses, DeviceStatus{
+			DeviceID:    deviceID,
+			Username:    trustedDevice.Username,
+			PairedAt:    trustedDevice.PairedAt,
+			Connected:   connectedDevices[deviceID],
+			LastAddress: trustedDevice.LastAddress,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Username < statuses[j].Username
+	})
+	return statuses
+}
+
+func (handler commandHandler) getTransferStatuses() []TransferStatus {
+	statuses := []TransferStatus{}
+	for _, peer := range handler.peerManager.getConnectedPeers() {
+		statuses = append(statuses, peer.getTransferStatuses()...)
+	}
+	return statuses
+}
+
+func getFolderStatus(uniqueID string, folderPath string) FolderStatus {
+	status := FolderStatus{ID: uniqueID, Path: folderPath}
+	configPath := folderPath + "/.syncIt/.syncIt.json"
+	if _, err := os.Stat(configPath); err != nil {
+		return status
+	}
+	syncData := getSyncData(folderPath, configPath)
+	status.Files = len(syncData.Files)
+	status.Dirs = len(syncData.Dirs)
+	status.LastSynced = syncData.LastSynced
+	status.Mode = syncData.Mode
+	if status.Mode == "" {
+		status.Mode = folderSendReceive
+	}
+	status.Retention = syncData.Retention.orDefault()
+	status.SharedWith = syncData.SharedWith
+	if status.SharedWith == nil {
+		status.SharedWith = []string{}
+	}
+	return status
+}
+
+func isSubcommand(name string) bool {
+	if name == "help" {
+		return true
+	}
+	for _, usage := range subcommandUsage {
+		if usage[0] == name {
+			return true
+		}
+	}
+	return false
+}
+
+//runSubcommand runs the subcommand name with the given command line arguments, returning the exit code. The command
+//is carried out by the running instance if there is one, and directly on the config of this device otherwise
+func runSubcommand(name string, args []string) int {
+	if name == "help" {
+		printUsage()
+		return exitOK
+	}
+	flags := flag.NewFlagSet("syncit "+name, flag.ContinueOnError)
+	jsonOutput := flags.Bool("json", false, "Print the result as JSON")
+	syncAll := flags.Bool("all", false, "Sync all the added folders (sync only)")
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			return exitUsage
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	request, err := getControlRequest(name, positional, *syncAll)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		printUsage()
+		return exitUsage
+	}
+	log.SetOutput(ioutil.Discard)
+	if name == "events" {
+		return followEvents(*jsonOutput)
+	}
+	data, err := executeSubcommand(request)
+	if err != nil {
+		if *jsonOutput {
+			errorJSON, _ := json.Marshal(map[string]string{"error": err.Error()})
+			fmt.Println(string(errorJSON))
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if err == errNotRunning || err == errIndexedOnly {
+			return exitNotRunning
+		}
+		return exitError
+	}
+	if *jsonOutput {
+		fmt.Println(string(data))
+	} else {
+		err = printResult(name, data)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+	}
+	if name == "status" {
+		status := InstanceStatus{}
+		json.Unmarshal(data, &status)
+		if !status.Running {
+			return exitNotRunning
+		}
+	}
+	return exitOK
+}
+
+//getControlRequest validates the arguments of a subcommand and turns them into a ControlRequest
+func getControlRequest(name string, args []string, syncAll bool) (ControlRequest, error) {
+	request := ControlRequest{Command: name, Args: []string{}}
+	switch name {
+	case "add":
+		if len(args) != 1 {
+			return request, errors.New("add needs a single folder path")
+		}
+	case "sync":
+		if syncAll == (len(args) > 0) {
+			return request, errors.New("sync needs either folder paths or --all")
+		}
+	case "remove":
+		if len(args) != 1 {
+			return request, errors.New("remove needs a single folder ID")
+		}
+		request.Args = args
+		return request, nil
+	case "reject":
+		if len(args) != 1 {
+			return request, errors.New("reject needs a single offer ID")
+		}
+		request.Args = args
+		return request, nil
+	case "accept":
+		if len(args) != 3 {
+			return request, errors.New("accept needs an offer ID, a directory and a folder name")
+		}
+		directory, err := filepath.Abs(args[1])
+		if err != nil {
+			return request, err
+		}
+		request.Args = []string{args[0], directory, args[2]}
+		return request, nil
+	case "versions":
+		if len(args) != 1 {
+			return request, errors.New("versions needs a single file path")
+		}
+	case "restore":
+		if len(args) != 2 {
+			return request, errors.New("restore needs a file path and a version")
+		}
+		filePath, err := filepath.Abs(args[0])
+		if err != nil {
+			return request, err
+		}
+		request.Args = []string{filePath, args[1]}
+		return request, nil
+	case "retention", "mode":
+		if name == "retention" && len(args) != 2 && len(args) != 3 {
+			return request, errors.New("retention needs a folder path, a policy and its value")
+		}
+		if name == "mode" && len(args) != 2 {
+			return request, errors.New("mode needs a folder path and the mode")
+		}
+		folderPath, err := filepath.Abs(args[0])
+		if err != nil {
+			return request, err
+		}
+		request.Args = append([]string{folderPath}, args[1:]...)
+		return request, nil
+	case "revert":
+		if len(args) != 1 {
+			return request, errors.New("revert needs a single folder path")
+		}
+	case "share", "unshare":
+		if len(args) != 2 {
+			return request, errors.New(name + " needs a folder path and a device ID")
+		}
+		folderPath, err := filepath.Abs(args[0])
+		if err != nil {
+			return request, err
+		}
+		request.Args = []string{folderPath, args[1]}
+		return request, nil
+	case "ignore":
+		if len(args) != 2 || args[0] != "test" {
+			return request, errors.New("ignore needs test and a path")
+		}
+		absPath, err := filepath.Abs(args[1])
+		if err != nil {
+			return request, err
+		}
+		request.Args = []string{absPath}
+		return request, nil
+	case "answer":
+		if len(args) < 2 {
+			return request, errors.New("answer needs a prompt ID and the answer")
+		}
+		request.Args = []string{args[0], strings.Join(args[1:], " ")}
+		return request, nil
+	default:
+		if len(args) != 0 {
+			return request, errors.New(name + " does not take any arguments")
+		}
+	}
+	for _, path := range args {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return request, err
+		}
+		request.Args = append(request.Args, absPath)
+	}
+	return request, nil
+}
+
+func executeSubcommand(request ControlRequest) (json.RawMessage, error) {
+	conn, err := dialControl()
+	if err == nil {
+		return sendControlRequest(conn, request)
+	}
+	//Without a running instance no peers are connected
+	peerManager := PeerManager{connectedPeers: make(map[string]*Peer), peersMutex: &sync.Mutex{}}
+	handler := commandHandler{
+		folderManager: FolderManager{cliController: &CLIController{}, peermanager: peerManager},
+		peerManager:   peerManager,
+		deviceID:      loadOrCreateIdentity().deviceID,
+	}
+	return handler.execute(request)
+}
+
+//followEvents prints the events of the running instance as they happen, until it stops
+func followEvents(jsonOutput bool) int {
+	conn, err := dialControl()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, errNotRunning)
+		return exitNotRunning
+	}
+	defer conn.Close()
+	err = json.NewEncoder(conn).Encode(ControlRequest{Command: "events", Args: []string{}})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	decoder := json.NewDecoder(conn)
+	for {
+		event := json.RawMessage{}
+		if err := decoder.Decode(&event); err != nil {
+			fmt.Fprintln(os.Stderr, "syncIt stopped")
+			return exitOK
+		}
+		if jsonOutput {
+			fmt.Println(string(event))
+			continue
+		}
+		decodedEvent := Event{}
+		json.Unmarshal(event, &decodedEvent)
+		fmt.Println(formatTimestamp(decodedEvent.Time), decodedEvent.Message)
+	}
+}
+
+//printResult prints the JSON result of the subcommand name in a human readable form
+func printResult(name string, data json.RawMessage) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer writer.Flush()
+	switch name {
+	case "add":
+		status := FolderStatus{}
+		if err := json.Unmarshal(data, &status); err != nil {
+			return err
+		}
+		fmt.Fprintln(writer, "Added", status.Path, "with ID", status.ID+",", status.Files, "files indexed")
+		fmt.Fprintln(writer, "Share it with a paired device using syncit share", status.Path, "<device id>")
+	case "sync":
+		statuses := []FolderStatus{}
+		if err := json.Unmarshal(data, &statuses); err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			fmt.Fprintln(writer, "Syncing", status.Path)
+		}
+	case "remove":
+		status := FolderStatus{}
+		if err := json.Unmarshal(data, &status); err != nil {
+			return err
+		}
+		fmt.Fprintln(writer, "Removed", status.Path+", its files have been left in place")
+	case "folders":
+		statuses := []FolderStatus{}
+		if err := json.Unmarshal(data, &statuses); err != nil {
+			return err
+		}
+		printFolderStatuses(writer, statuses)
+	case "peers":
+		statuses := []PeerStatus{}
+		if err := json.Unmarshal(data, &statuses); err != nil {
+			return err
+		}
+		printPeerStatuses(writer, statuses)
+	case "prompts":
+		pendingPrompts := []PendingPrompt{}
+		if err := json.Unmarshal(data, &pendingPrompts); err != nil {
+			return err
+		}
+		if len(pendingPrompts) == 0 {
+			fmt.Fprintln(writer, "No prompts are waiting for an answer")
+		}
+		for _, pendingPrompt := range pendingPrompts {
+			fmt.Fprintln(writer, "Prompt", pendingPrompt.ID, "asked at", formatTimestamp(pendingPrompt.AskedAt))
+			fmt.Fprintln(writer, pendingPrompt.Prompt)
+			fmt.Fprintln(writer)
+		}
+	case "offers":
+		pendingOffers := []FolderOffer{}
+		if err := json.Unmarshal(data, &pendingOffers); err != nil {
+			return err
+		}
+		if len(pendingOffers) == 0 {
+			fmt.Fprintln(writer, "No folders are waiting to be accepted")
+		}
+		for _, offer := range pendingOffers {
+			fmt.Fprintln(writer, "Offer", offer.ID, "from", offer.Username, "at", formatTimestamp(offer.OfferedAt))
+			fmt.Fprintln(writer, "Folder ID -", offer.UniqueID)
+			fmt.Fprintln(writer, "Files -", strings.Join(offer.Files, ", "))
+			fmt.Fprintln(writer, "Directories -", strings.Join(offer.Dirs, ", "))
+			fmt.Fprintln(writer)
+		}
+	case "accept", "reject":
+		offer := FolderOffer{}
+		if err := json.Unmarshal(data, &offer); err != nil {
+			return err
+		}
+		fmt.Fprintln(writer, map[string]string{"accept": "Accepted", "reject": "Rejected"}[name]+" folder", offer.UniqueID, "offered by", offer.Username)
+	case "versions":
+		versions := []FileVersion{}
+		if err := json.Unmarshal(data, &versions); err != nil {
+			return err
+		}
+		if len(versions) == 0 {
+			fmt.Fprintln(writer, "No versions of the file have been archived")
+			return nil
+		}
+		fmt.Fprintln(writer, "VERSION\tSAVED AT\tSIZE")
+		for _, version := range versions {
+			fmt.Fprintf(writer, "%s\t%s\t%d\n", version.Version, formatTimestamp(version.SavedAt), version.Size)
+		}
+	case "restore":
+		version := FileVersion{}
+		if err := json.Unmarshal(data, &version); err != nil {
+			return err
+		}
+		fmt.Fprintln(writer, "Restored", version.Name, "to the version saved at", formatTimestamp(version.SavedAt))
+	case "retention":
+		status := FolderStatus{}
+		if err := json.Unmarshal(data, &status); err != nil {
+			return err
+		}
+		fmt.Fprintln(writer, "Archived versions in", status.Path, "will", status.Retention.String())
+	case "mode":
+		status := FolderStatus{}
+		if err := json.Unmarshal(data, &status); err != nil {
+			return err
+		}
+		fmt.Fprintln(writer, status.Path, "is now", status.Mode)
+	case "devices":
+		statuses := []DeviceStatus{}
+		if err := json.Unmarshal(data, &statuses); err != nil {
+			return err
+		}
+		if len(statuses) == 0 {
+			fmt.Fprintln(writer, "No devices have been paired")
+			return nil
+		}
+		fmt.Fprintln(writer, "USERNAME\tDEVICE ID\tPAIRED AT\tCONNECTED\tLAST ADDRESS")
+		for _, status := range statuses {
+			lastAddress := status.LastAddress
+			if lastAddress == "" {
+				lastAddress = "-"
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%t\t%s\n", status.Username, status.DeviceID, formatTimestamp(status.PairedAt),
+				status.Connected, lastAddress)
+		}
+	case "share", "unshare":
+		status := FolderStatus{}
+		if err := json.Unmarshal(data, &status); err != nil {
+			return err
+		}
+		if len(status.SharedWith) == 0 {
+			fmt.Fprintln(writer, status.Path, "is not shared with any device")
+			return nil
+		}
+		fmt.Fprintln(writer, status.Path, "is shared with", strings.Join(status.SharedWith, ", "))
+	case "revert":
+		revertResult := RevertResult{}
+		if err := json.Unmarshal(data, &revertResult); err != nil {
+			return err
+		}
+		if len(revertResult.Files) == 0 {
+			fmt.Fprintln(writer, "There were no local changes to revert in", revertResult.Path)
+			return nil
+		}
+		fmt.Fprintln(writer, "Reverted", strings.Join(revertResult.Files, ", "), "in", revertResult.Path)
+	case "transfers":
+		statuses := []TransferStatus{}
+		if err := json.Unmarshal(data, &statuses); err != nil {
+			return err
+		}
+		if len(statuses) == 0 {
+			fmt.Fprintln(writer, "No files are being transferred")
+			return nil
+		}
+		fmt.Fprintln(writer, "PEER\tDIRECTION\tFOLDER\tFILE\tPROGRESS")
+		for _, status := range statuses {
+			fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%d/%d\n", status.Username, status.Direction, status.FolderID, status.File,
+				status.Transferred, status.Size)
+		}
+	case "ignore":
+		ignoreResult := IgnoreResult{}
+		if err := json.Unmarshal(data, &ignoreResult); err != nil {
+			return err
+		}
+		fmt.Fprintln(writer, ignoreResult.String())
+	case "answer":
+		pendingPrompt := PendingPrompt{}
+		if err := json.Unmarshal(data, &pendingPrompt); err != nil {
+			return err
+		}
+		fmt.Fprintln(writer, "Answered prompt", pendingPrompt.ID)
+	case "status":
+		status := InstanceStatus{}
+		if err := json.Unmarshal(data, &status); err != nil {
+			return err
+		}
+		if status.Running {
+			fmt.Fprintln(writer, "syncIt is running as", status.Username)
+		} else {
+			fmt.Fprintln(writer, "syncIt is not running")
+		}
+		fmt.Fprintln(writer, "Device ID", status.DeviceID)
+		fmt.Fprintln(writer)
+		printFolderStatuses(writer, status.Folders)
+		if status.Running {
+			fmt.Fprintln(writer)
+			printPeerStatuses(writer, status.Peers)
+		}
+	}
+	return nil
+}
+
+func printFolderStatuses(writer *tabwriter.Writer, statuses []FolderStatus) {
+	if len(statuses) == 0 {
+		fmt.Fprintln(writer, "No folders have been added")
+		return
+	}
+	fmt.Fprintln(writer, "ID\tPATH\tMODE\tFILES\tSHARED WITH\tLAST SYNCED")
+	for _, status := range statuses {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%d devices\t%s\n", status.ID, status.Path, status.Mode, status.Files,
+			len(status.SharedWith), formatTimestamp(status.LastSynced))
+	}
+}
+
+func printPeerStatuses(writer *tabwriter.Writer, statuses []PeerStatus) {
+	if len(statuses) == 0 {
+		fmt.Fprintln(writer, "No peers are connected")
+		return
+	}
+	fmt.Fprintln(writer, "USERNAME\tDEVICE ID\tADDRESS\tVERSION\tCONNECTED SINCE\tLAST SEEN\tRTT\tRECEIVING\tSENDING\tREJECTED")
+	for _, status := range statuses {
+		rtt := "-"
+		if status.RTTMillis > 0 {
+			rtt = strconv.FormatFloat(status.RTTMillis, 'f', 1, 64) + "ms"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\n", status.Username, status.DeviceID, status.Address,
+			status.SoftwareVersion, formatTimestamp(int64(status.ConnectedAt)), formatTimestamp(status.LastSeen), rtt,
+			len(status.ReceivingFiles), len(status.SendingFiles), status.RejectedCount)
+	}
+	for _, status := range statuses {
+		if status.LastRejection != "" {
+			fmt.Fprintln(writer, "Last request rejected from", status.Username, "-", status.LastRejection)
+		}
+	}
+}
+
+func formatTimestamp(timestamp int64) string {
+	if timestamp == 0 {
+		return "never"
+	}
+	return time.Unix(timestamp, 0).Local().Format("2006-01-02 15:04:05")
+}
+
+func printUsage() {
+	writer := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "Usage:")
+	fmt.Fprintln(writer, "  syncit -u <username> [-api <address>] [limits]\tRun syncIt interactively")
+	fmt.Fprintln(writer, "  syncit daemon -u <username> [-api <address>] [limits]\tRun syncIt in the background, controlled through the commands below")
+	for _, subcommand := range subcommandUsage {
+		command := strings.Join([]string{"syncit", subcommand[0], subcommand[1], "[--json]"}, " ")
+		fmt.Fprintln(writer, "  "+strings.Replace(command, "  ", " ", 1)+"\t"+subcommand[2])
+	}
+	fmt.Fprintln(writer, "Limits on peers:")
+	fmt.Fprintln(writer, "  -max-frame-size <bytes>\tLargest message accepted from peers, "+strconv.Itoa(defaultMaxFrameSize)+" by default")
+	fmt.Fprintln(writer, "  -max-rejections <count>\tBan peers after this many rejected messages, "+strconv.Itoa(defaultMaxRejections)+" by default, 0 to never ban")
+	fmt.Fprintln(writer, "  -ban-duration <duration>\tHow long banned peers are refused for, "+defaultBanDuration.String()+" by default")
+	fmt.Fprintln(writer, "  -keepalive-interval <duration>\tHow often peers are pinged, "+defaultKeepaliveInterval.String()+" by default")
+	fmt.Fprintln(writer, "  -keepalive-timeout <duration>\tDisconnect peers silent for longer than this, "+defaultKeepaliveTimeout.String()+" by default")
+	fmt.Fprintln(writer, "  -max-index-entries <count>\tIndex entries buffered from a peer at most, "+strconv.Itoa(defaultMaxIndexEntries)+" by default")
+	fmt.Fprintln(writer, "  -max-index-size <bytes>\tBytes of index buffered from a peer at most, "+strconv.Itoa(defaultMaxIndexSize)+" by default")
+	fmt.Fprintln(writer, "Environment:")
+	fmt.Fprintln(writer, "  SYNCIT_CONFIG_DIR\tDirectory holding the identity, trusted devices and folders of this installation, ~/.syncIt by default")
+	writer.Flush()
+}
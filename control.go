@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"time"
+)
+
+//ControlRequest is sent over the control socket to the running instance, asking it to carry out a command. Paths in
+//Args are always absolute, as the running instance can have a different working directory
+type ControlRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+//ControlResponse is the reply of the running instance to a ControlRequest. Data holds the JSON result of the command
+//if it succeeded, and Error the reason otherwise
+type ControlResponse struct {
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+var errAlreadyRunning = errors.New("syncIt is already running")
+
+//getControlSocketPath returns the path of the unix socket on which the running instance accepts commands
+func getControlSocketPath() string {
+	return getGlobalConfigFolder() + "/control.sock"
+}
+
+//startControlServer listens on the control socket and carries out the commands sent to it using handler. A socket
+//left behind by an instance which is no longer running is replaced, but an instance which is still running is not
+func startControlServer(handler commandHandler) error {
+	socketPath := getControlSocketPath()
+	if conn, err := dialControl(); err == nil {
+		conn.Close()
+		return errAlreadyRunning
+	}
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	os.Chmod(socketPath, 0600)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Println("Stopped accepting commands", err)
+				return
+			}
+			go serveControlConn(conn, handler)
+		}
+	}()
+	return nil
+}
+
+//serveControlConn reads a single request from conn, and replies with the result of carrying it out
+func serveControlConn(conn net.Conn, handler commandHandler) {
+	defer conn.Close()
+	request := ControlRequest{}
+	err := json.NewDecoder(conn).Decode(&request)
+	if err == io.EOF {
+		return
+	}
+	if err != nil {
+		log.Println("Invalid control request", err)
+		return
+	}
+	if request.Command == "events" {
+		streamEventsToConn(conn)
+		return
+	}
+	response := ControlResponse{}
+	data, err := handler.execute(request)
+	if err != nil {
+		response.Error = err.Error()
+	} else {
+		response.Data = data
+	}
+	json.NewEncoder(conn).Encode(response)
+}
+
+//streamEventsToConn writes every event to conn as a line of JSON, until the subcommand following them disconnects
+func streamEventsToConn(conn net.Conn) {
+	subscriber, _ := events.subscribe(math.MaxUint64)
+	defer events.unsubscribe(subscriber)
+	closed := make(chan bool)
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+	encoder := json.NewEncoder(conn)
+	for {
+		select {
+		case event, open := <-subscriber:
+			if !open || encoder.Encode(event) != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+func dialControl() (net.Conn, error) {
+	return net.DialTimeout("unix", getControlSocketPath(), time.Second)
+}
+
+//sendControlRequest carries out request on the running instance through conn, returning the JSON result
+func sendControlRequest(conn net.Conn, request ControlRequest) (json.RawMessage, error) {
+	defer conn.Close()
+	err := json.NewEncoder(conn).Encode(request)
+	if err != nil {
+		return nil, err
+	}
+	response := ControlResponse{}
+	err = json.NewDecoder(conn).Decode(&response)
+	if err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+	return response.Data, nil
+}
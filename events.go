@@ -0,0 +1,159 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+//Types of the events published on the event bus
+const (
+	eventPeerConnected    = "peer_connected"
+	eventPeerDisconnected = "peer_disconnected"
+	eventPeerFlagged      = "peer_flagged"
+	eventPeerBanned       = "peer_banned"
+	eventFolderOffered    = "folder_offered"
+	eventFolderAdded      = "folder_added"
+	eventIndexUpdated     = "index_updated"
+	eventTransferStarted  = "transfer_started"
+	eventTransferProgress = "transfer_progress"
+	eventTransferFinished = "transfer_finished"
+	eventTransferFailed   = "transfer_failed"
+	eventConflictDetected = "conflict_detected"
+)
+
+//recentEventsLength is how many of the latest events are kept, so that a subscriber which reconnects can catch up on
+//what it missed
+const recentEventsLength = 256
+
+//subscriberBufferLength is how many events can be queued for a subscriber. A subscriber which falls further behind
+//is dropped, and has to subscribe again
+const subscriberBufferLength = 256
+
+//Event is something which syncIt did, along with a human readable message describing it. Data holds one of the
+//*EventData structs, depending on the type of the event
+type Event struct {
+	ID      uint64      `json:"id"`
+	Type    string      `json:"type"`
+	Time    int64       `json:"time"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data"`
+}
+
+//PeerEventData is the data of the peer_connected and peer_disconnected events
+type PeerEventData struct {
+	Username        string `json:"username"`
+	DeviceID        string `json:"device_id"`
+	Address         string `json:"address"`
+	SoftwareVersion string `json:"software_version,omitempty"`
+}
+
+//PeerFlaggedEventData is the data of the peer_flagged event, published when a request from a peer is rejected, and of
+//the peer_banned event, published when a peer is banned for having too many of its requests rejected
+type PeerFlaggedEventData struct {
+	PeerEventData
+	Reason        string `json:"reason"`
+	RejectedCount int    `json:"rejected_count"`
+}
+
+//FolderEventData is the data of the folder_offered, folder_added and index_updated events
+type FolderEventData struct {
+	FolderID   uint32 `json:"folder_id"`
+	Path       string `json:"path,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Files      int    `json:"files"`
+	Dirs       int    `json:"dirs"`
+	Tombstones int    `json:"tombstones"`
+}
+
+//TransferEventData is the data of the transfer events. Error is only set for transfer_failed
+type TransferEventData struct {
+	TransferStatus
+	Error string `json:"error,omitempty"`
+}
+
+//ConflictEventData is the data of the conflict_detected event
+type ConflictEventData struct {
+	FolderID     uint32 `json:"folder_id"`
+	File         string `json:"file"`
+	Username     string `json:"username"`
+	ConflictCopy string `json:"conflict_copy"`
+}
+
+//EventBus hands every published event to all the current subscribers
+type EventBus struct {
+	mutex        sync.Mutex
+	lastID       uint64
+	recentEvents []Event
+	subscribers  map[chan Event]bool
+}
+
+//events is the event bus of this instance, to which everything that happens is published
+var events = &EventBus{subscribers: make(map[chan Event]bool)}
+
+func (bus *EventBus) publish(eventType string, message string, data interface{}) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.lastID++
+	event := Event{ID: bus.lastID, Type: eventType, Time: time.Now().UTC().Unix(), Message: message, Data: data}
+	bus.recentEvents = append(bus.recentEvents, event)
+	if len(bus.recentEvents) > recentEventsLength {
+		bus.recentEvents = bus.recentEvents[1:]
+	}
+	for subscriber := range bus.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			delete(bus.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+//subscribe returns a channel receiving all the events published from now on, along with the recent events after
+//sinceID. The channel is closed if the subscriber falls behind
+func (bus *EventBus) subscribe(sinceID uint64) (chan Event, []Event) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	missedEvents := []Event{}
+	for _, event := range bus.recentEvents {
+		if event.ID > sinceID {
+			missedEvents = append(missedEvents, event)
+		}
+	}
+	subscriber := make(chan Event, subscriberBufferLength)
+	bus.subscribers[subscriber] = true
+	return subscriber, missedEvents
+}
+
+func (bus *EventBus) unsubscribe(subscriber chan Event) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	if bus.subscribers[subscriber] {
+		delete(bus.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+//printEvents prints the message of every event as it is published, catching up on the missed events if it falls
+//behind. Progress events are left out, as they are only useful to dashboards
+func printEvents(cliController *CLIController) {
+	subscriber, _ := events.subscribe(math.MaxUint64)
+	lastPrintedID := uint64(0)
+	for {
+		for event := range subscriber {
+			lastPrintedID = event.ID
+			if event.Type != eventTransferProgress {
+				cliController.print(event.Message)
+			}
+		}
+		var missedEvents []Event
+		subscriber, missedEvents = events.subscribe(lastPrintedID)
+		for _, event := range missedEvents {
+			lastPrintedID = event.ID
+			if event.Type != eventTransferProgress {
+				cliController.print(event.Message)
+			}
+		}
+	}
+}
@@ -2,57 +2,258 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"github.com/akshay1713/goUtils"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
+//pieceSize is the size of the pieces whose hashes are stored in the folder config, and the unit in which changed parts of
+//a file are requested
+const pieceSize = 524288
+
 type TransferFile struct {
 	filePath        string
+	fileName        string
+	folderPath      string
 	fileSize        uint64
 	transferredSize uint64
 	md5             string
 	filePtr         *os.File
 	uniqueID        uint32
 	modTime         uint32
+	//pieceIndices is set when only some pieces of the file are being transferred
+	pieceIndices []uint32
+	//tempPath is the temp file under .syncIt into which a file being received is written
+	tempPath string
+	//attempt counts how many times a file being received has been requested after failing verification
+	attempt int
+	//version and pieceHashes are those announced by the peer for a file being received, and are recorded in the index
+	//once it has been received
+	version     VersionVector
+	pieceHashes []string
 }
 
+//maxReceiveAttempts is the number of times a file is requested before a copy which does not match the announced hash is
+//given up on
+const maxReceiveAttempts = 3
+
+var errHashMismatch = errors.New("received file does not match the announced hash")
+
 func (file *TransferFile) getNextBytes() []byte {
-	remainingSize := int(file.fileSize - file.transferredSize)
-	if remainingSize == 0 {
+	if file.transferredSize >= file.fileSize {
 		return []byte{}
 	}
 	//Transfer in chunks of 4096 bytes
-	bytesToTransfer := 4096
-	if remainingSize < 4096 {
+	bytesToTransfer := uint64(4096)
+	if remainingSize := file.fileSize - file.transferredSize; remainingSize < 4096 {
 		bytesToTransfer = remainingSize
-		fmt.Println("Finished sending file", file.filePath)
 	}
-	nextBytes := make([]byte, int(bytesToTransfer))
-	file.transferredSize += uint64(bytesToTransfer)
+	nextBytes := make([]byte, bytesToTransfer)
+	file.transferredSize += bytesToTransfer
 	file.filePtr.Read(nextBytes)
 	return nextBytes
 }
 
+//getFileName returns the name of the file relative to its synced folder, which is how it is identified in messages
 func (file TransferFile) getFileName() string {
+	if file.fileName != "" {
+		return file.fileName
+	}
 	return filepath.Base(file.filePath)
 }
 
 func (file *TransferFile) writeBytes(fileData []byte) bool {
 	_, err := file.filePtr.Write(fileData)
 	goUtils.HandleErr(err, "While writing to file")
+	previousPiece := file.transferredSize / pieceSize
 	file.transferredSize += uint64(len(fileData))
+	if file.tempPath != "" && file.transferredSize/pieceSize != previousPiece {
+		file.saveProgress()
+	}
 	if file.transferredSize == file.fileSize {
 		file.filePtr.Close()
-		fmt.Println("Finished receiving file", file.getFileName())
 		return true
 	}
 	return false
 }
 
+//getPieceBytes reads the piece at pieceIndex. The last piece of a file may be shorter than pieceSize, and a piece
+//beyond the end of the file is empty
+func (file *TransferFile) getPieceBytes(pieceIndex uint32) []byte {
+	offset := uint64(pieceIndex) * pieceSize
+	if offset >= file.fileSize {
+		return []byte{}
+	}
+	pieceBytes := make([]byte, getPieceLength(file.fileSize, pieceIndex))
+	_, err := file.filePtr.ReadAt(pieceBytes, int64(offset))
+	goUtils.HandleErr(err, "While reading piece of file")
+	return pieceBytes
+}
+
+//writeBytesAt writes part of a piece at the given offset. Returns true once all the requested pieces have been
+//received
+func (file *TransferFile) writeBytesAt(fileData []byte, offset uint64) bool {
+	_, err := file.filePtr.WriteAt(fileData, int64(offset))
+	goUtils.HandleErr(err, "While writing piece to file")
+	file.transferredSize += uint64(len(fileData))
+	if file.transferredSize == file.getTransferSize() {
+		file.filePtr.Close()
+		return true
+	}
+	return false
+}
+
+//getTransferSize returns the number of bytes which will be transferred, which is less than the file size when only some
+//of its pieces are requested
+func (file TransferFile) getTransferSize() uint64 {
+	if len(file.pieceIndices) == 0 {
+		return file.fileSize
+	}
+	transferSize := uint64(0)
+	for i := range file.pieceIndices {
+		transferSize += getPieceLength(file.fileSize, file.pieceIndices[i])
+	}
+	return transferSize
+}
+
+func getPieceLength(fileSize uint64, pieceIndex uint32) uint64 {
+	offset := uint64(pieceIndex) * pieceSize
+	if offset >= fileSize {
+		return 0
+	}
+	if fileSize-offset < pieceSize {
+		return fileSize - offset
+	}
+	return pieceSize
+}
+
+//getChangedPieces compares the piece hashes of the local copy of a file with those announced by a peer, and returns the
+//indices of the pieces which differ. An empty result means that the whole file has to be requested
+func getChangedPieces(currentPieceHashes []string, newPieceHashes []string) []uint32 {
+	changedPieces := []uint32{}
+	if len(currentPieceHashes) == 0 || len(newPieceHashes) == 0 {
+		return changedPieces
+	}
+	for i := range newPieceHashes {
+		if i >= len(currentPieceHashes) || currentPieceHashes[i] != newPieceHashes[i] {
+			changedPieces = append(changedPieces, uint32(i))
+		}
+	}
+	if len(changedPieces) == len(newPieceHashes) {
+		return []uint32{}
+	}
+	return changedPieces
+}
+
+//TransferProgress is stored next to a file which is being received into a temp file, so that an interrupted transfer of
+//the same version of the file can be resumed
+type TransferProgress struct {
+	Name            string `json:"name"`
+	Md5             string `json:"md5"`
+	Size            uint64 `json:"size"`
+	ModTime         uint32 `json:"mod_time"`
+	TransferredSize uint64 `json:"transferred_size"`
+}
+
+func (file TransferFile) saveProgress() {
+	progress := TransferProgress{
+		Name:            file.getFileName(),
+		Md5:             file.md5,
+		Size:            file.fileSize,
+		ModTime:         file.modTime,
+		TransferredSize: file.transferredSize,
+	}
+	progressBytes, _ := json.Marshal(progress)
+	err := ioutil.WriteFile(file.tempPath+".progress", progressBytes, 0755)
+	goUtils.HandleErr(err, "While saving transfer progress for "+file.getFileName())
+}
+
+func loadTransferProgress(tempPath string) (TransferProgress, error) {
+	progress := TransferProgress{}
+	progressBytes, err := ioutil.ReadFile(tempPath + ".progress")
+	if err != nil {
+		return progress, err
+	}
+	err = json.Unmarshal(progressBytes, &progress)
+	return progress, err
+}
+
+//verify checks a file received into a temp file against the announced md5 hash. The temp file and its progress record
+//are discarded if they do not match
+func (file TransferFile) verify() error {
+	if file.tempPath == "" || file.md5 == "" {
+		return nil
+	}
+	md5, err := getMD5Hash(file.tempPath)
+	if err != nil {
+		return err
+	}
+	if md5 != file.md5 {
+		os.Remove(file.tempPath)
+		os.Remove(file.tempPath + ".progress")
+		return errHashMismatch
+	}
+	return nil
+}
+
+//complete atomically moves a verified temp file over the actual path, applies the sender's mod time and removes the
+//progress record
+func (file TransferFile) complete() error {
+	if file.tempPath == "" {
+		return nil
+	}
+	err := os.Rename(file.tempPath, file.filePath)
+	if err != nil {
+		return err
+	}
+	os.Remove(file.tempPath + ".progress")
+	modTime := time.Unix(int64(file.modTime), 0)
+	return os.Chtimes(file.filePath, modTime, modTime)
+}
+
+//getSyncFile returns the details of the file as announced by the peer, which are needed to request it again
+func (file TransferFile) getSyncFile() SyncFile {
+	pieceHashes := file.pieceHashes
+	if pieceHashes == nil {
+		pieceHashes = []string{}
+	}
+	return SyncFile{
+		Name:        file.getFileName(),
+		Md5:         file.md5,
+		Size:        file.fileSize,
+		ModTime:     file.modTime,
+		PieceHashes: pieceHashes,
+		PieceCount:  uint32(len(pieceHashes)),
+		Version:     file.version,
+	}
+}
+
+//getVerifiedOffset returns the length of the prefix of a partially received file whose pieces match pieceHashes. Only
+//this prefix is kept when the transfer is resumed
+func getVerifiedOffset(tempPath string, pieceHashes []string) uint64 {
+	filePtr, err := os.Open(tempPath)
+	if err != nil {
+		return 0
+	}
+	defer filePtr.Close()
+	verifiedOffset := uint64(0)
+	pieceBytes := make([]byte, pieceSize)
+	for i := range pieceHashes {
+		readSize, _ := io.ReadFull(filePtr, pieceBytes)
+		if readSize == 0 || getSha1(pieceBytes[:readSize]) != pieceHashes[i] {
+			break
+		}
+		verifiedOffset += uint64(readSize)
+	}
+	return verifiedOffset
+}
+
 type MultipleTransferFiles []TransferFile
 
 func (multipleFiles MultipleTransferFiles) remove(filePath string) MultipleTransferFiles {
@@ -60,8 +261,6 @@ func (multipleFiles MultipleTransferFiles) remove(filePath string) MultipleTrans
 		if multipleFiles[i].filePath == filePath {
 			multipleFiles[i].filePtr.Close()
 			multipleFiles = append(multipleFiles[:i], multipleFiles[i+1:]...)
-			lockFile := filePath + ".lock"
-			os.Remove(lockFile)
 			return multipleFiles
 		}
 	}
@@ -98,19 +297,194 @@ type SyncFile struct {
 	PieceHashes []string `json:"piece_hashes"`
 	PieceCount  uint32   `json:"piece_count"`
 	ModTime     uint32   `json:"mod_time"`
+	//Version counts the changes made to the file on every device
+	Version VersionVector `json:"version"`
+}
+
+//Tombstone records the deletion of a file from a synced folder, so that the deletion can be sent to peers instead of
+//the file being recreated from their copy
+type Tombstone struct {
+	Name      string `json:"name"`
+	Md5       string `json:"md5"`
+	DeletedAt uint32 `json:"deleted_at"`
+	//Version is the version vector of the file when it was deleted, counting the deletion as one more change
+	Version VersionVector `json:"version"`
 }
 
 type SyncData struct {
-	UniqueID   uint32     `json:"unique_id"`
-	Files      []SyncFile `json:"files"`
-	Synced     bool       `json:"synced"`
-	LastSynced int64      `json:"last_synced"`
+	UniqueID   uint32          `json:"unique_id"`
+	Files      []SyncFile      `json:"files"`
+	Dirs       []string        `json:"dirs"`
+	Tombstones []Tombstone     `json:"tombstones"`
+	Synced     bool            `json:"synced"`
+	LastSynced int64           `json:"last_synced"`
+	Retention  RetentionPolicy `json:"retention"`
+	Mode       string          `json:"mode,omitempty"`
+	SharedWith []string        `json:"shared_with"`
+}
+
+//isSharedWith reports whether the folder is shared with the device deviceID. Folders are only announced to, and only
+//accept requests and changes from, the devices they are shared with
+func (syncData SyncData) isSharedWith(deviceID string) bool {
+	for i := range syncData.SharedWith {
+		if syncData.SharedWith[i] == deviceID {
+			return true
+		}
+	}
+	return false
 }
 
 func (syncData *SyncData) update(folderPath string, configPath string) {
-	syncData.Files = addMultipleFiles(folderPath, configPath, syncData.UniqueID)
+	oldFiles := syncData.Files
+	syncData.Files, syncData.Dirs = indexFolder(folderPath, oldFiles)
+	syncData.updateTombstones(oldFiles)
 	syncData.Synced = true
 	syncData.LastSynced = time.Now().UTC().Unix()
+	syncData.save(configPath)
+}
+
+//updateTombstones adds a tombstone for every file in oldFiles which no longer exists, and drops the tombstones of
+//files which have been created again since they were deleted. A file created again continues from the version of its
+//deletion, so that peers which accepted the deletion see it as newer rather than deleted
+func (syncData *SyncData) updateTombstones(oldFiles []SyncFile) {
+	currentFiles := make(map[string]int)
+	for i := range syncData.Files {
+		currentFiles[syncData.Files[i].Name] = i
+	}
+	tombstones := []Tombstone{}
+	for i := range syncData.Tombstones {
+		fileIndex, recreated := currentFiles[syncData.Tombstones[i].Name]
+		if !recreated {
+			tombstones = append(tombstones, syncData.Tombstones[i])
+			continue
+		}
+		file := &syncData.Files[fileIndex]
+		if file.Version.compare(syncData.Tombstones[i].Version) != versionNewer {
+			file.Version = syncData.Tombstones[i].Version.merge(file.Version).increment(getLocalDeviceID())
+		}
+	}
+	syncData.Tombstones = tombstones
+	deletedAt := uint32(time.Now().UTC().Unix())
+	for i := range oldFiles {
+		if _, exists := currentFiles[oldFiles[i].Name]; !exists {
+			syncData.addTombstone(Tombstone{
+				Name:      oldFiles[i].Name,
+				Md5:       oldFiles[i].Md5,
+				DeletedAt: deletedAt,
+				Version:   oldFiles[i].Version.increment(getLocalDeviceID()),
+			})
+		}
+	}
+}
+
+//addTombstone removes the file from the index and records its deletion. If the file already has a tombstone, the
+//newer deletion is kept, and concurrent deletions are merged
+func (syncData *SyncData) addTombstone(tombstone Tombstone) {
+	files := []SyncFile{}
+	for i := range syncData.Files {
+		if syncData.Files[i].Name != tombstone.Name {
+			files = append(files, syncData.Files[i])
+		}
+	}
+	syncData.Files = files
+	for i := range syncData.Tombstones {
+		if syncData.Tombstones[i].Name == tombstone.Name {
+			existing := syncData.Tombstones[i]
+			switch tombstone.Version.compare(existing.Version) {
+			case versionNewer:
+				syncData.Tombstones[i] = tombstone
+			case versionConcurrent:
+				syncData.Tombstones[i].Version = existing.Version.merge(tombstone.Version)
+				if tombstone.DeletedAt > existing.DeletedAt {
+					syncData.Tombstones[i].DeletedAt = tombstone.DeletedAt
+				}
+			case versionEqual:
+				//The same deletion, or deletions recorded before version vectors were tracked
+				if tombstone.DeletedAt > existing.DeletedAt {
+					syncData.Tombstones[i] = tombstone
+				}
+			}
+			return
+		}
+	}
+	syncData.Tombstones = append(syncData.Tombstones, tombstone)
+}
+
+func (syncData SyncData) getTombstones() map[string]Tombstone {
+	tombstones := make(map[string]Tombstone)
+	for i := range syncData.Tombstones {
+		tombstones[syncData.Tombstones[i].Name] = syncData.Tombstones[i]
+	}
+	return tombstones
+}
+
+func (syncData SyncData) save(configPath string) {
+	syncDataBytes, _ := json.Marshal(syncData)
+	ioutil.WriteFile(configPath, syncDataBytes, 0755)
+}
+
+//hasSameContents reports whether two versions of the index describe the same files, directories and deletions
+func (syncData SyncData) hasSameContents(otherSyncData SyncData) bool {
+	if len(syncData.Files) != len(otherSyncData.Files) || len(syncData.Dirs) != len(otherSyncData.Dirs) ||
+		len(syncData.Tombstones) != len(otherSyncData.Tombstones) {
+		return false
+	}
+	otherFiles := make(map[string]string)
+	for i := range otherSyncData.Files {
+		otherFiles[otherSyncData.Files[i].Name] = otherSyncData.Files[i].Md5
+	}
+	for i := range syncData.Files {
+		if md5, exists := otherFiles[syncData.Files[i].Name]; !exists || md5 != syncData.Files[i].Md5 {
+			return false
+		}
+	}
+	for i := range syncData.Dirs {
+		if goUtils.Pos(otherSyncData.Dirs, syncData.Dirs[i]) == -1 {
+			return false
+		}
+	}
+	otherTombstones := otherSyncData.getTombstones()
+	for i := range syncData.Tombstones {
+		if _, exists := otherTombstones[syncData.Tombstones[i].Name]; !exists {
+			return false
+		}
+	}
+	return true
+}
+
+//forCapabilities returns a copy of the index without the parts which a peer with the given capabilities would not
+//understand - files in nested directories, deletions, piece hashes and version vectors
+func (syncData SyncData) forCapabilities(capabilities map[string]bool) SyncData {
+	files := []SyncFile{}
+	for _, file := range syncData.Files {
+		if !capabilities[capRecursiveFolders] && strings.Contains(file.Name, "/") {
+			continue
+		}
+		if !capabilities[capDeltaTransfer] {
+			file.PieceHashes = []string{}
+			file.PieceCount = 0
+		}
+		if !capabilities[capVersionVectors] {
+			file.Version = VersionVector{}
+		}
+		files = append(files, file)
+	}
+	syncData.Files = files
+	if !capabilities[capVersionVectors] {
+		tombstones := []Tombstone{}
+		for _, tombstone := range syncData.Tombstones {
+			tombstone.Version = VersionVector{}
+			tombstones = append(tombstones, tombstone)
+		}
+		syncData.Tombstones = tombstones
+	}
+	if !capabilities[capRecursiveFolders] {
+		syncData.Dirs = []string{}
+	}
+	if !capabilities[capTombstones] {
+		syncData.Tombstones = []Tombstone{}
+	}
+	return syncData
 }
 
 func (syncData SyncData) getAllFiles() []SyncFile {
@@ -138,21 +512,54 @@ func getSyncData(folderPath string, configPath string) SyncData {
 	return syncData
 }
 
-func addMultipleFiles(folderPath string, configPath string, uniqueID uint32) []SyncFile {
+//addMultipleFiles indexes every file under folderPath, including those in nested directories, and writes the result to
+//the folder config. Returns the indexed files along with the relative paths of all the directories in the folder
+func addMultipleFiles(folderPath string, configPath string, uniqueID uint32) ([]SyncFile, []string) {
+	files, dirNames := indexFolder(folderPath, []SyncFile{})
+	syncData := SyncData{Files: files, Dirs: dirNames, UniqueID: uniqueID}
+	syncData.save(configPath)
+	return files, dirNames
+}
+
+//indexFolder computes the hashes, size and mod time of every file under folderPath. Entries in previousFiles whose size
+//and mod time have not changed are reused without hashing the file again
+func indexFolder(folderPath string, previousFiles []SyncFile) ([]SyncFile, []string) {
 	files := []SyncFile{}
-	fileNames := getFileNamesInFolder(folderPath)
+	indexedFiles := make(map[string]SyncFile)
+	for i := range previousFiles {
+		indexedFiles[previousFiles[i].Name] = previousFiles[i]
+	}
+	fileNames, dirNames := walkFolder(folderPath)
 	for i := range fileNames {
-		md5, _ := getMD5Hash(folderPath + "/" + fileNames[i])
-		filePtr, _ := os.Open(folderPath + "/" + fileNames[i])
-		fileStat, _ := filePtr.Stat()
+		filePath := getLocalPath(folderPath, fileNames[i])
+		fileStat, err := os.Stat(filePath)
+		if err != nil {
+			log.Println("Error while indexing file", err)
+			continue
+		}
 		fileSize := uint64(fileStat.Size())
 		modTime := uint32(fileStat.ModTime().UTC().Unix())
+		indexedFile, exists := indexedFiles[fileNames[i]]
+		if exists && len(indexedFile.Version) == 0 {
+			//Indexed before version vectors were tracked
+			indexedFile.Version = VersionVector{}.increment(getLocalDeviceID())
+		}
+		if exists && indexedFile.Size == fileSize && indexedFile.ModTime == modTime {
+			files = append(files, indexedFile)
+			continue
+		}
+		md5, _ := getMD5Hash(filePath)
+		version := indexedFile.Version
+		if !exists || indexedFile.Md5 != md5 {
+			version = version.increment(getLocalDeviceID())
+		}
+		filePtr, _ := os.Open(filePath)
 		pieceHashes := []string{}
 		pieceCount := 0
 		for readSize := uint64(0); readSize < fileSize; {
 			remaining := fileSize - readSize
-			if remaining > 524288 {
-				remaining = 524288
+			if remaining > pieceSize {
+				remaining = pieceSize
 			}
 			nextBytes := make([]byte, remaining)
 			filePtr.Read(nextBytes)
@@ -161,6 +568,7 @@ func addMultipleFiles(folderPath string, configPath string, uniqueID uint32) []S
 			pieceCount++
 			readSize += remaining
 		}
+		filePtr.Close()
 		files = append(files, SyncFile{
 			Md5:         md5,
 			Name:        fileNames[i],
@@ -168,11 +576,9 @@ func addMultipleFiles(folderPath string, configPath string, uniqueID uint32) []S
 			PieceCount:  uint32(pieceCount),
 			PieceHashes: pieceHashes,
 			ModTime:     modTime,
+			Version:     version,
 		})
 
 	}
-	syncData := SyncData{Files: files, UniqueID: uniqueID}
-	syncDataBytes, _ := json.Marshal(syncData)
-	ioutil.WriteFile(configPath, syncDataBytes, 0755)
-	return files
+	return files, dirNames
 }
@@ -5,9 +5,9 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 )
 
 func getMD5Hash(filePath string) (string, error) {
@@ -31,15 +31,53 @@ func getMD5Hash(filePath string) (string, error) {
 
 }
 
-func getFileNamesInFolder(folderPath string) []string {
-	files, _ := ioutil.ReadDir(folderPath)
+//walkFolder recursively walks folderPath, skipping the .syncIt config directory and everything excluded by .syncignore,
+//and returns the relative paths of all the files and directories found
+func walkFolder(folderPath string) ([]string, []string) {
 	filesInFolder := []string{}
-	for _, f := range files {
-		if !f.IsDir() {
-			filesInFolder = append(filesInFolder, f.Name())
+	dirsInFolder := []string{}
+	ignoreMatcher := loadIgnoreMatcher(folderPath)
+	filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Println("Error while walking folder", err)
+			return nil
 		}
-	}
-	return filesInFolder
+		relPath, err := filepath.Rel(folderPath, path)
+		if err != nil || relPath == "." {
+			return nil
+		}
+		relPath = filepath.ToSlash(relPath)
+		if info.IsDir() {
+			if relPath == ".syncIt" || ignoreMatcher.isIgnored(relPath, true) {
+				return filepath.SkipDir
+			}
+			dirsInFolder = append(dirsInFolder, relPath)
+			return nil
+		}
+		if ignoreMatcher.isIgnored(relPath, false) {
+			return nil
+		}
+		filesInFolder = append(filesInFolder, relPath)
+		return nil
+	})
+	return filesInFolder, dirsInFolder
+}
+
+//getLocalPath converts a relative "/" separated file name, as used in the config and in messages, to a path inside
+//folderPath
+func getLocalPath(folderPath string, fileName string) string {
+	return filepath.Join(folderPath, filepath.FromSlash(fileName))
+}
+
+//getPartialFilePath returns the path of the temp file under .syncIt into which fileName is received
+func getPartialFilePath(folderPath string, fileName string) string {
+	return getLocalPath(folderPath+"/.syncIt/partial", fileName)
+}
+
+//getLockFilePath returns the path of the lock file used while receiving fileName. Lock files are kept under .syncIt so
+//that they are never mistaken for files of the folder
+func getLockFilePath(folderPath string, fileName string) string {
+	return getLocalPath(folderPath+"/.syncIt/locks/receiving", fileName+".lock")
 }
 
 func getSha1(target []byte) string {
@@ -48,3 +86,19 @@ func getSha1(target []byte) string {
 	sha1hash := hex.EncodeToString(h.Sum(nil))
 	return sha1hash
 }
+
+//copyFile copies the contents of srcPath to dstPath, creating or truncating dstPath
+func copyFile(srcPath string, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(dstPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0755)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestWalkFolderIndexesLockFilesOfTheFolder(t *testing.T) {
+	folderPath := t.TempDir()
+	for _, fileName := range []string{"yarn.lock", "rust/Cargo.lock", "a.txt"} {
+		if err := os.MkdirAll(filepath.Dir(getLocalPath(folderPath, fileName)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(getLocalPath(folderPath, fileName), []byte(fileName), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, lockFile := range []string{getLockFilePath(folderPath, "a.txt"), getLockFilePath(folderPath, "rust/Cargo.lock")} {
+		if err := os.MkdirAll(filepath.Dir(lockFile), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(lockFile, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileNames, dirNames := walkFolder(folderPath)
+	sort.Strings(fileNames)
+	if want := []string{"a.txt", "rust/Cargo.lock", "yarn.lock"}; !reflect.DeepEqual(fileNames, want) {
+		t.Errorf("walkFolder found files %v, want %v", fileNames, want)
+	}
+	if want := []string{"rust"}; !reflect.DeepEqual(dirNames, want) {
+		t.Errorf("walkFolder found dirs %v, want %v", dirNames, want)
+	}
+}
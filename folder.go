@@ -2,16 +2,36 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/akshay1713/goUtils"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/user"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
+//Modes of a folder. A send-receive folder announces its changes to peers and takes theirs, a send-only folder ignores
+//the changes made by peers and a receive-only folder never announces its local changes
+const (
+	folderSendReceive = "send-receive"
+	folderSendOnly    = "send-only"
+	folderReceiveOnly = "receive-only"
+)
+
+//RemoteIndex is the last index announced by a peer for a receive-only folder, to which the local changes are reverted
+type RemoteIndex struct {
+	DeviceID   string      `json:"device_id"`
+	Username   string      `json:"username"`
+	Files      []SyncFile  `json:"files"`
+	Dirs       []string    `json:"dirs"`
+	Tombstones []Tombstone `json:"tombstones"`
+}
+
 type FolderManager struct {
 	peermanager   PeerManager
 	cliController *CLIController
@@ -34,10 +54,26 @@ func (folder FolderManager) setupFolderConfig(folderPath string) string {
 	return configFile
 }
 
-func (folder FolderManager) add(folderPath string) {
+func (folder FolderManager) add(folderPath string) uint32 {
 	configFile := folder.setupFolderConfig(folderPath)
+	if configFile == "" {
+		return 0
+	}
 	uniqueID := folder.addNewFolderToGlobal(folderPath)
-	_ = addMultipleFiles(folderPath, configFile, uniqueID)
+	_, _ = addMultipleFiles(folderPath, configFile, uniqueID)
+	publishFolderAdded(folderPath, getSyncData(folderPath, configFile), "Added "+folderPath)
+	return uniqueID
+}
+
+//remove stops syncing the folder with uniqueID. Only the index of the folder is deleted, the files in it and their
+//backups are left in place
+func (folder FolderManager) remove(uniqueID uint32) {
+	folderPath := folder.getFolderPath(uniqueID)
+	globalConfigJson := getGlobalConfig()
+	delete(globalConfigJson, strconv.FormatInt(int64(uniqueID), 10))
+	marshalledConfig, _ := json.Marshal(globalConfigJson)
+	ioutil.WriteFile(getGlobalConfigFile(), marshalledConfig, 0755)
+	os.Remove(folderPath + "/.syncIt/.syncIt.json")
 }
 
 func (folder FolderManager) addNewFolderToGlobal(folderPath string) uint32 {
@@ -61,24 +97,74 @@ func (folder FolderManager) addToGlobal(absFolderPath string, uniqueID uint32) {
 
 func (folder FolderManager) sync(folderPath string) {
 	syncData := folder.updateExistingFolderConfig(folderPath)
-	filesInFolder := syncData.getAllFiles()
-	fileNames := []string{}
-	fileSizes := []uint64{}
-	md5Hashes := []string{}
-	modTimes := []uint32{}
-	for i := range filesInFolder {
-		fileNames = append(fileNames, filesInFolder[i].Name)
-		fileSizes = append(fileSizes, filesInFolder[i].Size)
-		md5Hashes = append(md5Hashes, filesInFolder[i].Md5)
-		modTimes = append(modTimes, filesInFolder[i].ModTime)
+	if syncData.Mode == folderReceiveOnly {
+		publishIndexUpdated(folderPath, syncData, "Indexed "+folderPath+", local changes to receive-only folders are not sent")
+		return
 	}
-	syncReqMsg := getSyncReqMsg(syncData.UniqueID, 1, fileNames, fileSizes, md5Hashes, modTimes)
-	folder.peermanager.sendToAllPeers(syncReqMsg)
+	publishIndexUpdated(folderPath, syncData, "Syncing "+folderPath)
+	folder.sendSyncReq(syncData)
+}
+
+//publishIndexUpdated publishes the index_updated event for a folder whose index has just been saved
+func publishIndexUpdated(folderPath string, syncData SyncData, message string) {
+	events.publish(eventIndexUpdated, message, FolderEventData{
+		FolderID:   syncData.UniqueID,
+		Path:       folderPath,
+		Files:      len(syncData.Files),
+		Dirs:       len(syncData.Dirs),
+		Tombstones: len(syncData.Tombstones),
+	})
+}
+
+//publishFolderAdded publishes the folder_added event for a folder which has just been added to the global config
+func publishFolderAdded(folderPath string, syncData SyncData, message string) {
+	events.publish(eventFolderAdded, message, FolderEventData{
+		FolderID:   syncData.UniqueID,
+		Path:       folderPath,
+		Files:      len(syncData.Files),
+		Dirs:       len(syncData.Dirs),
+		Tombstones: len(syncData.Tombstones),
+	})
+}
+
+//syncIfChanged updates the index of an already added folder, and sends a sync request to all the peers only if the
+//files, directories or deletions in the folder have changed since it was last indexed
+func (folder FolderManager) syncIfChanged(folderPath string) {
+	syncFolder := folderPath + "/.syncIt"
+	if _, err := os.Stat(syncFolder + "/.syncIt.json"); os.IsNotExist(err) {
+		log.Println("Not syncing", folderPath, "as it has not been added")
+		return
+	}
+	oldSyncData := getSyncData(folderPath, syncFolder+"/.syncIt.json")
+	syncData := oldSyncData
+	syncData.update(folderPath, syncFolder+"/.syncIt.json")
+	if syncData.hasSameContents(oldSyncData) {
+		return
+	}
+	if syncData.Mode == folderReceiveOnly {
+		publishIndexUpdated(folderPath, syncData, "Local changes found in receive-only folder "+folderPath+
+			", revert them using syncit revert")
+		return
+	}
+	publishIndexUpdated(folderPath, syncData, "Changes found in "+folderPath+", syncing with peers")
+	folder.sendSyncReq(syncData)
+}
+
+func (folder FolderManager) sendSyncReq(syncData SyncData) {
+	if syncData.Mode == folderReceiveOnly {
+		log.Println("Not announcing receive-only folder", syncData.UniqueID)
+		return
+	}
+	if len(syncData.SharedWith) == 0 {
+		log.Println("Not announcing folder", syncData.UniqueID, "as it is not shared with any device")
+		return
+	}
+	folder.peermanager.sendSyncReqToSharedPeers(syncData)
 }
 
 func (folder FolderManager) updateExistingFolderConfig(folderPath string) SyncData {
 	syncFolder := folderPath + "/.syncIt"
-	if _, err := os.Stat(syncFolder); os.IsNotExist(err) {
+	if _, err := os.Stat(syncFolder + "/.syncIt.json"); os.IsNotExist(err) {
 		folder.cliController.print("This is an unsynced folder, adding it for syncing")
 		folder.add(folderPath)
 	}
@@ -110,27 +196,267 @@ func (folder FolderManager) getFolderPath(uniqueID uint32) string {
 	return getGlobalConfig()[uniqueIDstring]
 }
 
+//backupExistingFiles archives the files about to be replaced or deleted by changes from a peer under
+//.syncIt/versions, keeping as many of their earlier versions as the retention policy of the folder allows
 func (folder FolderManager) backupExistingFiles(uniqueID uint32, fileNames []string) string {
 	folderPath := folder.getFolderPath(uniqueID)
-	syncFolder := folderPath + "/.syncIt"
+	ignoreMatcher := loadIgnoreMatcher(folderPath)
+	policy := getSyncData(folderPath, folderPath+"/.syncIt/.syncIt.json").Retention
 	for i := range fileNames {
-		log.Println("Moving ", fileNames[i])
-		currentFilePath := folderPath + "/" + fileNames[i]
-		newFilePath := syncFolder + "/" + fileNames[i] + ".bak"
-		os.Rename(currentFilePath, newFilePath)
+		if ignoreMatcher.isIgnored(fileNames[i], false) {
+			log.Println("Not moving ignored file", fileNames[i])
+			continue
+		}
+		if _, err := os.Stat(getLocalPath(folderPath, fileNames[i])); os.IsNotExist(err) {
+			continue
+		}
+		log.Println("Archiving ", fileNames[i])
+		err := archiveFile(folderPath, fileNames[i], policy)
+		goUtils.HandleErr(err, "While archiving "+fileNames[i])
 	}
 	return folderPath
 }
 
-func (folder FolderManager) restoreFile(uniqueID uint32, fileName string) {
+//addTombstones records the deletions received from a peer in the folder config, so that they are not undone by the
+//next update and are passed on to other peers
+func (folder FolderManager) addTombstones(uniqueID uint32, tombstones []Tombstone) {
+	folderPath := folder.getFolderPath(uniqueID)
+	configPath := folderPath + "/.syncIt/.syncIt.json"
+	syncData := getSyncData(folderPath, configPath)
+	for i := range tombstones {
+		syncData.addTombstone(tombstones[i])
+	}
+	syncData.save(configPath)
+}
+
+//getIndexedFile returns the entry of fileName in the index of the folder with uniqueID, and whether there is one
+func (folder FolderManager) getIndexedFile(uniqueID uint32, fileName string) (SyncFile, bool) {
+	folderPath := folder.getFolderPath(uniqueID)
+	syncData := getSyncData(folderPath, folderPath+"/.syncIt/.syncIt.json")
+	for i := range syncData.Files {
+		if syncData.Files[i].Name == fileName {
+			return syncData.Files[i], true
+		}
+	}
+	return SyncFile{}, false
+}
+
+//updateIndexedFiles replaces the index entries of the given files, such as files just received from a peer, so that
+//their version vectors are kept rather than being counted as local changes by the next update
+func (folder FolderManager) updateIndexedFiles(uniqueID uint32, files []SyncFile) {
+	if len(files) == 0 {
+		return
+	}
+	folderPath := folder.getFolderPath(uniqueID)
+	configPath := folderPath + "/.syncIt/.syncIt.json"
+	syncData := getSyncData(folderPath, configPath)
+	updatedFiles := make(map[string]SyncFile)
+	fileNames := make(map[string]bool)
+	for i := range files {
+		updatedFiles[files[i].Name] = files[i]
+		fileNames[files[i].Name] = true
+	}
+	for i := range syncData.Files {
+		if updatedFile, exists := updatedFiles[syncData.Files[i].Name]; exists {
+			syncData.Files[i] = updatedFile
+			delete(updatedFiles, updatedFile.Name)
+		}
+	}
+	for i := range files {
+		if _, added := updatedFiles[files[i].Name]; added {
+			syncData.Files = append(syncData.Files, files[i])
+		}
+	}
+	tombstones := []Tombstone{}
+	for i := range syncData.Tombstones {
+		if !fileNames[syncData.Tombstones[i].Name] {
+			tombstones = append(tombstones, syncData.Tombstones[i])
+		}
+	}
+	syncData.Tombstones = tombstones
+	syncData.save(configPath)
+}
+
+//getFileVersions returns the archived versions of fileName in the folder with uniqueID, newest first
+func (folder FolderManager) getFileVersions(uniqueID uint32, fileName string) []FileVersion {
+	return getFileVersions(folder.getFolderPath(uniqueID), fileName)
+}
+
+//restoreFile puts back the archived version of fileName identified by versionID, archiving the current copy, and
+//syncs the restored file with the peers like any other local change
+func (folder FolderManager) restoreFile(uniqueID uint32, fileName string, versionID string) error {
+	folderPath := folder.getFolderPath(uniqueID)
+	policy := getSyncData(folderPath, folderPath+"/.syncIt/.syncIt.json").Retention
+	err := restoreFileVersion(folderPath, fileName, versionID, policy)
+	if err != nil {
+		return err
+	}
+	folder.syncIfChanged(folderPath)
+	return nil
+}
+
+//setRetentionPolicy changes which archived versions are kept for the folder with uniqueID, and removes the versions
+//which the new policy no longer keeps
+func (folder FolderManager) setRetentionPolicy(uniqueID uint32, policy RetentionPolicy) {
+	folderPath := folder.getFolderPath(uniqueID)
+	configPath := folderPath + "/.syncIt/.syncIt.json"
+	syncData := getSyncData(folderPath, configPath)
+	syncData.Retention = policy
+	syncData.save(configPath)
+	pruneVersions(folderPath, policy)
+}
+
+//getFolderMode returns the mode of the folder with uniqueID
+func (folder FolderManager) getFolderMode(uniqueID uint32) string {
+	folderPath := folder.getFolderPath(uniqueID)
+	mode := getSyncData(folderPath, folderPath+"/.syncIt/.syncIt.json").Mode
+	if mode == "" {
+		return folderSendReceive
+	}
+	return mode
+}
+
+//setFolderMode changes the mode of the folder with uniqueID
+func (folder FolderManager) setFolderMode(uniqueID uint32, mode string) error {
+	if mode != folderSendReceive && mode != folderSendOnly && mode != folderReceiveOnly {
+		return errors.New("unknown folder mode " + mode + ", use send-receive, send-only or receive-only")
+	}
 	folderPath := folder.getFolderPath(uniqueID)
-	syncFolder := folderPath + "./syncIt"
-	backupFile := syncFolder + "/" + fileName + ".bak"
-	filePath := folderPath + "/" + fileName
-	os.Rename(backupFile, filePath)
+	configPath := folderPath + "/.syncIt/.syncIt.json"
+	syncData := getSyncData(folderPath, configPath)
+	syncData.Mode = mode
+	syncData.save(configPath)
+	return nil
 }
 
-func (folder FolderManager) addPeerFolder(directory string, folderName string, uniqueID uint32, fileNames []string) {
+func getRemoteIndexPath(folderPath string) string {
+	return folderPath + "/.syncIt/remote_index.json"
+}
+
+func (folder FolderManager) saveRemoteIndex(uniqueID uint32, remoteIndex RemoteIndex) {
+	remoteIndexBytes, _ := json.Marshal(remoteIndex)
+	err := ioutil.WriteFile(getRemoteIndexPath(folder.getFolderPath(uniqueID)), remoteIndexBytes, 0644)
+	goUtils.HandleErr(err, "While saving the remote index of folder "+strconv.FormatInt(int64(uniqueID), 10))
+}
+
+//getRemoteIndex returns the last index announced by a peer for the folder at folderPath, and whether there is one
+func getRemoteIndex(folderPath string) (RemoteIndex, bool) {
+	remoteIndex := RemoteIndex{}
+	remoteIndexBytes, err := ioutil.ReadFile(getRemoteIndexPath(folderPath))
+	if err != nil {
+		return remoteIndex, false
+	}
+	err = json.Unmarshal(remoteIndexBytes, &remoteIndex)
+	return remoteIndex, err == nil
+}
+
+//revertLocalChanges brings a receive-only folder back in line with the last index announced by a peer. Files added or
+//changed locally are archived and dropped from the index, and deletions made locally are forgotten, so that the peer's
+//copies are received again - right away if the peer is connected, otherwise once it next announces the folder.
+//Returns the names of the reverted files
+func (folder FolderManager) revertLocalChanges(uniqueID uint32) ([]string, error) {
+	folderPath := folder.getFolderPath(uniqueID)
+	configPath := folderPath + "/.syncIt/.syncIt.json"
+	syncData := getSyncData(folderPath, configPath)
+	if syncData.Mode != folderReceiveOnly {
+		return nil, errors.New(folderPath + " is not a receive-only folder")
+	}
+	remoteIndex, exists := getRemoteIndex(folderPath)
+	if !exists {
+		return nil, errors.New("no peer has announced " + folderPath + " yet, there is nothing to revert to")
+	}
+	syncData.update(folderPath, configPath)
+	remoteFiles := make(map[string]SyncFile)
+	for i := range remoteIndex.Files {
+		remoteFiles[remoteIndex.Files[i].Name] = remoteIndex.Files[i]
+	}
+	revertedFiles := []string{}
+	changedFiles := []string{}
+	keptFiles := []SyncFile{}
+	for i := range syncData.Files {
+		if remoteFile, exists := remoteFiles[syncData.Files[i].Name]; exists && remoteFile.Md5 == syncData.Files[i].Md5 {
+			keptFiles = append(keptFiles, syncData.Files[i])
+			continue
+		}
+		changedFiles = append(changedFiles, syncData.Files[i].Name)
+	}
+	tombstones := []Tombstone{}
+	for i := range syncData.Tombstones {
+		if _, exists := remoteFiles[syncData.Tombstones[i].Name]; exists {
+			revertedFiles = append(revertedFiles, syncData.Tombstones[i].Name)
+			continue
+		}
+		tombstones = append(tombstones, syncData.Tombstones[i])
+	}
+	folder.backupExistingFiles(uniqueID, changedFiles)
+	revertedFiles = append(revertedFiles, changedFiles...)
+	syncData.Files = keptFiles
+	syncData.Tombstones = tombstones
+	syncData.save(configPath)
+	for _, peer := range folder.peermanager.getConnectedPeers() {
+		if peer.deviceID == remoteIndex.DeviceID {
+			go peer.syncExistingFolderFromPeer(uniqueID, remoteIndex.Files, remoteIndex.Dirs, remoteIndex.Tombstones)
+		}
+	}
+	sort.Strings(revertedFiles)
+	return revertedFiles, nil
+}
+
+//isSharedWith reports whether the folder with uniqueID is shared with the device deviceID
+func (folder FolderManager) isSharedWith(uniqueID uint32, deviceID string) bool {
+	folderPath := folder.getFolderPath(uniqueID)
+	return getSyncData(folderPath, folderPath+"/.syncIt/.syncIt.json").isSharedWith(deviceID)
+}
+
+//getAnnouncedFolders returns the indexes of the folders announced to the device deviceID - those shared with it, except
+//for receive-only folders
+func (folder FolderManager) getAnnouncedFolders(deviceID string) []SyncData {
+	announcedFolders := []SyncData{}
+	for _, folderPath := range folder.getAllFolders() {
+		configPath := folderPath + "/.syncIt/.syncIt.json"
+		if _, err := os.Stat(configPath); err != nil {
+			continue
+		}
+		syncData := getSyncData(folderPath, configPath)
+		if syncData.Mode == folderReceiveOnly || !syncData.isSharedWith(deviceID) {
+			continue
+		}
+		announcedFolders = append(announcedFolders, syncData)
+	}
+	return announcedFolders
+}
+
+//shareFolder shares the folder with uniqueID with the device deviceID, announcing it to the device right away if it
+//is connected
+func (folder FolderManager) shareFolder(uniqueID uint32, deviceID string) {
+	folderPath := folder.getFolderPath(uniqueID)
+	configPath := folderPath + "/.syncIt/.syncIt.json"
+	syncData := getSyncData(folderPath, configPath)
+	if syncData.isSharedWith(deviceID) {
+		return
+	}
+	syncData.SharedWith = append(syncData.SharedWith, deviceID)
+	syncData.save(configPath)
+	folder.sendSyncReq(syncData)
+}
+
+//unshareFolder stops sharing the folder with uniqueID with the device deviceID
+func (folder FolderManager) unshareFolder(uniqueID uint32, deviceID string) {
+	folderPath := folder.getFolderPath(uniqueID)
+	configPath := folderPath + "/.syncIt/.syncIt.json"
+	syncData := getSyncData(folderPath, configPath)
+	sharedWith := []string{}
+	for i := range syncData.SharedWith {
+		if syncData.SharedWith[i] != deviceID {
+			sharedWith = append(sharedWith, syncData.SharedWith[i])
+		}
+	}
+	syncData.SharedWith = sharedWith
+	syncData.save(configPath)
+}
+
+//addPeerFolder creates a folder offered by the device deviceID, which the folder is then shared with
+func (folder FolderManager) addPeerFolder(directory string, folderName string, uniqueID uint32, deviceID string, fileNames []string, dirNames []string) {
 	folderPath := directory + "/" + folderName
 	err := os.Mkdir(folderPath, 0755)
 	goUtils.HandleErr(err, "While creating peer folder")
@@ -138,18 +464,33 @@ func (folder FolderManager) addPeerFolder(directory string, folderName string, u
 	absFolderPath, err := filepath.Abs(folderPath)
 	goUtils.HandleErr(err, "While getting absolute folder path")
 	folder.addToGlobal(absFolderPath, uniqueID)
-	folder.addPeerFiles(folderPath, fileNames, folderConfigFile, uniqueID)
+	folder.addPeerFiles(folderPath, fileNames, dirNames, folderConfigFile, uniqueID)
+	syncData := getSyncData(folderPath, folderConfigFile)
+	syncData.SharedWith = []string{deviceID}
+	syncData.save(folderConfigFile)
+	publishFolderAdded(absFolderPath, syncData, "Added "+absFolderPath+", offered by "+deviceID)
 }
 
-func (folder FolderManager) addPeerFiles(folderPath string, fileNames []string, configPath string, uniqueID uint32) {
+//addPeerFiles creates all the directories announced by a peer, including the parents of the announced files. File
+//names are relative to folderPath and may contain nested directories. The files themselves only appear in the folder
+//once they have been received and verified
+func (folder FolderManager) addPeerFiles(folderPath string, fileNames []string, dirNames []string, configPath string, uniqueID uint32) {
+	createDirs(folderPath, dirNames)
 	for i := range fileNames {
-		log.Println("Creating file ", fileNames[i])
-		_, err := os.Create(folderPath + "/" + fileNames[i])
-		goUtils.HandleErr(err, "While creating file")
+		err := os.MkdirAll(filepath.Dir(getLocalPath(folderPath, fileNames[i])), 0755)
+		goUtils.HandleErr(err, "While creating parent directory for "+fileNames[i])
 	}
 	addMultipleFiles(folderPath, configPath, uniqueID)
 }
 
+//createDirs creates every directory in dirNames, given relative to folderPath, if it does not already exist
+func createDirs(folderPath string, dirNames []string) {
+	for i := range dirNames {
+		err := os.MkdirAll(getLocalPath(folderPath, dirNames[i]), 0755)
+		goUtils.HandleErr(err, "While creating directory "+dirNames[i])
+	}
+}
+
 func (folder FolderManager) updateAndGetSyncData(uniqueID uint32) SyncData {
 	folderPath := folder.getFolderPath(uniqueID)
 	folder.updateExistingFolderConfig(folderPath)
@@ -158,22 +499,47 @@ func (folder FolderManager) updateAndGetSyncData(uniqueID uint32) SyncData {
 	return syncData
 }
 
-func (folder FolderManager) getFilePath(uniqueID uint32, fileName string) string {
-	globalConfigJson := getGlobalConfig()
-	uniqueIDString := strconv.FormatInt(int64(uniqueID), 10)
-	folderPath := globalConfigJson[uniqueIDString]
-	return folderPath + "/" + fileName
+//checkIgnored reports whether path, which can be anywhere inside a synced folder, is excluded by the .syncignore of
+//that folder
+func (folder FolderManager) checkIgnored(path string) (IgnoreResult, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return IgnoreResult{}, errors.New("invalid path " + path)
+	}
+	for _, folderPath := range folder.getAllFolders() {
+		relPath, err := filepath.Rel(folderPath, absPath)
+		if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			continue
+		}
+		isDir := false
+		if fileStat, err := os.Stat(absPath); err == nil {
+			isDir = fileStat.IsDir()
+		}
+		ignored, pattern := loadIgnoreMatcher(folderPath).explain(filepath.ToSlash(relPath), isDir)
+		return IgnoreResult{Path: path, Folder: folderPath, Ignored: ignored, Pattern: pattern}, nil
+	}
+	return IgnoreResult{}, errors.New(path + " is not inside any synced folder")
 }
 
-func getGlobalConfigFile() string {
-	user, _ := user.Current()
-	homeDir := user.HomeDir
-	globalConfigFolder := filepath.Join(homeDir, ".syncIt")
+//getGlobalConfigFolder returns the ~/.syncIt directory holding the configuration of this installation, creating it if
+//needed. It can be moved elsewhere with the SYNCIT_CONFIG_DIR environment variable, such as to run several
+//installations on the same machine
+func getGlobalConfigFolder() string {
+	globalConfigFolder := os.Getenv("SYNCIT_CONFIG_DIR")
+	if globalConfigFolder == "" {
+		user, _ := user.Current()
+		globalConfigFolder = filepath.Join(user.HomeDir, ".syncIt")
+	}
 	if _, err := os.Stat(globalConfigFolder); os.IsNotExist(err) {
 		log.Println("Creating config directory", globalConfigFolder)
-		err := os.Mkdir(globalConfigFolder, 0755)
+		err := os.MkdirAll(globalConfigFolder, 0755)
 		goUtils.HandleErr(err, "While creating config folder")
 	}
+	return globalConfigFolder
+}
+
+func getGlobalConfigFile() string {
+	globalConfigFolder := getGlobalConfigFolder()
 	globalConfigFile := globalConfigFolder + "/global.json"
 	if _, err := os.Stat(globalConfigFile); os.IsNotExist(err) {
 		log.Println("Creating config file", globalConfigFile)
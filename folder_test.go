@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestReceiveOnlyFolderRefusesRequests(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	uniqueID, _ := addTestFolder(t, folderManager, map[string][]byte{"a.txt": []byte("data")}, "remote")
+	if err := folderManager.setFolderMode(uniqueID, folderReceiveOnly); err != nil {
+		t.Fatal(err)
+	}
+	_, conn := startTestPeer(t, folderManager, "remote")
+	sendTestMessage(t, conn, &FileReqMsg{DiffType: fileReqWhole, FolderID: uniqueID, Name: "a.txt"})
+	if refusal, ok := readTestMessage(t, conn).(*FileRefuseMsg); !ok || refusal.Name != "a.txt" {
+		t.Fatalf("received %+v, want a refusal for a.txt", refusal)
+	}
+}
+
+func TestSendOnlyFolderIgnoresPeerChanges(t *testing.T) {
+	for _, mode := range []string{folderSendReceive, folderSendOnly} {
+		t.Run(mode, func(t *testing.T) {
+			useTestConfigFolder(t)
+			folderManager := newTestFolderManager(t)
+			uniqueID, folderPath := addTestFolder(t, folderManager, map[string][]byte{"a.txt": []byte("data")}, "remote")
+			if err := folderManager.setFolderMode(uniqueID, mode); err != nil {
+				t.Fatal(err)
+			}
+			peer, conn := startTestPeer(t, folderManager, "remote")
+			localFile, _ := folderManager.getIndexedFile(uniqueID, "a.txt")
+			peerFile := SyncFile{Name: "a.txt", Md5: "md5", Size: 7, Version: localFile.Version.increment("remote")}
+			peer.indexHandler(1, uniqueID, []SyncFile{peerFile}, nil, []Tombstone{{Name: "b.txt"}})
+			if mode == folderSendReceive {
+				if request, ok := readTestMessage(t, conn).(*FileReqMsg); !ok || request.Name != "a.txt" {
+					t.Fatalf("received %+v, want a request for a.txt", request)
+				}
+				return
+			}
+			if files := peer.getAllRecevingFiles(); len(files) != 0 {
+				t.Errorf("%d files are being received into the send-only folder", len(files))
+			}
+			if indexedFile, _ := folderManager.getIndexedFile(uniqueID, "a.txt"); !reflect.DeepEqual(indexedFile, localFile) {
+				t.Errorf("index entry of a.txt changed to %+v", indexedFile)
+			}
+			if data, err := os.ReadFile(getLocalPath(folderPath, "a.txt")); err != nil || string(data) != "data" {
+				t.Errorf("a.txt holds %q - %v", data, err)
+			}
+		})
+	}
+}
+
+func TestRevertLocalChanges(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	remoteData := map[string][]byte{"a.txt": []byte("data"), "b.txt": []byte("more data")}
+	uniqueID, folderPath := addTestFolder(t, folderManager, remoteData, "remote")
+	if _, err := folderManager.revertLocalChanges(uniqueID); err == nil {
+		t.Error("a send-receive folder was reverted")
+	}
+	if err := folderManager.setFolderMode(uniqueID, folderReceiveOnly); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := folderManager.revertLocalChanges(uniqueID); err == nil {
+		t.Error("a folder which no peer has announced was reverted")
+	}
+	remoteIndex := RemoteIndex{DeviceID: "remote", Username: "remote", Files: []SyncFile{}}
+	for fileName := range remoteData {
+		file, _ := folderManager.getIndexedFile(uniqueID, fileName)
+		remoteIndex.Files = append(remoteIndex.Files, file)
+	}
+	folderManager.saveRemoteIndex(uniqueID, remoteIndex)
+	//Change, delete and add a file locally
+	writeTestFile(t, folderPath, "a.txt", []byte("local change"))
+	os.Remove(getLocalPath(folderPath, "b.txt"))
+	writeTestFile(t, folderPath, "c.txt", []byte("local file"))
+	folderManager.updateAndGetSyncData(uniqueID)
+	peer, conn := startTestPeer(t, folderManager, "remote")
+	folderManager.peermanager.peersMutex.Lock()
+	folderManager.peermanager.connectedPeers["remote"] = peer
+	folderManager.peermanager.peersMutex.Unlock()
+	revertedFiles, err := folderManager.revertLocalChanges(uniqueID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.txt", "b.txt", "c.txt"}; !reflect.DeepEqual(revertedFiles, want) {
+		t.Errorf("reverted %v, want %v", revertedFiles, want)
+	}
+	serveTestFiles(t, conn, remoteData)
+	for fileName, data := range remoteData {
+		waitForTestFile(t, folderPath, fileName, data)
+	}
+	if _, err := os.Stat(getLocalPath(folderPath, "c.txt")); !os.IsNotExist(err) {
+		t.Error("file added locally was not removed")
+	}
+	for _, fileName := range []string{"a.txt", "c.txt"} {
+		if versions := folderManager.getFileVersions(uniqueID, fileName); len(versions) != 1 {
+			t.Errorf("%d versions of %s were archived, want 1", len(versions), fileName)
+		}
+	}
+}
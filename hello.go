@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+//protocolVersion is the version of the peer protocol spoken by this build. Peers agree on the highest version both of
+//them support, which has to be at least the minimum version of each side. Version 3 moved every message to the tagged
+//fields defined in protocol.go, which earlier versions cannot read
+const protocolVersion = 3
+const minProtocolVersion = 3
+
+const softwareVersion = "0.3.0"
+
+//Capabilities are optional features of the protocol which are only used when both peers declare them in their hello
+const (
+	capRecursiveFolders = "recursive_folders"
+	capTombstones       = "tombstones"
+	capDeltaTransfer    = "delta_transfer"
+	capResume           = "resume"
+	capVersionVectors   = "version_vectors"
+	capFileRefuse       = "file_refuse"
+)
+
+var supportedCapabilities = []string{capRecursiveFolders, capTombstones, capDeltaTransfer, capResume, capVersionVectors,
+	capFileRefuse}
+
+//HelloMsg is the first message exchanged over a newly encrypted connection, describing the device and what it
+//supports
+type HelloMsg struct {
+	ProtocolVersion    uint32   `json:"protocol_version"`
+	MinProtocolVersion uint32   `json:"min_protocol_version"`
+	SoftwareVersion    string   `json:"software_version"`
+	DeviceID           string   `json:"device_id"`
+	Username           string   `json:"username"`
+	Capabilities       []string `json:"capabilities"`
+	//MaxFrameSize is the largest message the device accepts
+	MaxFrameSize uint32 `json:"max_frame_size,omitempty"`
+}
+
+func getOwnHello(identity DeviceIdentity, username string, limits PeerLimits) HelloMsg {
+	return HelloMsg{
+		ProtocolVersion:    protocolVersion,
+		MinProtocolVersion: minProtocolVersion,
+		SoftwareVersion:    softwareVersion,
+		DeviceID:           identity.deviceID,
+		Username:           username,
+		Capabilities:       supportedCapabilities,
+		MaxFrameSize:       limits.MaxFrameSize,
+	}
+}
+
+//negotiateHello picks the protocol version and capabilities to be used with a peer, from its hello and the device ID
+//it authenticated with. An error is returned if the two sides have no protocol version in common
+func negotiateHello(ownHello HelloMsg, peerHello HelloMsg, peerDeviceID string) (uint32, map[string]bool, error) {
+	if peerHello.DeviceID != peerDeviceID {
+		return 0, nil, errors.New("peer announced device ID " + peerHello.DeviceID + " but authenticated as " + peerDeviceID)
+	}
+	version := ownHello.ProtocolVersion
+	if peerHello.ProtocolVersion < version {
+		version = peerHello.ProtocolVersion
+	}
+	if version < ownHello.MinProtocolVersion || version < peerHello.MinProtocolVersion {
+		return 0, nil, fmt.Errorf("incompatible protocol versions, %s %s supports %d-%d while this device supports %d-%d",
+			peerHello.Username, peerHello.SoftwareVersion, peerHello.MinProtocolVersion, peerHello.ProtocolVersion,
+			ownHello.MinProtocolVersion, ownHello.ProtocolVersion)
+	}
+	peerCapabilities := make(map[string]bool)
+	for i := range peerHello.Capabilities {
+		peerCapabilities[peerHello.Capabilities[i]] = true
+	}
+	capabilities := make(map[string]bool)
+	for i := range ownHello.Capabilities {
+		if peerCapabilities[ownHello.Capabilities[i]] {
+			capabilities[ownHello.Capabilities[i]] = true
+		}
+	}
+	return version, capabilities, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//DeviceIdentity is the long lived keypair identifying this installation to its peers. It is generated on first run and
+//stored in ~/.syncIt/identity.pem
+type DeviceIdentity struct {
+	privateKey  ed25519.PrivateKey
+	publicKey   ed25519.PublicKey
+	deviceID    string
+	certificate tls.Certificate
+}
+
+//TrustedDevice is a device which has been paired with this installation. LastAddress is the address at which the device
+//was last dialed successfully, where it is redialed once the connection with it drops
+type TrustedDevice struct {
+	Username    string `json:"username"`
+	PairedAt    int64  `json:"paired_at"`
+	LastAddress string `json:"last_address,omitempty"`
+}
+
+var errUntrustedDevice = errors.New("pairing with the device was not confirmed")
+
+//pairingTimeout is how long the user is given to confirm the pairing code of an unknown device before the pairing is
+//rejected, so that devices which keep connecting cannot pile up prompts
+var pairingTimeout = 2 * time.Minute
+
+var localDeviceIDOnce sync.Once
+var localDeviceID string
+
+//getLocalDeviceID returns the ID of this device, under which local changes are counted in version vectors
+func getLocalDeviceID() string {
+	localDeviceIDOnce.Do(func() {
+		localDeviceID = loadOrCreateIdentity().deviceID
+	})
+	return localDeviceID
+}
+
+func loadOrCreateIdentity() DeviceIdentity {
+	identityFile := getGlobalConfigFolder() + "/identity.pem"
+	pemBytes, err := ioutil.ReadFile(identityFile)
+	if err == nil {
+		block, _ := pem.Decode(pemBytes)
+		if block != nil {
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if privateKey, valid := key.(ed25519.PrivateKey); err == nil && valid {
+				return newDeviceIdentity(privateKey)
+			}
+		}
+		log.Println("Invalid identity file", identityFile, "generating a new identity")
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatalln("Error while generating device identity", err)
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		log.Fatalln("Error while encoding device identity", err)
+	}
+	pemBytes = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+	err = ioutil.WriteFile(identityFile, pemBytes, 0600)
+	if err != nil {
+		log.Fatalln("Error while saving device identity", err)
+	}
+	log.Println("Generated new device identity", identityFile)
+	return newDeviceIdentity(privateKey)
+}
+
+func newDeviceIdentity(privateKey ed25519.PrivateKey) DeviceIdentity {
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	deviceID := getDeviceID(publicKey)
+	certificate, err := getDeviceCertificate(privateKey, deviceID)
+	if err != nil {
+		log.Fatalln("Error while creating device certificate", err)
+	}
+	return DeviceIdentity{privateKey: privateKey, publicKey: publicKey, deviceID: deviceID, certificate: certificate}
+}
+
+//getDeviceID derives the device ID from a public key, as groups of base32 characters from its SHA-256 hash
+func getDeviceID(publicKey ed25519.PublicKey) string {
+	hash := sha256.Sum256(publicKey)
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(hash[:20])
+	groups := []string{}
+	for i := 0; i < len(encoded); i += 8 {
+		groups = append(groups, encoded[i:i+8])
+	}
+	return strings.Join(groups, "-")
+}
+
+//trustedDevicesMutex guards trusted.json, so that devices paired or dialed at the same time do not overwrite each other
+//while it is read, changed and saved
+var trustedDevicesMutex sync.Mutex
+
+func getTrustedDevices() map[string]TrustedDevice {
+	trustedDevicesMutex.Lock()
+	defer trustedDevicesMutex.Unlock()
+	return readTrustedDevices()
+}
+
+func readTrustedDevices() map[string]TrustedDevice {
+	trustedDevices := make(map[string]TrustedDevice)
+	trustedBytes, err := ioutil.ReadFile(getGlobalConfigFolder() + "/trusted.json")
+	if err != nil {
+		return trustedDevices
+	}
+	json.Unmarshal(trustedBytes, &trustedDevices)
+	return trustedDevices
+}
+
+func addTrustedDevice(deviceID string, username string) {
+	trustedDevicesMutex.Lock()
+	defer trustedDevicesMutex.Unlock()
+	trustedDevices := readTrustedDevices()
+	trustedDevices[deviceID] = TrustedDevice{Username: username, PairedAt: time.Now().UTC().Unix()}
+	saveTrustedDevices(trustedDevices)
+}
+
+//setTrustedDeviceAddress remembers the address at which a trusted device was dialed
+func setTrustedDeviceAddress(deviceID string, address string) {
+	trustedDevicesMutex.Lock()
+	defer trustedDevicesMutex.Unlock()
+	trustedDevices := readTrustedDevices()
+	trustedDevice, trusted := trustedDevices[deviceID]
+	if !trusted || trustedDevice.LastAddress == address {
+		return
+	}
+	trustedDevice.LastAddress = address
+	trustedDevices[deviceID] = trustedDevice
+	saveTrustedDevices(trustedDevices)
+}
+
+//saveTrustedDevices replaces trusted.json. The caller holds trustedDevicesMutex if the devices were read from it
+func saveTrustedDevices(trustedDevices map[string]TrustedDevice) {
+	trustedBytes, _ := json.Marshal(trustedDevices)
+	err := ioutil.WriteFile(getGlobalConfigFolder()+"/trusted.json", trustedBytes, 0600)
+	if err != nil {
+		log.Println("Error while saving trusted devices", err)
+	}
+}
+
+func isTrustedDevice(deviceID string) bool {
+	_, trusted := getTrustedDevices()[deviceID]
+	return trusted
+}
+
+//secureConnection upgrades conn to TLS before anything else is exchanged with the peer. Both sides present a self
+//signed certificate for their device identity, and the side which initiated the connection acts as the TLS client.
+//Returns the encrypted connection along with the device ID of the peer, derived from its certificate
+func (identity DeviceIdentity) secureConnection(conn net.Conn, initiated bool) (*tls.Conn, string, error) {
+	tlsConfig := &tls.Config{
+		Certificates:          []tls.Certificate{identity.certificate},
+		MinVersion:            tls.VersionTLS13,
+		ClientAuth:            tls.RequireAnyClientCert,
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyDeviceCertificate,
+	}
+	var tlsConn *tls.Conn
+	if initiated {
+		tlsConn = tls.Client(conn, tlsConfig)
+	} else {
+		tlsConn = tls.Server(conn, tlsConfig)
+	}
+	err := tlsConn.Handshake()
+	if err != nil {
+		return nil, "", err
+	}
+	peerPublicKey := tlsConn.ConnectionState().PeerCertificates[0].PublicKey.(ed25519.PublicKey)
+	return tlsConn, getDeviceID(peerPublicKey), nil
+}
+
+//verifyDeviceCertificate replaces the usual chain verification, as device certificates are self signed. The device
+//ID is pinned by checking it against the trusted devices once the handshake is done
+func verifyDeviceCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("peer did not present a device certificate")
+	}
+	certificate, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	if _, valid := certificate.PublicKey.(ed25519.PublicKey); !valid {
+		return errors.New("peer device certificate does not use an ed25519 key")
+	}
+	return certificate.CheckSignature(certificate.SignatureAlgorithm, certificate.RawTBSCertificate, certificate.Signature)
+}
+
+//getDeviceCertificate creates the self signed certificate presented by this device in TLS handshakes
+func getDeviceCertificate(privateKey ed25519.PrivateKey, deviceID string) (tls.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: deviceID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(20, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certificateBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, privateKey.Public(), privateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{certificateBytes}, PrivateKey: privateKey}, nil
+}
+
+//getPairingCode derives a 6 digit code from the TLS session, which is the same on both sides unless the connection is
+//being intercepted
+func getPairingCode(tlsConn *tls.Conn) (string, error) {
+	connectionState := tlsConn.ConnectionState()
+	keyingMaterial, err := connectionState.ExportKeyingMaterial("syncIt-pairing", nil, 4)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", binary.BigEndian.Uint32(keyingMaterial)%1000000), nil
+}
+
+//confirmPairing asks the user to pair with an unknown device after comparing the pairing code, and exchanges the answer
+//with the peer. The device is trusted only when the users on both sides accept within pairingTimeout
+func confirmPairing(conn net.Conn, cliController *CLIController, peerUsername string, peerDeviceID string, pairingCode string) error {
+	userResponse, _ := cliController.getInputWithin(peerUsername+" is connecting from an unknown device "+peerDeviceID+"\n"+
+		"Pairing code - "+pairingCode+"\n"+
+		"Does the same pairing code appear on "+peerUsername+"'s device?[y/n]", pairingTimeout)
+	accepted := []byte{0}
+	if userResponse == "y" {
+		accepted[0] = 1
+	}
+	_, err := conn.Write(accepted)
+	if err != nil {
+		return err
+	}
+	peerAccepted := make([]byte, 1)
+	_, err = io.ReadFull(conn, peerAccepted)
+	if err != nil {
+		return err
+	}
+	if accepted[0] != 1 || peerAccepted[0] != 1 {
+		return errUntrustedDevice
+	}
+	addTrustedDevice(peerDeviceID, peerUsername)
+	cliController.print("Paired with " + peerUsername + " - " + peerDeviceID)
+	return nil
+}
+
+//getTrustedDevicesStatus describes this device along with all the devices it has been paired with
+func getTrustedDevicesStatus(identity DeviceIdentity) string {
+	status := "This device - " + identity.deviceID
+	for deviceID, trustedDevice := range getTrustedDevices() {
+		status += "\n" + trustedDevice.Username + " - " + deviceID + " paired at " +
+			time.Unix(trustedDevice.PairedAt, 0).Format(time.RFC1123)
+	}
+	return status
+}
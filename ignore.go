@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+//ignorePattern is a single pattern from a .syncignore file
+type ignorePattern struct {
+	line    string
+	regex   *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+//IgnoreMatcher decides which paths in a folder are excluded from syncing, using gitignore style patterns read from the
+//.syncignore file at the root of the folder. As with gitignore, the last matching pattern wins, patterns starting with
+//"!" re-include paths, patterns ending with "/" only match directories, and patterns containing a "/" are relative to
+//the root of the folder while the others match at any depth
+type IgnoreMatcher struct {
+	patterns []ignorePattern
+}
+
+//IgnoreResult tells whether a path is excluded by the .syncignore of the folder it is in, along with the pattern which
+//decided it, if any
+type IgnoreResult struct {
+	Path    string `json:"path"`
+	Folder  string `json:"folder"`
+	Ignored bool   `json:"ignored"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+func (result IgnoreResult) String() string {
+	if result.Ignored {
+		return result.Path + " is ignored by the pattern \"" + result.Pattern + "\" in " + result.Folder + "/.syncignore"
+	}
+	if result.Pattern != "" {
+		return result.Path + " is not ignored, it is re-included by the pattern \"" + result.Pattern + "\""
+	}
+	return result.Path + " is not ignored"
+}
+
+func loadIgnoreMatcher(folderPath string) IgnoreMatcher {
+	matcher := IgnoreMatcher{patterns: []ignorePattern{}}
+	ignoreFile, err := os.Open(filepath.Join(folderPath, ".syncignore"))
+	if err != nil {
+		return matcher
+	}
+	defer ignoreFile.Close()
+	scanner := bufio.NewScanner(ignoreFile)
+	for scanner.Scan() {
+		pattern, valid := parseIgnorePattern(scanner.Text())
+		if valid {
+			matcher.patterns = append(matcher.patterns, pattern)
+		}
+	}
+	return matcher
+}
+
+func parseIgnorePattern(line string) (ignorePattern, bool) {
+	pattern := ignorePattern{line: line}
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pattern, false
+	}
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return pattern, false
+	}
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	regexString := globToRegex(line)
+	if anchored {
+		regexString = "^" + regexString + "$"
+	} else {
+		regexString = "^(.*/)?" + regexString + "$"
+	}
+	regex, err := regexp.Compile(regexString)
+	if err != nil {
+		return pattern, false
+	}
+	pattern.regex = regex
+	return pattern, true
+}
+
+//globToRegex converts a gitignore style glob to a regular expression. "*" and "?" do not match "/", while "**" matches
+//any number of directories
+func globToRegex(glob string) string {
+	var regex strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			regex.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			regex.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			regex.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			regex.WriteString("[^/]*")
+		case glob[i] == '?':
+			regex.WriteString("[^/]")
+		case glob[i] == '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end == -1 {
+				regex.WriteString(regexp.QuoteMeta(glob[i:]))
+				return regex.String()
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			regex.WriteString("[" + class + "]")
+			i += end
+		case glob[i] == '\\' && i+1 < len(glob):
+			regex.WriteString(regexp.QuoteMeta(glob[i+1 : i+2]))
+			i++
+		default:
+			regex.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return regex.String()
+}
+
+//match returns whether relPath, relative to the folder and "/" separated, is matched by the patterns on its own,
+//without considering its parent directories, along with the pattern which decided it
+func (matcher IgnoreMatcher) match(relPath string, isDir bool) (bool, string) {
+	ignored := false
+	decidingPattern := ""
+	for i := range matcher.patterns {
+		pattern := matcher.patterns[i]
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.regex.MatchString(relPath) {
+			ignored = !pattern.negate
+			decidingPattern = pattern.line
+		}
+	}
+	return ignored, decidingPattern
+}
+
+//isIgnored returns whether relPath is excluded from syncing. A path inside an ignored directory is always ignored, as
+//the directory is never walked
+func (matcher IgnoreMatcher) isIgnored(relPath string, isDir bool) bool {
+	ignored, _ := matcher.explain(relPath, isDir)
+	return ignored
+}
+
+//explain is like isIgnored, but also returns the pattern responsible for the result, which is empty if no pattern
+//matched
+func (matcher IgnoreMatcher) explain(relPath string, isDir bool) (bool, string) {
+	pathParts := strings.Split(relPath, "/")
+	for i := 1; i < len(pathParts); i++ {
+		parentIgnored, pattern := matcher.match(strings.Join(pathParts[:i], "/"), true)
+		if parentIgnored {
+			return true, pattern
+		}
+	}
+	return matcher.match(relPath, isDir)
+}
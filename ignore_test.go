@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func getTestIgnoreMatcher(lines ...string) IgnoreMatcher {
+	matcher := IgnoreMatcher{patterns: []ignorePattern{}}
+	for _, line := range lines {
+		if pattern, valid := parseIgnorePattern(line); valid {
+			matcher.patterns = append(matcher.patterns, pattern)
+		}
+	}
+	return matcher
+}
+
+func TestIsIgnored(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		isDir    bool
+		ignored  bool
+	}{
+		{"no patterns", nil, "a.txt", false, false},
+		{"comment", []string{"#a.txt"}, "#a.txt", false, false},
+		{"escaped comment", []string{"\\#a.txt"}, "#a.txt", false, true},
+		{"trailing spaces", []string{"a.txt  "}, "a.txt", false, true},
+		{"name at the root", []string{"*.log"}, "debug.log", false, true},
+		{"name at any depth", []string{"*.log"}, "logs/2024/debug.log", false, true},
+		{"star does not cross directories", []string{"logs/*.log"}, "logs/2024/debug.log", false, false},
+		{"question mark", []string{"file?.txt"}, "file1.txt", false, true},
+		{"question mark needs a character", []string{"file?.txt"}, "file.txt", false, false},
+		{"character class", []string{"file[0-9].txt"}, "file7.txt", false, true},
+		{"negated character class", []string{"file[!0-9].txt"}, "file7.txt", false, false},
+		{"anchored with a slash", []string{"/build"}, "build", true, true},
+		{"anchored is not matched deeper", []string{"/build"}, "src/build", true, false},
+		{"pattern with a slash is anchored", []string{"src/gen"}, "lib/src/gen", true, false},
+		{"dir only matches directories", []string{"tmp/"}, "tmp", true, true},
+		{"dir only skips files", []string{"tmp/"}, "tmp", false, false},
+		{"dir only at any depth", []string{"node_modules/"}, "web/node_modules", true, true},
+		{"inside an ignored directory", []string{"node_modules/"}, "web/node_modules/lib/index.js", false, true},
+		{"leading double star", []string{"**/cache"}, "a/b/cache", true, true},
+		{"leading double star at the root", []string{"**/cache"}, "cache", true, true},
+		{"trailing double star", []string{"out/**"}, "out/a/b.txt", false, true},
+		{"trailing double star skips the directory", []string{"out/**"}, "out", true, false},
+		{"middle double star", []string{"a/**/b.txt"}, "a/x/y/b.txt", false, true},
+		{"middle double star with no directories", []string{"a/**/b.txt"}, "a/b.txt", false, true},
+		{"negation", []string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{"negation keeps the others ignored", []string{"*.log", "!keep.log"}, "other.log", false, true},
+		{"last pattern wins", []string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{"negation cannot re-include inside an ignored directory", []string{"logs/", "!logs/keep.log"}, "logs/keep.log", false, true},
+		{"escaped negation", []string{"\\!important"}, "!important", false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ignored := getTestIgnoreMatcher(test.patterns...).isIgnored(test.path, test.isDir); ignored != test.ignored {
+				t.Errorf("isIgnored(%q) with %q gave %t, want %t", test.path, test.patterns, ignored, test.ignored)
+			}
+		})
+	}
+}
+
+func TestIgnoreTestCommand(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	_, folderPath := addTestFolder(t, folderManager, map[string][]byte{
+		".syncignore": []byte("*.log\n!keep.log\n"),
+		"debug.log":   {},
+		"keep.log":    {},
+	})
+	handler := commandHandler{folderManager: folderManager, peerManager: folderManager.peermanager}
+	tests := []struct {
+		path string
+		want IgnoreResult
+	}{
+		{"debug.log", IgnoreResult{Ignored: true, Pattern: "*.log"}},
+		{"keep.log", IgnoreResult{Pattern: "!keep.log"}},
+		{"a.txt", IgnoreResult{}},
+	}
+	for _, test := range tests {
+		path := filepath.Join(folderPath, test.path)
+		request, err := getControlRequest("ignore", []string{"test", path}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		apiRequest, _, err := getAPIControlRequest(httptest.NewRequest("GET", "/api/folders/"+
+			getTestFolderID(t, handler, folderPath)+"/ignore?path="+test.path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(apiRequest, request) {
+			t.Errorf("API request %+v differs from the subcommand request %+v", apiRequest, request)
+		}
+		data, err := handler.execute(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := IgnoreResult{}
+		json.Unmarshal(data, &result)
+		test.want.Path, test.want.Folder = path, folderPath
+		if result != test.want {
+			t.Errorf("ignore test %s gave %+v, want %+v", test.path, result, test.want)
+		}
+	}
+	outside := filepath.Join(t.TempDir(), "a.txt")
+	if _, err := handler.execute(ControlRequest{Command: "ignore", Args: []string{outside}}); err == nil ||
+		!strings.Contains(err.Error(), "not inside any synced folder") {
+		t.Errorf("checking a path outside the folders gave %v", err)
+	}
+	if _, err := getControlRequest("ignore", []string{folderPath}, false); err == nil {
+		t.Error("ignore was accepted without test")
+	}
+}
+
+func getTestFolderID(t *testing.T, handler commandHandler, folderPath string) string {
+	uniqueID, exists := handler.getFolderID(folderPath)
+	if !exists {
+		t.Fatal(folderPath, "has not been added")
+	}
+	return uniqueID
+}
+
+func TestLoadIgnoreMatcher(t *testing.T) {
+	folderPath := t.TempDir()
+	if err := os.WriteFile(filepath.Join(folderPath, ".syncignore"), []byte("# build output\n\nbuild/\r\n!build/keep\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	matcher := loadIgnoreMatcher(folderPath)
+	if len(matcher.patterns) != 2 {
+		t.Fatalf("loaded %d patterns, want 2", len(matcher.patterns))
+	}
+	if !matcher.isIgnored("build", true) || matcher.isIgnored("src", true) {
+		t.Error("patterns loaded from .syncignore do not match")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Defaults of the limits on what is accepted from peers
+const (
+	defaultMaxFrameSize  = 1024 * 1024
+	minMaxFrameSize      = 64 * 1024
+	maxMaxFrameSize      = 64 * 1024 * 1024
+	defaultMaxRejections = 20
+	defaultBanDuration   = time.Hour
+	//Indexes are buffered till their final chunk has been received. The number of entries and their estimated size are
+	//bounded across all the indexes being received from a peer
+	defaultMaxIndexEntries = 1000000
+	defaultMaxIndexSize    = 256 * 1024 * 1024
+	//Peers are pinged every keepalive interval, and disconnected once nothing has been received from them for longer
+	//than the keepalive timeout
+	defaultKeepaliveInterval = 10 * time.Second
+	defaultKeepaliveTimeout  = time.Minute
+)
+
+var errEmptyFrame = errors.New("empty frame")
+var errFrameTooLarge = errors.New("frame larger than the maximum frame size")
+
+//PeerLimits bounds what is accepted from peers. MaxFrameSize is the largest message read from a peer, and is announced
+//in the hello so that the peer never sends anything larger. A peer whose messages are rejected MaxRejections times is
+//disconnected and refused for BanDuration, unless MaxRejections is 0. A peer is pinged every KeepaliveInterval, and a
+//peer from which nothing has been received for longer than KeepaliveTimeout is disconnected. The indexes being received
+//from a peer are buffered up to MaxIndexEntries entries and MaxIndexSize bytes in all
+//
+//Malformed messages are handled according to how much of the connection they leave usable. A message which cannot be
+//decoded is dropped, as the frames around it can still be read. An empty frame or one larger than MaxFrameSize
+//disconnects the peer, as the rest of the stream cannot be trusted to be framed correctly. Both count as rejections
+type PeerLimits struct {
+	MaxFrameSize  uint32
+	MaxRejections int
+	BanDuration   time.Duration
+
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+
+	MaxIndexEntries int
+	MaxIndexSize    int
+}
+
+//addPeerLimitFlags defines the flags which configure the limits on flags. The returned function reads the limits once
+//the flags have been parsed
+func addPeerLimitFlags(flags *flag.FlagSet) func() (PeerLimits, error) {
+	maxFrameSizePtr := flags.Uint("max-frame-size", defaultMaxFrameSize, "Largest message in bytes accepted from peers")
+	maxRejectionsPtr := flags.Int("max-rejections", defaultMaxRejections,
+		"Number of rejected messages after which a peer is banned, 0 to never ban")
+	banDurationPtr := flags.Duration("ban-duration", defaultBanDuration, "How long a banned peer is refused for")
+	keepaliveIntervalPtr := flags.Duration("keepalive-interval", defaultKeepaliveInterval, "How often peers are pinged")
+	keepaliveTimeoutPtr := flags.Duration("keepalive-timeout", defaultKeepaliveTimeout,
+		"How long a peer can stay silent before it is disconnected")
+	maxIndexEntriesPtr := flags.Int("max-index-entries", defaultMaxIndexEntries,
+		"Number of index entries buffered from a peer at most")
+	maxIndexSizePtr := flags.Int("max-index-size", defaultMaxIndexSize, "Bytes of index buffered from a peer at most")
+	return func() (PeerLimits, error) {
+		if *maxFrameSizePtr < minMaxFrameSize || *maxFrameSizePtr > maxMaxFrameSize {
+			return PeerLimits{}, errors.New("max-frame-size has to be between " + strconv.Itoa(minMaxFrameSize) + " and " +
+				strconv.Itoa(maxMaxFrameSize) + " bytes")
+		}
+		if *maxRejectionsPtr < 0 || *banDurationPtr <= 0 {
+			return PeerLimits{}, errors.New("max-rejections cannot be negative and ban-duration has to be positive")
+		}
+		if *keepaliveIntervalPtr <= 0 || *keepaliveTimeoutPtr <= *keepaliveIntervalPtr {
+			return PeerLimits{}, errors.New("keepalive-interval has to be positive and shorter than keepalive-timeout")
+		}
+		if *maxIndexEntriesPtr <= 0 || *maxIndexSizePtr <= 0 {
+			return PeerLimits{}, errors.New("max-index-entries and max-index-size have to be positive")
+		}
+		return PeerLimits{
+			MaxFrameSize:  uint32(*maxFrameSizePtr),
+			MaxRejections: *maxRejectionsPtr,
+			BanDuration:   *banDurationPtr,
+
+			KeepaliveInterval: *keepaliveIntervalPtr,
+			KeepaliveTimeout:  *keepaliveTimeoutPtr,
+
+			MaxIndexEntries: *maxIndexEntriesPtr,
+			MaxIndexSize:    *maxIndexSizePtr,
+		}, nil
+	}
+}
+
+//readFrame reads the next message from a peer, preceded by its 4 byte length. Nothing is allocated for a frame larger
+//than maxFrameSize, which is returned as errFrameTooLarge
+func readFrame(reader io.Reader, maxFrameSize uint32) ([]byte, error) {
+	lengthBytes := make([]byte, 4)
+	_, err := io.ReadFull(reader, lengthBytes)
+	if err != nil {
+		return nil, err
+	}
+	frameLength := binary.BigEndian.Uint32(lengthBytes)
+	if frameLength == 0 {
+		return nil, errEmptyFrame
+	}
+	if frameLength > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	frame := make([]byte, frameLength)
+	_, err = io.ReadFull(reader, frame)
+	return frame, err
+}
+
+//bannedDevices holds the devices which are refused till the time they are mapped to
+var bannedDevices = make(map[string]time.Time)
+var bannedDevicesMutex sync.Mutex
+
+func banDevice(deviceID string, duration time.Duration) {
+	bannedDevicesMutex.Lock()
+	bannedDevices[deviceID] = time.Now().Add(duration)
+	bannedDevicesMutex.Unlock()
+}
+
+//getBanExpiry returns the time till which a device is banned, if it is currently banned
+func getBanExpiry(deviceID string) (time.Time, bool) {
+	bannedDevicesMutex.Lock()
+	defer bannedDevicesMutex.Unlock()
+	bannedTill, banned := bannedDevices[deviceID]
+	if banned && time.Now().After(bannedTill) {
+		delete(bannedDevices, deviceID)
+		return time.Time{}, false
+	}
+	return bannedTill, banned
+}
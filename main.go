@@ -5,57 +5,153 @@ import (
 	"flag"
 	"fmt"
 	"github.com/akshay1713/LANPeerDiscovery"
-	"github.com/akshay1713/goUtils"
 	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 func main() {
-	username := getUserName()
+	if len(os.Args) > 1 && os.Args[1] == "daemon" {
+		os.Exit(runDaemon(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && isSubcommand(os.Args[1]) {
+		os.Exit(runSubcommand(os.Args[1], os.Args[2:]))
+	}
+	username, apiAddress, limits, err := getUserName()
+	if err != nil {
+		fmt.Println(err)
+		printUsage()
+		os.Exit(exitUsage)
+	}
 	if username == "" {
 		fmt.Println("Please specify a username using the -u flag")
-		return
+		printUsage()
+		os.Exit(exitUsage)
 	}
-	fmt.Println("Looking for peers")
-	connectedPeers := make(map[string]*Peer)
-	closeChan := make(chan Peer)
-	peerManager := PeerManager{closeChan: closeChan, connectedPeers: connectedPeers}
 	inputChan := make(chan string)
-	cliController := CLIController{inputChan: inputChan}
-	go initDiscovery(peerManager, username, &cliController)
-	folder := FolderManager{cliController: &cliController, peermanager: peerManager}
+	cliController := newCLIController(inputChan)
+	folder, peerManager, err := startSyncing(username, apiAddress, limits, cliController)
+	if err != nil {
+		fmt.Println("Error while starting:", err)
+		os.Exit(exitError)
+	}
 	cliController.startCli(folder, peerManager)
 }
 
-func getUserName() string {
+//runDaemon runs syncIt without a terminal, till it is interrupted or terminated. It is controlled entirely through the
+//subcommands, which also list and answer the prompts it raises
+func runDaemon(args []string) int {
+	flags := flag.NewFlagSet("syncit daemon", flag.ContinueOnError)
+	usernamePtr := flags.String("u", "", "Desired username")
+	apiAddressPtr := flags.String("api", "", "Serve the REST API on this localhost address, e.g. 127.0.0.1:8384")
+	getLimits := addPeerLimitFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	limits, err := getLimits()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if *usernamePtr == "" {
+		fmt.Fprintln(os.Stderr, "Please specify a username using the -u flag")
+		return exitUsage
+	}
+	cliController := newHeadlessCLIController()
+	_, _, err = startSyncing(*usernamePtr, *apiAddressPtr, limits, cliController)
+	if err != nil {
+		log.Println("Error while starting:", err)
+		return exitError
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	receivedSignal := <-signals
+	log.Println("Stopping on", receivedSignal)
+	os.Remove(getControlSocketPath())
+	return exitOK
+}
+
+//startSyncing starts accepting commands on the control socket and the API if apiAddress is given, discovering peers
+//and watching the added folders. Fails if syncIt is already running
+func startSyncing(username string, apiAddress string, limits PeerLimits, cliController *CLIController) (FolderManager, PeerManager, error) {
+	connectedPeers := make(map[string]*Peer)
+	closeChan := make(chan *Peer)
+	identity := loadOrCreateIdentity()
+	peerManager := PeerManager{
+		closeChan:      closeChan,
+		connectedPeers: connectedPeers,
+		reconnecting:   make(map[string]bool),
+		peersMutex:     &sync.Mutex{},
+		identity:       identity,
+		limits:         limits,
+		username:       username,
+	}
+	go peerManager.removeDisconnectedPeers()
+	folder := FolderManager{cliController: cliController, peermanager: peerManager}
+	handler := commandHandler{folderManager: folder, peerManager: peerManager, username: username, deviceID: identity.deviceID, running: true}
+	if err := startControlServer(handler); err != nil {
+		return folder, peerManager, err
+	}
+	if apiAddress != "" {
+		if err := startAPIServer(apiAddress, handler); err != nil {
+			return folder, peerManager, err
+		}
+	}
+	go printEvents(cliController)
+	cliController.print("Device ID " + identity.deviceID)
+	cliController.print("Looking for peers")
+	go initDiscovery(peerManager, username, cliController)
+	watcher := newFolderWatcher(folder)
+	go watcher.start()
+	return folder, peerManager, nil
+}
+
+func getUserName() (string, string, PeerLimits, error) {
 	var usernamePtr *string
 	usernamePtr = flag.String("u", "", "Desired username")
+	apiAddressPtr := flag.String("api", "", "Serve the REST API on this localhost address, e.g. 127.0.0.1:8384")
+	getLimits := addPeerLimitFlags(flag.CommandLine)
 	flag.Parse()
-	return *usernamePtr
+	limits, err := getLimits()
+	return *usernamePtr, *apiAddressPtr, limits, err
 }
 
+//initDiscovery connects to the peers found on the LAN. Every connection is handled in its own goroutine, so that a
+//peer which is slow to complete the handshake does not hold up the others
 func initDiscovery(peerManager PeerManager, username string, cliController *CLIController) {
 	candidatePorts := []string{"8011", "8012"}
 	connectionsChan := LANPeerDiscovery.GetConnectionsChan(candidatePorts, peerManager, "syncIt")
 	for connAndType := range connectionsChan {
-		switch connAndType.Type {
-		case "sender":
-			currentTimestamp := uint32(time.Now().UTC().Unix())
-			peerManager.addNewPeer(connAndType.Connection, currentTimestamp, true, username, cliController)
-		case "receiver":
-			recvdTimestampBytes := make([]byte, 4)
-			_, err := io.ReadFull(connAndType.Connection, recvdTimestampBytes)
-			goUtils.HandleErr(err, "While getting timestamp")
-			recvdTimestamp := binary.BigEndian.Uint32(recvdTimestampBytes)
-			peerManager.addNewPeer(connAndType.Connection, recvdTimestamp, false, username, cliController)
-		case "duplicate_receiver":
-			recvdTimestampBytes := make([]byte, 4)
-			_, err := io.ReadFull(connAndType.Connection, recvdTimestampBytes)
-			goUtils.HandleErr(err, "While getting timestamp")
-			recvdTimestamp := binary.BigEndian.Uint32(recvdTimestampBytes)
-			senderIPString := strings.Split(connAndType.Connection.RemoteAddr().String(), ":")[0]
-			peerManager.compareTimestampAndUpdate(connAndType.Connection, recvdTimestamp, senderIPString)
-		}
+		go handleDiscoveredConnection(peerManager, connAndType.Connection, connAndType.Type, username, cliController)
+	}
+}
+
+func handleDiscoveredConnection(peerManager PeerManager, conn net.Conn, connType string, username string, cliController *CLIController) {
+	if connType == "sender" {
+		currentTimestamp := uint32(time.Now().UTC().Unix())
+		peerManager.addNewPeer(conn, currentTimestamp, true, username, cliController)
+		return
+	}
+	recvdTimestampBytes := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(peerManager.limits.KeepaliveTimeout))
+	_, err := io.ReadFull(conn, recvdTimestampBytes)
+	if err != nil {
+		log.Println("Error while getting timestamp from", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+	recvdTimestamp := binary.BigEndian.Uint32(recvdTimestampBytes)
+	switch connType {
+	case "receiver":
+		peerManager.addNewPeer(conn, recvdTimestamp, false, username, cliController)
+	case "duplicate_receiver":
+		senderIPString := strings.Split(conn.RemoteAddr().String(), ":")[0]
+		peerManager.compareTimestampAndUpdate(conn, recvdTimestamp, senderIPString, username, cliController)
 	}
 }
@@ -2,154 +2,262 @@ package main
 
 import (
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"github.com/akshay1713/goUtils"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
 )
 
-func getPingMsg() []byte {
-	pingMsg := make([]byte, 5)
-	copy(pingMsg[0:4], []byte{0, 0, 0, 1})
-	copy(pingMsg[4:5], []byte{0})
-	return pingMsg
-}
+//Messages are framed by a 4 byte length, followed by the byte identifying the type of the message and then its fields.
+//Each field is encoded as its tag, the length of its value and the value, with the tag and length varint encoded, so
+//that a message can be walked without knowing its schema. Values are encoded according to the type of the field in the
+//schema - unsigned integers as varints, bools as a single byte, strings and byte slices as they are and structs as
+//their own fields. Slices repeat the field for every element, and maps repeat it for every entry, as a struct with the
+//key in field 1 and the value in field 2. Fields with zero values are left out
 
-func getPongMsg() []byte {
-	pingMsg := make([]byte, 5)
-	copy(pingMsg[0:4], []byte{0, 0, 0, 1})
-	copy(pingMsg[4:5], []byte{1})
-	return pingMsg
+//wireField is a field of a message struct along with its tag
+type wireField struct {
+	tag   uint64
+	index int
 }
 
-func getFileReqMsg(uniqueID int64, fileName string, diffType byte) []byte {
-	fileReqMsg := make([]byte, 5+len(fileName)+4+1)
-	msgLen := len(fileName) + 4 + 1
-	goUtils.GetBytesFromUint32(fileReqMsg[0:4], uint32(msgLen)+1)
-	fileReqMsg[4] = 3
-	fileReqMsg[5] = diffType
-	goUtils.GetBytesFromUint32(fileReqMsg[6:10], uint32(uniqueID))
-	copy(fileReqMsg[10:], fileName)
-	return fileReqMsg
-}
+var wireFieldsCache sync.Map
 
-func extractFileReqMsg(fileReqMsg []byte) (uint32, string, byte) {
-	diffType := fileReqMsg[1]
-	uniqueID := binary.BigEndian.Uint32(fileReqMsg[2:6])
-	fileName := string(fileReqMsg[6:])
-	return uniqueID, fileName, diffType
+//getWireFields returns the fields of a struct in the schema which are sent on the wire
+func getWireFields(structType reflect.Type) []wireField {
+	if fields, cached := wireFieldsCache.Load(structType); cached {
+		return fields.([]wireField)
+	}
+	fields := []wireField{}
+	for i := 0; i < structType.NumField(); i++ {
+		tagValue, exists := structType.Field(i).Tag.Lookup("wire")
+		if !exists {
+			continue
+		}
+		tag, err := strconv.ParseUint(tagValue, 10, 64)
+		if err != nil || tag == 0 {
+			panic("Invalid wire tag on " + structType.Name() + "." + structType.Field(i).Name)
+		}
+		fields = append(fields, wireField{tag: tag, index: i})
+	}
+	wireFieldsCache.Store(structType, fields)
+	return fields
 }
 
-func getFileDataMsg(fileData []byte, uniqueID uint32, fileName string) []byte {
-	fileDataMsg := make([]byte, 5+len(fileData)+32+len(fileName)+1)
-	msgLen := len(fileData) + 32 + len(fileName) + 1
-	goUtils.GetBytesFromUint32(fileDataMsg[0:4], uint32(msgLen)+1)
-	fileDataMsg[4] = 4
-	fileDataMsg[5] = byte(len(fileName))
-	copy(fileDataMsg[6:6+len(fileName)], fileName)
-	position := 6 + len(fileName)
-	goUtils.GetBytesFromUint32(fileDataMsg[position:position+32], uniqueID)
-	position += 32
-	copy(fileDataMsg[position:], fileData)
-	return fileDataMsg
+func getWireField(structType reflect.Type, tag uint64) (wireField, bool) {
+	for _, field := range getWireFields(structType) {
+		if field.tag == tag {
+			return field, true
+		}
+	}
+	return wireField{}, false
 }
 
-func extractFileData(fileDataMsg []byte) (uint32, string, []byte) {
-	fileNameLen := int(fileDataMsg[1])
-	fileName := string(fileDataMsg[2 : 2+fileNameLen])
-	position := 2 + fileNameLen
-	uniqueID := binary.BigEndian.Uint32(fileDataMsg[position : position+32])
-	position += 32
-	fileData := fileDataMsg[position:]
-	return uniqueID, fileName, fileData
+//getMessageType returns the type byte of a message in the schema
+func getMessageType(message interface{}) (byte, bool) {
+	for msgType, schema := range messageSchema {
+		if reflect.TypeOf(message) == reflect.PtrTo(schema.msgType) {
+			return msgType, true
+		}
+	}
+	return 0, false
 }
 
-func getFileInfoMsg(fileLen uint64, fileName string, md5 string, uniqueID uint32) []byte {
-	fileNameLen := uint8(len(fileName))
-	fileMsgLen := 10 + fileNameLen + 32 + 4
-	fileMsg := make([]byte, fileMsgLen+4)
-	goUtils.GetBytesFromUint32(fileMsg[0:4], uint32(fileMsgLen))
-	fileMsg[4] = 3
-	fileMsg[5] = fileNameLen
-	goUtils.GetBytesFromUint64(fileMsg[6:], fileLen)
-	copy(fileMsg[14:], md5)
-	goUtils.GetBytesFromUint32(fileMsg[46:50], uniqueID)
-	copy(fileMsg[50:], fileName)
-	return fileMsg
+//encodeMessage frames a message for sending. message has to be a pointer to one of the structs in messageSchema
+func encodeMessage(message interface{}) []byte {
+	msgType, exists := getMessageType(message)
+	if !exists {
+		panic("Encoding a message which is not in the schema - " + reflect.TypeOf(message).String())
+	}
+	msg := appendFields([]byte{0, 0, 0, 0, msgType}, reflect.ValueOf(message).Elem())
+	goUtils.GetBytesFromUint32(msg[0:4], uint32(len(msg)-4))
+	return msg
 }
 
-func getSyncReqMsg(uniqueID uint32, diffType byte, fileNames []string, fileSizes []uint64, md5Hashes []string, modTimes []uint32) []byte {
-	totalNameLen := 0
-	for i := range fileNames {
-		totalNameLen += len(fileNames[i])
+//decodeMessage decodes a message received from a peer, without its length, into a pointer to the struct its type is
+//registered with in messageSchema. Fields with unknown tags are skipped
+func decodeMessage(msg []byte) (interface{}, error) {
+	if len(msg) == 0 {
+		return nil, errors.New("empty message")
 	}
-	syncReqMsg := make([]byte, 10+totalNameLen+2+len(fileNames)+8*len(fileSizes)+32*len(md5Hashes)+32*len(modTimes))
-	msgLen := 6 + totalNameLen + 2 + len(fileNames) + 8*len(fileSizes) + 32*len(md5Hashes) + 32*len(modTimes)
-	goUtils.GetBytesFromUint32(syncReqMsg[0:4], uint32(msgLen))
-	syncReqMsg[4] = 2
-	syncReqMsg[5] = diffType
-	goUtils.GetBytesFromUint16(syncReqMsg[6:8], uint16(len(fileNames)))
-	goUtils.GetBytesFromUint32(syncReqMsg[8:12], uniqueID)
-	start := 12
-	for i := range fileNames {
-		syncReqMsg[start] = byte(len(fileNames[i]))
-		start++
+	schema, exists := messageSchema[msg[0]]
+	if !exists {
+		return nil, errors.New("unknown message type " + strconv.Itoa(int(msg[0])))
 	}
-	for i := range fileSizes {
-		goUtils.GetBytesFromUint64(syncReqMsg[start:start+8], fileSizes[i])
-		start += 8
+	message := reflect.New(schema.msgType)
+	if err := decodeFields(msg[1:], message.Elem()); err != nil {
+		return nil, errors.New("malformed " + schema.name + " message - " + err.Error())
 	}
-	for i := range md5Hashes {
-		copy(syncReqMsg[start:start+32], md5Hashes[i])
-		start += 32
-	}
-	for i := range modTimes {
-		goUtils.GetBytesFromUint32(syncReqMsg[start:start+32], modTimes[i])
-		start += 32
-	}
-	for i := range fileNames {
-		copy(syncReqMsg[start:start+len(fileNames[i])], fileNames[i])
-		start += len(fileNames[i])
-	}
-	return syncReqMsg
+	return message.Interface(), nil
 }
 
-func extractSyncReqMsg(syncReqMsg []byte) (byte, uint32, []uint64, []string, []string, []uint32) {
-	num_files := binary.BigEndian.Uint16(syncReqMsg[2:4])
-	folderID := uint32(binary.BigEndian.Uint32(syncReqMsg[4:8]))
-	start := 8
-	name_lengths := []byte{}
-	for ; start < int(num_files)+8; start++ {
-		name_lengths = append(name_lengths, syncReqMsg[start])
+func appendFields(msg []byte, value reflect.Value) []byte {
+	for _, field := range getWireFields(value.Type()) {
+		fieldValue := value.Field(field.index)
+		switch {
+		case fieldValue.Kind() == reflect.Slice && fieldValue.Type().Elem().Kind() != reflect.Uint8:
+			for i := 0; i < fieldValue.Len(); i++ {
+				msg = appendField(msg, field.tag, getValueBytes(fieldValue.Index(i)))
+			}
+		case fieldValue.Kind() == reflect.Map:
+			//Entries are sorted by key so that a map is always encoded the same way
+			keys := fieldValue.MapKeys()
+			sort.Slice(keys, func(i, j int) bool {
+				return string(getValueBytes(keys[i])) < string(getValueBytes(keys[j]))
+			})
+			for _, key := range keys {
+				entry := appendField(nil, 1, getValueBytes(key))
+				entry = appendField(entry, 2, getValueBytes(fieldValue.MapIndex(key)))
+				msg = appendField(msg, field.tag, entry)
+			}
+		case !fieldValue.IsZero():
+			msg = appendField(msg, field.tag, getValueBytes(fieldValue))
+		}
 	}
-	fileSizes := []uint64{}
-	for i := 0; i < int(num_files); i++ {
-		fileSizes = append(fileSizes, binary.BigEndian.Uint64(syncReqMsg[start:start+8]))
-		start += 8
-	}
-	md5Hashes := []string{}
-	for i := 0; i < int(num_files); i++ {
-		md5Hashes = append(md5Hashes, string(syncReqMsg[start:start+32]))
-		start += 32
-	}
-	modTimes := []uint32{}
-	for i := 0; i < int(num_files); i++ {
-		modTimes = append(modTimes, binary.BigEndian.Uint32(syncReqMsg[start:start+32]))
-		start += 32
+	return msg
+}
+
+func appendField(msg []byte, tag uint64, valueBytes []byte) []byte {
+	msg = appendUvarint(msg, tag)
+	msg = appendUvarint(msg, uint64(len(valueBytes)))
+	return append(msg, valueBytes...)
+}
+
+func appendUvarint(msg []byte, value uint64) []byte {
+	varintBytes := make([]byte, binary.MaxVarintLen64)
+	varintLen := binary.PutUvarint(varintBytes, value)
+	return append(msg, varintBytes[:varintLen]...)
+}
+
+func getValueBytes(value reflect.Value) []byte {
+	switch value.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return appendUvarint(nil, value.Uint())
+	case reflect.Bool:
+		if value.Bool() {
+			return []byte{1}
+		}
+		return []byte{0}
+	case reflect.String:
+		return []byte(value.String())
+	case reflect.Slice:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			return value.Bytes()
+		}
+	case reflect.Struct:
+		return appendFields(nil, value)
 	}
-	fileNames := []string{}
-	for i := range name_lengths {
-		fileNames = append(fileNames, string(syncReqMsg[start:start+int(name_lengths[i])]))
-		start += int(name_lengths[i])
+	panic("Unsupported type in message schema - " + value.Type().String())
+}
+
+//readFields calls handleField with the tag and value of every field in msg
+func readFields(msg []byte, handleField func(tag uint64, valueBytes []byte) error) error {
+	for position := 0; position < len(msg); {
+		tag, tagLen := binary.Uvarint(msg[position:])
+		if tagLen <= 0 {
+			return errors.New("invalid field tag at offset " + strconv.Itoa(position))
+		}
+		position += tagLen
+		valueLen, lengthLen := binary.Uvarint(msg[position:])
+		if lengthLen <= 0 {
+			return errors.New("invalid length of field " + strconv.FormatUint(tag, 10))
+		}
+		position += lengthLen
+		if valueLen > uint64(len(msg)-position) {
+			return errors.New("field " + strconv.FormatUint(tag, 10) + " runs past the end of the message")
+		}
+		if err := handleField(tag, msg[position:position+int(valueLen)]); err != nil {
+			return err
+		}
+		position += int(valueLen)
 	}
-	return syncReqMsg[1], folderID, fileSizes, fileNames, md5Hashes, modTimes
+	return nil
 }
 
-func getMsgType(msg []byte) string {
-	availableMsgTypes := map[byte]string{
-		0: "ping",
-		1: "pong",
-		2: "sync_req",
-		3: "file_req",
-		4: "file_data",
+func decodeFields(msg []byte, value reflect.Value) error {
+	return readFields(msg, func(tag uint64, valueBytes []byte) error {
+		field, known := getWireField(value.Type(), tag)
+		if !known {
+			return nil
+		}
+		fieldValue := value.Field(field.index)
+		switch {
+		case fieldValue.Kind() == reflect.Slice && fieldValue.Type().Elem().Kind() != reflect.Uint8:
+			element := reflect.New(fieldValue.Type().Elem()).Elem()
+			if err := decodeValue(valueBytes, element); err != nil {
+				return err
+			}
+			fieldValue.Set(reflect.Append(fieldValue, element))
+		case fieldValue.Kind() == reflect.Map:
+			if fieldValue.IsNil() {
+				fieldValue.Set(reflect.MakeMap(fieldValue.Type()))
+			}
+			key := reflect.New(fieldValue.Type().Key()).Elem()
+			entryValue := reflect.New(fieldValue.Type().Elem()).Elem()
+			err := readFields(valueBytes, func(entryTag uint64, entryBytes []byte) error {
+				switch entryTag {
+				case 1:
+					return decodeValue(entryBytes, key)
+				case 2:
+					return decodeValue(entryBytes, entryValue)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			fieldValue.SetMapIndex(key, entryValue)
+		default:
+			return decodeValue(valueBytes, fieldValue)
+		}
+		return nil
+	})
+}
+
+func decodeValue(valueBytes []byte, value reflect.Value) error {
+	switch value.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number, numberLen := binary.Uvarint(valueBytes)
+		if numberLen <= 0 || numberLen != len(valueBytes) || value.OverflowUint(number) {
+			return errors.New("invalid " + value.Type().String() + " value")
+		}
+		value.SetUint(number)
+		return nil
+	case reflect.Bool:
+		if len(valueBytes) != 1 || valueBytes[0] > 1 {
+			return errors.New("invalid bool value")
+		}
+		value.SetBool(valueBytes[0] == 1)
+		return nil
+	case reflect.String:
+		value.SetString(string(valueBytes))
+		return nil
+	case reflect.Slice:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			value.SetBytes(valueBytes)
+			return nil
+		}
+	case reflect.Struct:
+		return decodeFields(valueBytes, value)
 	}
-	msgType := availableMsgTypes[msg[0]]
-	return msgType
+	return errors.New("unsupported type in message schema - " + value.Type().String())
+}
+
+//getHelloMsg creates the hello message sent at the start of the handshake. It is JSON encoded so that peers with
+//different protocol versions can always read each other's hello
+func getHelloMsg(hello HelloMsg) []byte {
+	helloBytes, _ := json.Marshal(hello)
+	helloMsg := make([]byte, 4+len(helloBytes))
+	goUtils.GetBytesFromUint32(helloMsg[0:4], uint32(len(helloBytes)))
+	copy(helloMsg[4:], helloBytes)
+	return helloMsg
+}
+
+func extractHelloMsg(helloMsg []byte) (HelloMsg, error) {
+	hello := HelloMsg{}
+	err := json.Unmarshal(helloMsg, &hello)
+	return hello, err
 }
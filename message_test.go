@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+//getSeedMessages returns an encoded message of every type in the schema, without its length, to seed the fuzz tests
+func getSeedMessages() [][]byte {
+	messages := []interface{}{
+		&PingMsg{SentAt: 1},
+		&PongMsg{SentAt: 1},
+		&FileReqMsg{DiffType: fileReqPieces, FolderID: 1, Name: "a.txt", PieceIndices: []uint32{0, 2}, Offset: 10},
+		&FileDataMsg{FolderID: 1, Name: "a.txt", Data: []byte("data")},
+		&PieceDataMsg{FolderID: 1, Name: "a.txt", Offset: pieceSize, Data: []byte("data")},
+		&FileRefuseMsg{FolderID: 1, Name: "a.txt", Reason: "reason"},
+		&IndexChunkMsg{
+			DiffType: 1,
+			FolderID: 1,
+			Final:    true,
+			Files: []FileEntry{{
+				Name:        "dir/a.txt",
+				Size:        4,
+				Md5:         "md5",
+				ModTime:     1,
+				PieceHashes: []string{"hash"},
+				Version:     VersionVector{"device": 2},
+			}},
+			Dirs:       []string{"dir"},
+			Tombstones: []TombstoneEntry{{Name: "b.txt", Md5: "md5", DeletedAt: 1, Version: VersionVector{"device": 1}}},
+		},
+	}
+	seeds := [][]byte{}
+	for _, message := range messages {
+		seeds = append(seeds, encodeMessage(message)[4:])
+	}
+	return seeds
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		message interface{}
+	}{
+		{"zero ping", &PingMsg{}},
+		{"ping", &PingMsg{SentAt: 1<<64 - 1}},
+		{"zero pong", &PongMsg{}},
+		{"pong", &PongMsg{SentAt: 1234567890}},
+		{"zero file_req", &FileReqMsg{}},
+		{"whole file_req", &FileReqMsg{DiffType: fileReqWhole, FolderID: 1<<32 - 1, Name: "dir/ä.txt"}},
+		{"pieces file_req", &FileReqMsg{DiffType: fileReqPieces, FolderID: 1, Name: "a", PieceIndices: []uint32{0, 0, 7}}},
+		{"resume file_req", &FileReqMsg{DiffType: fileReqResume, FolderID: 1, Name: "a", Offset: 1 << 40}},
+		{"zero file_data", &FileDataMsg{}},
+		{"file_data", &FileDataMsg{FolderID: 1, Name: "a", Data: []byte{0, 1, 2, 0xff}}},
+		{"zero piece_data", &PieceDataMsg{}},
+		{"piece_data", &PieceDataMsg{FolderID: 1, Name: "a", Offset: 3 * pieceSize, Data: bytes.Repeat([]byte{7}, 4096)}},
+		{"zero file_refuse", &FileRefuseMsg{}},
+		{"file_refuse", &FileRefuseMsg{FolderID: 1, Name: "dir/a", Reason: "the file is already being sent"}},
+		{"zero index_chunk", &IndexChunkMsg{}},
+		{"index_chunk", &IndexChunkMsg{
+			DiffType: 1,
+			FolderID: 2,
+			Sequence: 3,
+			Final:    true,
+			Files: []FileEntry{
+				{},
+				{Name: "a", Size: 1, Md5: "md5", ModTime: 2, PieceHashes: []string{"", "hash"}, Version: VersionVector{}},
+				{Name: "b", PieceHashes: []string{"next"}, PieceOffset: 2, Version: VersionVector{"": 0, "x": 1, "y": 1<<64 - 1}},
+			},
+			Dirs:       []string{"", "dir", "dir/sub"},
+			Tombstones: []TombstoneEntry{{}, {Name: "c", Md5: "md5", DeletedAt: 4, Version: VersionVector{"x": 5}}},
+		}},
+	}
+	testedTypes := make(map[byte]bool)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := encodeMessage(test.message)
+			testedTypes[msg[4]] = true
+			if int(binary.BigEndian.Uint32(msg)) != len(msg)-4 {
+				t.Fatalf("length %d does not match a message of %d bytes", binary.BigEndian.Uint32(msg), len(msg)-4)
+			}
+			decoded, err := decodeMessage(msg[4:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(normalizeMessage(decoded), normalizeMessage(test.message)) {
+				t.Fatalf("decoded %+v, want %+v", decoded, test.message)
+			}
+			if !bytes.Equal(encodeMessage(decoded), msg) {
+				t.Fatal("encoding the decoded message gives different bytes")
+			}
+		})
+	}
+	for msgType, schema := range messageSchema {
+		if !testedTypes[msgType] {
+			t.Errorf("no round trip test for %s messages", schema.name)
+		}
+	}
+}
+
+//normalizeMessage replaces the empty slices and maps in a message with nil, as empty and missing repeated fields are
+//sent the same way
+func normalizeMessage(message interface{}) interface{} {
+	value := reflect.New(reflect.TypeOf(message).Elem())
+	value.Elem().Set(reflect.ValueOf(message).Elem())
+	normalizeValue(value.Elem())
+	return value.Interface()
+}
+
+func normalizeValue(value reflect.Value) {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Map:
+		if value.Len() == 0 {
+			value.Set(reflect.Zero(value.Type()))
+			return
+		}
+		if value.Kind() == reflect.Slice {
+			copied := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+			reflect.Copy(copied, value)
+			value.Set(copied)
+			for i := 0; i < value.Len(); i++ {
+				normalizeValue(value.Index(i))
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			normalizeValue(value.Field(i))
+		}
+	}
+}
+
+//FuzzDecodeMessage checks that any message which decodes is encoded back into a message which decodes the same way
+func FuzzDecodeMessage(f *testing.F) {
+	for _, seed := range getSeedMessages() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		decoded, err := decodeMessage(msg)
+		if err != nil {
+			return
+		}
+		reencoded, err := decodeMessage(encodeMessage(decoded)[4:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(normalizeMessage(reencoded), normalizeMessage(decoded)) {
+			t.Fatalf("re-encoded %+v, decoded %+v", reencoded, decoded)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//validateFileName checks a file or directory name received from a peer before it is used to build a local path. Names
+//have to be relative "/" separated paths which stay inside the folder and do not touch its .syncIt config
+func validateFileName(fileName string) error {
+	switch {
+	case fileName == "":
+		return errors.New("empty file name")
+	case !utf8.ValidString(fileName):
+		return errors.New("file name " + strconv.Quote(fileName) + " is not valid UTF-8")
+	case strings.ContainsRune(fileName, 0):
+		return errors.New("file name " + strconv.Quote(fileName) + " contains a NUL character")
+	case strings.Contains(fileName, "\\"):
+		return errors.New("file name " + strconv.Quote(fileName) + " contains a backslash")
+	case strings.HasPrefix(fileName, "/") || filepath.IsAbs(filepath.FromSlash(fileName)) ||
+		filepath.VolumeName(filepath.FromSlash(fileName)) != "":
+		return errors.New("file name " + strconv.Quote(fileName) + " is an absolute path")
+	}
+	for i, component := range strings.Split(fileName, "/") {
+		switch {
+		case component == "":
+			return errors.New("file name " + strconv.Quote(fileName) + " has an empty path component")
+		case component == "." || component == "..":
+			return errors.New("file name " + strconv.Quote(fileName) + " has a " + component + " path component")
+		case i == 0 && strings.EqualFold(strings.TrimRight(component, ". "), ".syncIt"):
+			//Case insensitive file systems, and Windows dropping trailing dots and spaces, would map these to .syncIt
+			return errors.New("file name " + strconv.Quote(fileName) + " targets the .syncIt config")
+		}
+	}
+	return nil
+}
+
+//validatePeerFileNames checks every name in a sync request received from a peer, returning the first invalid one. For
+//a folder which already exists at folderPath, the names are also checked with getPeerFilePath
+func validatePeerFileNames(folderPath string, peerFiles []SyncFile, dirNames []string, tombstones []Tombstone) error {
+	names := append([]string{}, dirNames...)
+	for i := range peerFiles {
+		names = append(names, peerFiles[i].Name)
+	}
+	for i := range tombstones {
+		names = append(names, tombstones[i].Name)
+	}
+	for _, name := range names {
+		err := validateFileName(name)
+		if err == nil && folderPath != "" {
+			_, err = getPeerFilePath(folderPath, name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//getPeerFilePath returns the local path of a file named by a peer inside folderPath. Besides the name being valid, none
+//of the directories leading to the file may be a symlink, which could otherwise point outside the folder
+func getPeerFilePath(folderPath string, fileName string) (string, error) {
+	if err := validateFileName(fileName); err != nil {
+		return "", err
+	}
+	components := strings.Split(fileName, "/")
+	parentPath := folderPath
+	for _, component := range components[:len(components)-1] {
+		parentPath = filepath.Join(parentPath, component)
+		fileInfo, err := os.Lstat(parentPath)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err == nil && fileInfo.Mode()&os.ModeSymlink != 0 {
+			return "", errors.New("file name " + strconv.Quote(fileName) + " leads through the symlink " + parentPath)
+		}
+	}
+	return getLocalPath(folderPath, fileName), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateFileName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"a.txt", true},
+		{"dir/sub/a.txt", true},
+		{".hidden", true},
+		{"..a", true},
+		{"a..", true},
+		{"dir/.syncIt", true},
+		{".syncItx/a.txt", true},
+		{"", false},
+		{"..", false},
+		{".", false},
+		{"../a.txt", false},
+		{"dir/../../a.txt", false},
+		{"dir/./a.txt", false},
+		{"dir//a.txt", false},
+		{"dir/", false},
+		{"/etc/passwd", false},
+		{"\\\\server\\share\\a.txt", false},
+		{"dir\\..\\a.txt", false},
+		{"C:\\a.txt", false},
+		{"a\x00.txt", false},
+		{"a\xff.txt", false},
+		{".syncIt", false},
+		{".syncIt/.syncIt.json", false},
+		{".SYNCIT/.syncIt.json", false},
+		{".SyncIt/.syncIt.json", false},
+		{".syncIt./.syncIt.json", false},
+		{".syncIt /.syncIt.json", false},
+	}
+	for _, test := range tests {
+		err := validateFileName(test.name)
+		if (err == nil) != test.valid {
+			t.Errorf("validateFileName(%q) returned %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestGetPeerFilePath(t *testing.T) {
+	folderPath := t.TempDir()
+	outsidePath := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(folderPath, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outsidePath, filepath.Join(folderPath, "link")); err != nil {
+		t.Skip("symlinks are not supported", err)
+	}
+	if err := os.Symlink(outsidePath, filepath.Join(folderPath, "dir", "link")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		localPath string
+	}{
+		{"a.txt", filepath.Join(folderPath, "a.txt")},
+		{"dir/a.txt", filepath.Join(folderPath, "dir", "a.txt")},
+		{"new/dir/a.txt", filepath.Join(folderPath, "new", "dir", "a.txt")},
+		//A symlink named by the file itself is replaced rather than followed
+		{"link", filepath.Join(folderPath, "link")},
+		{"link/a.txt", ""},
+		{"dir/link/a.txt", ""},
+		{"../a.txt", ""},
+		{".SYNCIT/.syncIt.json", ""},
+	}
+	for _, test := range tests {
+		localPath, err := getPeerFilePath(folderPath, test.name)
+		if test.localPath == "" {
+			if err == nil {
+				t.Errorf("getPeerFilePath(%q) returned %s, want an error", test.name, localPath)
+			}
+			continue
+		}
+		if err != nil || localPath != test.localPath {
+			t.Errorf("getPeerFilePath(%q) returned %s, %v, want %s", test.name, localPath, err, test.localPath)
+		}
+	}
+}
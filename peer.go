@@ -1,87 +1,303 @@
 package main
 
 import (
-	"encoding/binary"
-	"fmt"
+	"encoding/json"
+	"errors"
 	"github.com/akshay1713/goUtils"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+var errPeerDisconnected = errors.New("peer disconnected")
+
 //Peer contains the following data associated with a connected peer-
-//Conn - The TCP connection with that peer
+//Conn - The TLS encrypted connection with that peer
 type Peer struct {
-	Conn           *net.TCPConn
-	closeChan      chan Peer
-	connectedAt    uint32
-	connected      bool
-	username       string
-	msgChan        chan []byte
-	stopMsgChan    chan bool
-	sendMutex      sync.Mutex
-	cliController  *CLIController
-	folderManager  FolderManager
-	sendingFiles   MultipleTransferFiles
-	receivingFiles MultipleTransferFiles
+	Conn            net.Conn
+	closeChan       chan *Peer
+	connectedAt     uint32
+	connected       bool
+	username        string
+	deviceID        string
+	softwareVersion string
+	protocolVersion uint32
+	capabilities    map[string]bool
+	maxFrameSize    uint32
+	limits          PeerLimits
+	msgChan         chan []byte
+	stopMsgChan     chan bool
+	sendMutex       sync.Mutex
+	cliController   *CLIController
+	folderManager   FolderManager
+	sendingFiles    MultipleTransferFiles
+	receivingFiles  MultipleTransferFiles
+	pendingIndexes  map[uint32]*pendingIndex
+	//rejectedCount and lastRejection are updated by the goroutines reading from the peer and read by the API, so they are
+	//guarded by flagMutex
+	rejectedCount int
+	lastRejection string
+	flagMutex     sync.Mutex
+	//transfersMutex guards sendingFiles and receivingFiles, which are read by the API while transfers update them
+	transfersMutex sync.Mutex
+	//pendingIndexEntries and pendingIndexSize are the totals of the indexes being received, bounded by the limits
+	pendingIndexEntries int
+	pendingIndexSize    int
+	//lastSeen is when the last message was received from the peer, and rtt the round trip time of the last ping.
+	//handling is set while a message from the peer is being handled, during which nothing else is read from it
+	lastSeen       time.Time
+	rtt            time.Duration
+	handling       bool
+	keepaliveMutex sync.Mutex
+	disconnectOnce sync.Once
+}
+
+func (peer *Peer) hasCapability(capability string) bool {
+	return peer.capabilities[capability]
+}
+
+//flag records that a request from the peer had to be rejected, such as one naming a file outside the folder, so that
+//the peer stands out in its status and in the events. Once the peer reaches the maximum number of rejections it is
+//banned, and its connection is closed
+func (peer *Peer) flag(reason string) {
+	peer.flagMutex.Lock()
+	peer.rejectedCount++
+	peer.lastRejection = reason
+	rejectedCount := peer.rejectedCount
+	peer.flagMutex.Unlock()
+	log.Println("Rejected", reason, "from", peer.username, "-", peer.deviceID)
+	events.publish(eventPeerFlagged, "Rejected "+reason+" from "+peer.username, PeerFlaggedEventData{
+		PeerEventData: peer.getPeerEventData(),
+		Reason:        reason,
+		RejectedCount: rejectedCount,
+	})
+	if peer.limits.MaxRejections > 0 && rejectedCount == peer.limits.MaxRejections {
+		banDevice(peer.deviceID, peer.limits.BanDuration)
+		events.publish(eventPeerBanned, "Banned "+peer.username+" for "+peer.limits.BanDuration.String()+" after "+
+			strconv.Itoa(rejectedCount)+" rejected messages", PeerFlaggedEventData{
+			PeerEventData: peer.getPeerEventData(),
+			Reason:        reason,
+			RejectedCount: rejectedCount,
+		})
+		peer.Conn.Close()
+	}
+}
+
+//sendSyncReq announces a folder to the peer, leaving out the parts of the index which the peer has not declared
+//support for
+func (peer *Peer) sendSyncReq(syncData SyncData) {
+	syncData = syncData.forCapabilities(peer.capabilities)
+	peer.sendIndexChunks(syncData, 1)
+}
+
+//announceSharedFolders announces every folder shared with the peer, so that the syncs and transfers which were pending
+//when the peer connected, or when its connection last dropped, resume without waiting for the folders to change
+func (peer *Peer) announceSharedFolders() {
+	for _, syncData := range peer.folderManager.getAnnouncedFolders(peer.deviceID) {
+		peer.sendSyncReq(syncData)
+	}
+}
+
+//sendIndexChunks announces a folder as a sequence of index_chunk messages, each holding at most maxIndexChunkLength
+//bytes of the index, or half the maximum frame size of the peer if that is smaller, so that large folders never have
+//to be encoded into a single message. The piece hashes of a file which do not fit in a chunk are split across chunks
+func (peer *Peer) sendIndexChunks(syncData SyncData, diffType byte) error {
+	maxChunkLen := maxIndexChunkLength
+	if int(peer.maxFrameSize/2) < maxChunkLen {
+		maxChunkLen = int(peer.maxFrameSize / 2)
+	}
+	chunk := IndexChunkMsg{DiffType: diffType, FolderID: syncData.UniqueID}
+	chunkLen := 0
+	sendChunk := func(final bool) error {
+		chunk.Final = final
+		err := peer.sendMessage(encodeMessage(&chunk))
+		chunk.Sequence++
+		chunk.Files, chunk.Dirs, chunk.Tombstones = nil, nil, nil
+		chunkLen = 0
+		return err
+	}
+	//makeRoom starts the next chunk if the current one has no room for an entry, returning false if the entry is too
+	//large for any chunk
+	makeRoom := func(name string, entryLen int) (bool, error) {
+		if entryLen > maxChunkLen {
+			log.Println("Leaving", name, "in folder", syncData.UniqueID, "out of the index sent to", peer.username,
+				"as its entry is larger than", maxChunkLen, "bytes")
+			return false, nil
+		}
+		if chunkLen+entryLen > maxChunkLen {
+			if err := sendChunk(false); err != nil {
+				return false, err
+			}
+		}
+		chunkLen += entryLen
+		return true, nil
+	}
+	pieceHashLen := getIndexEntryLen("", 1, nil) - getIndexEntryLen("", 0, nil)
+	for i := range syncData.Files {
+		file := syncData.Files[i]
+		entry := getFileEntry(file)
+		entryLen := getIndexEntryLen(file.Name, 0, file.Version)
+		maxPieceHashes := (maxChunkLen - entryLen) / pieceHashLen
+		remainingHashes := file.PieceHashes
+		for {
+			partHashes := remainingHashes
+			if len(partHashes) > maxPieceHashes && maxPieceHashes > 0 {
+				partHashes = partHashes[:maxPieceHashes]
+			}
+			fits, err := makeRoom(file.Name, entryLen+len(partHashes)*pieceHashLen)
+			if err != nil {
+				return err
+			}
+			if !fits {
+				break
+			}
+			entry.PieceHashes = partHashes
+			chunk.Files = append(chunk.Files, entry)
+			remainingHashes = remainingHashes[len(partHashes):]
+			if len(remainingHashes) == 0 {
+				break
+			}
+			entry = FileEntry{Name: file.Name, PieceOffset: uint32(len(file.PieceHashes) - len(remainingHashes))}
+		}
+	}
+	for i := range syncData.Dirs {
+		fits, err := makeRoom(syncData.Dirs[i], getIndexEntryLen(syncData.Dirs[i], 0, nil))
+		if err != nil {
+			return err
+		}
+		if fits {
+			chunk.Dirs = append(chunk.Dirs, syncData.Dirs[i])
+		}
+	}
+	for i := range syncData.Tombstones {
+		entryLen := getIndexEntryLen(syncData.Tombstones[i].Name, 0, syncData.Tombstones[i].Version)
+		fits, err := makeRoom(syncData.Tombstones[i].Name, entryLen)
+		if err != nil {
+			return err
+		}
+		if fits {
+			chunk.Tombstones = append(chunk.Tombstones, getTombstoneEntry(syncData.Tombstones[i]))
+		}
+	}
+	return sendChunk(true)
 }
 
 func (peer *Peer) initPeer() {
+	peer.transfersMutex.Lock()
 	peer.sendingFiles = []TransferFile{}
 	peer.receivingFiles = []TransferFile{}
+	peer.transfersMutex.Unlock()
+	peer.dropPendingIndexes()
+	peer.markSeen()
 	peer.createMsgChan()
 	go peer.listenForMessages()
-	peer.setPing()
+	go peer.keepAlive()
 }
 
 //sendMessage is the route through which all messages are sent to a peer.
-//Uses a mutex(not strictly necessary)
+//Uses a mutex(not strictly necessary). Messages larger than the maximum frame size of the peer are not sent, and a
+//write which the peer does not take in within the keepalive timeout fails
 func (peer *Peer) sendMessage(msg []byte) error {
+	if len(msg)-4 > int(peer.maxFrameSize) {
+		log.Println("Not sending a message of", len(msg)-4, "bytes to", peer.username, "which accepts at most",
+			peer.maxFrameSize)
+		return errFrameTooLarge
+	}
 	peer.sendMutex.Lock()
+	peer.Conn.SetWriteDeadline(time.Now().Add(peer.limits.KeepaliveTimeout))
 	_, err := peer.Conn.Write(msg)
 	peer.sendMutex.Unlock()
 	return err
 }
 
-func (peer Peer) setPing() {
-	// Do NOT forget to increase this time later
-	time.AfterFunc(2*time.Second, peer.sendPing)
+//keepAlive pings the peer every keepalive interval, and closes the connection once nothing has been received from the
+//peer for longer than the keepalive timeout, other than while one of its messages is being handled, so that a peer which
+//vanished without closing the connection is torn down like any other disconnected peer
+func (peer *Peer) keepAlive() {
+	ticker := time.NewTicker(peer.limits.KeepaliveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		lastSeen, _ := peer.getKeepaliveStatus()
+		if silence := time.Since(lastSeen); silence > peer.limits.KeepaliveTimeout && !peer.isHandling() {
+			log.Println("Nothing received from", peer.username, "for", silence.Round(time.Second), "- disconnecting")
+			peer.Conn.Close()
+			return
+		}
+		//Sending fails once the connection is closed, however it was lost
+		if err := peer.sendMessage(encodeMessage(&PingMsg{SentAt: uint64(time.Now().UnixNano())})); err != nil {
+			return
+		}
+	}
 }
 
-func (peer Peer) sendPing() {
-	if !peer.connected {
-		fmt.Println("Stopping ping")
-		return
-	}
-	time.AfterFunc(2*time.Second, peer.sendPing)
-	pingMessage := getPingMsg()
-	peer.sendMessage(pingMessage)
+func (peer *Peer) markSeen() {
+	peer.keepaliveMutex.Lock()
+	peer.lastSeen = time.Now()
+	peer.keepaliveMutex.Unlock()
+}
+
+//setHandling records whether a message from the peer is being handled. Handling a message, such as an index which
+//has the whole folder hashed again, can take longer than the keepalive timeout, during which nothing is read from the
+//peer. The peer is not counted as silent till then, and is counted as seen once the message has been handled
+func (peer *Peer) setHandling(handling bool) {
+	peer.keepaliveMutex.Lock()
+	peer.handling = handling
+	peer.lastSeen = time.Now()
+	peer.keepaliveMutex.Unlock()
+}
+
+func (peer *Peer) isHandling() bool {
+	peer.keepaliveMutex.Lock()
+	defer peer.keepaliveMutex.Unlock()
+	return peer.handling
+}
+
+//getKeepaliveStatus returns when a message was last received from the peer, and the round trip time of the last ping
+//answered by it
+func (peer *Peer) getKeepaliveStatus() (time.Time, time.Duration) {
+	peer.keepaliveMutex.Lock()
+	defer peer.keepaliveMutex.Unlock()
+	return peer.lastSeen, peer.rtt
 }
 
 func (peer *Peer) listenForMessages() {
 	for {
-		msg := <-peer.msgChan
-		if len(msg) == 0 {
+		var msg []byte
+		select {
+		case msg = <-peer.msgChan:
+		case <-peer.stopMsgChan:
 			return
 		}
-		msgType := getMsgType(msg)
-		switch msgType {
-		case "ping":
-			peer.pingHandler()
-		case "sync_req":
-			peer.syncReqHandler(msg)
-		case "file_req":
-			peer.fileReqHandler(msg)
-		case "file_data":
-			peer.fileDataHandler(msg)
+		message, err := decodeMessage(msg)
+		if err != nil {
+			peer.flag(err.Error())
+			continue
 		}
-
+		peer.setHandling(true)
+		switch message := message.(type) {
+		case *PingMsg:
+			peer.pingHandler(message)
+		case *PongMsg:
+			peer.pongHandler(message)
+		case *IndexChunkMsg:
+			peer.indexChunkHandler(message)
+		case *FileReqMsg:
+			peer.fileReqHandler(message)
+		case *FileDataMsg:
+			peer.fileDataHandler(message)
+		case *PieceDataMsg:
+			peer.pieceDataHandler(message)
+		case *FileRefuseMsg:
+			peer.fileRefuseHandler(message)
+		}
+		peer.setHandling(false)
 	}
 }
 
@@ -93,245 +309,829 @@ func (peer *Peer) createMsgChan() {
 		for {
 			select {
 			case <-peer.stopMsgChan:
-				fmt.Println("Stopping poll func")
 				return
 			default:
 				msg, err := peer.getNextMessage()
+				if err == errFrameTooLarge || err == errEmptyFrame {
+					peer.flag(err.Error() + ", disconnecting")
+				}
 				if len(msg) == 0 || err != nil {
 					peer.disConnect()
-					peer.stopMsgChan <- true
 					return
 				}
-				msgChan <- msg
+				peer.markSeen()
+				//The peer may be disconnected while a message is handled, by another goroutine
+				select {
+				case msgChan <- msg:
+				case <-peer.stopMsgChan:
+					return
+				}
 			}
 		}
 	}()
 	peer.msgChan = msgChan
 }
 
-func (peer Peer) stopMsgLoop() {
+func (peer *Peer) stopMsgLoop() {
 	peer.stopMsgChan <- true
 }
 
 //getNextMessage gets the next message from a connected peer. Each message is preceded by 4 bytes containing the length
-//of the actual message. The first byte of the actual message identifies the type of the message
-func (peer Peer) getNextMessage() ([]byte, error) {
-	msgLength := 4
-	lengthMsg := make([]byte, msgLength)
-	_, err := io.ReadFull(peer.Conn, lengthMsg)
-	payloadLength := binary.BigEndian.Uint32(lengthMsg)
-	msg := make([]byte, payloadLength)
-	_, err = io.ReadFull(peer.Conn, msg)
-	return msg, err
+//of the actual message, which may not exceed the configured maximum frame size. The first byte of the actual message
+//identifies the type of the message
+func (peer *Peer) getNextMessage() ([]byte, error) {
+	return readFrame(peer.Conn, peer.limits.MaxFrameSize)
 }
 
-func (peer Peer) pingHandler() {
-	//fmt.Println("Ping received")
+func (peer *Peer) pingHandler(ping *PingMsg) {
+	peer.sendPong(ping.SentAt)
+}
+
+//pongHandler measures the round trip time of a ping from the time it was sent, which the peer echoes back
+func (peer *Peer) pongHandler(pong *PongMsg) {
+	rtt := time.Since(time.Unix(0, int64(pong.SentAt)))
+	if pong.SentAt == 0 || rtt < 0 || rtt > peer.limits.KeepaliveTimeout {
+		return
+	}
+	peer.keepaliveMutex.Lock()
+	peer.rtt = rtt
+	peer.keepaliveMutex.Unlock()
 }
 
 func (peer *Peer) sendFile(file TransferFile) {
-	log.Println("Sending file ", file.filePath)
+	peer.publishTransferEvent(eventTransferStarted, "sending", file, nil)
+	previousSize := file.transferredSize
 	fileData := file.getNextBytes()
 	for len(fileData) > 0 {
-		fileDataMsg := getFileDataMsg(fileData, file.uniqueID, file.getFileName())
-		peer.sendingFiles = peer.sendingFiles.update(file)
-		peer.sendMessage(fileDataMsg)
+		fileDataMsg := encodeMessage(&FileDataMsg{FolderID: file.uniqueID, Name: file.getFileName(), Data: fileData})
+		peer.updateTransfer(&peer.sendingFiles, file)
+		if err := peer.sendMessage(fileDataMsg); err != nil {
+			peer.removeTransfer(&peer.sendingFiles, file.filePath)
+			peer.publishTransferEvent(eventTransferFailed, "sending", file, err)
+			return
+		}
+		peer.publishTransferProgress("sending", file, previousSize)
+		previousSize = file.transferredSize
 		fileData = file.getNextBytes()
 	}
-	peer.sendingFiles = peer.sendingFiles.remove(file.filePath)
+	peer.removeTransfer(&peer.sendingFiles, file.filePath)
+	peer.publishTransferEvent(eventTransferFinished, "sending", file, nil)
 }
 
-func (peer *Peer) fileDataHandler(fileDataMsg []byte) {
-	var file TransferFile
-	uniqueID, fileName, fileData := extractFileData(fileDataMsg)
+//sendPieces sends only the requested pieces of a file, each in chunks of 4096 bytes tagged with their offset
+func (peer *Peer) sendPieces(file TransferFile) {
+	peer.publishTransferEvent(eventTransferStarted, "sending", file, nil)
+	for _, pieceIndex := range file.pieceIndices {
+		pieceBytes := file.getPieceBytes(pieceIndex)
+		offset := uint64(pieceIndex) * pieceSize
+		for start := 0; start < len(pieceBytes); start += 4096 {
+			end := start + 4096
+			if end > len(pieceBytes) {
+				end = len(pieceBytes)
+			}
+			pieceDataMsg := encodeMessage(&PieceDataMsg{
+				FolderID: file.uniqueID,
+				Name:     file.getFileName(),
+				Offset:   offset + uint64(start),
+				Data:     pieceBytes[start:end],
+			})
+			previousSize := file.transferredSize
+			file.transferredSize += uint64(end - start)
+			peer.updateTransfer(&peer.sendingFiles, file)
+			if err := peer.sendMessage(pieceDataMsg); err != nil {
+				peer.removeTransfer(&peer.sendingFiles, file.filePath)
+				peer.publishTransferEvent(eventTransferFailed, "sending", file, err)
+				return
+			}
+			peer.publishTransferProgress("sending", file, previousSize)
+		}
+	}
+	peer.removeTransfer(&peer.sendingFiles, file.filePath)
+	peer.publishTransferEvent(eventTransferFinished, "sending", file, nil)
+}
+
+//getReceivingFile returns the file being received from the peer with the given name in the given folder
+func (peer *Peer) getReceivingFile(uniqueID uint32, fileName string) (TransferFile, bool) {
+	peer.transfersMutex.Lock()
+	defer peer.transfersMutex.Unlock()
 	for i := range peer.receivingFiles {
 		if peer.receivingFiles[i].uniqueID == uniqueID && peer.receivingFiles[i].getFileName() == fileName {
-			file = peer.receivingFiles[i]
-			break
+			return peer.receivingFiles[i], true
+		}
+	}
+	return TransferFile{}, false
+}
+
+//isSendingFile checks whether the file at filePath is already being sent to the peer
+func (peer *Peer) isSendingFile(filePath string) bool {
+	peer.transfersMutex.Lock()
+	defer peer.transfersMutex.Unlock()
+	for i := range peer.sendingFiles {
+		if peer.sendingFiles[i].filePath == filePath {
+			return true
 		}
 	}
+	return false
+}
+
+func (peer *Peer) addTransfer(transfers *MultipleTransferFiles, file TransferFile) {
+	peer.transfersMutex.Lock()
+	*transfers = append(*transfers, file)
+	peer.transfersMutex.Unlock()
+}
+
+func (peer *Peer) updateTransfer(transfers *MultipleTransferFiles, file TransferFile) {
+	peer.transfersMutex.Lock()
+	*transfers = transfers.update(file)
+	peer.transfersMutex.Unlock()
+}
+
+func (peer *Peer) removeTransfer(transfers *MultipleTransferFiles, filePath string) {
+	peer.transfersMutex.Lock()
+	*transfers = transfers.remove(filePath)
+	peer.transfersMutex.Unlock()
+}
+
+func (peer *Peer) fileDataHandler(fileDataMsg *FileDataMsg) {
+	uniqueID, fileName, fileData := fileDataMsg.FolderID, fileDataMsg.Name, fileDataMsg.Data
+	file, receiving := peer.getReceivingFile(uniqueID, fileName)
+	if !receiving {
+		log.Println("Dropping data for", fileName, "in folder", uniqueID, "from", peer.username, "which is not being received")
+		return
+	}
+	if file.transferredSize+uint64(len(fileData)) > file.fileSize {
+		peer.flag("data past the end of " + fileName + " in folder " + strconv.FormatInt(int64(uniqueID), 10))
+		return
+	}
+	previousSize := file.transferredSize
 	finished := file.writeBytes(fileData)
-	peer.receivingFiles = peer.receivingFiles.update(file)
+	peer.updateTransfer(&peer.receivingFiles, file)
+	peer.publishTransferProgress("receiving", file, previousSize)
 	if finished {
-		peer.receivingFiles = peer.receivingFiles.remove(file.filePath)
+		peer.finishReceivingFile(file)
 	}
 }
 
-func (peer *Peer) fileReqHandler(fileReqMsg []byte) {
-	uniqueID, fileName, diffType := extractFileReqMsg(fileReqMsg)
-	log.Println("Diff type is ", diffType)
-	filePath := peer.folderManager.getFilePath(uniqueID, fileName)
-	lockFile := filePath + ".lock"
-	if _, err := os.Stat(lockFile); !os.IsNotExist(err) {
-		log.Println("Lock file for", filePath, "exists, continuing")
+func (peer *Peer) pieceDataHandler(pieceDataMsg *PieceDataMsg) {
+	uniqueID, fileName, offset, fileData := pieceDataMsg.FolderID, pieceDataMsg.Name, pieceDataMsg.Offset, pieceDataMsg.Data
+	file, receiving := peer.getReceivingFile(uniqueID, fileName)
+	if !receiving {
+		log.Println("Dropping piece of", fileName, "in folder", uniqueID, "from", peer.username, "which is not being received")
 		return
 	}
+	if offset > file.fileSize || uint64(len(fileData)) > file.fileSize-offset {
+		peer.flag("piece past the end of " + fileName + " in folder " + strconv.FormatInt(int64(uniqueID), 10))
+		return
+	}
+	previousSize := file.transferredSize
+	finished := file.writeBytesAt(fileData, offset)
+	peer.updateTransfer(&peer.receivingFiles, file)
+	peer.publishTransferProgress("receiving", file, previousSize)
+	if finished {
+		peer.finishReceivingFile(file)
+	}
+}
+
+func (peer *Peer) fileReqHandler(fileReqMsg *FileReqMsg) {
+	uniqueID, fileName, diffType := fileReqMsg.FolderID, fileReqMsg.Name, fileReqMsg.DiffType
+	pieceIndices, offset := fileReqMsg.PieceIndices, fileReqMsg.Offset
+	if !peer.folderManager.isSharedWith(uniqueID, peer.deviceID) {
+		peer.refuseFileReq(uniqueID, fileName, "the folder is not shared with it")
+		return
+	}
+	if peer.folderManager.getFolderMode(uniqueID) == folderReceiveOnly {
+		peer.refuseFileReq(uniqueID, fileName, "the folder is receive-only")
+		return
+	}
+	filePath, err := getPeerFilePath(peer.folderManager.getFolderPath(uniqueID), fileName)
+	if err != nil {
+		peer.flag("request for a file in folder " + strconv.FormatInt(int64(uniqueID), 10) + " - " + err.Error())
+		peer.refuseFileReq(uniqueID, fileName, "the file name is invalid")
+		return
+	}
+	if _, indexed := peer.folderManager.getIndexedFile(uniqueID, fileName); !indexed {
+		peer.refuseFileReq(uniqueID, fileName, "the file is not in the index of the folder")
+		return
+	}
+	folderPath := peer.folderManager.getFolderPath(uniqueID)
+	//Transfers are tracked per peer, so the same file can be sent to several peers at once
+	if peer.isSendingFile(filePath) {
+		peer.refuseFileReq(uniqueID, fileName, "the file is already being sent to it")
+		return
+	}
+	//The file may have been deleted or replaced since it was indexed
 	filePtr, err := os.Open(filePath)
-	goUtils.HandleErr(err, "While opening file for sending"+filePath)
-	lockPtr, err := os.Create(lockFile)
-	goUtils.HandleErr(err, "While creating lock file "+lockFile)
+	if err != nil {
+		peer.refuseFileReq(uniqueID, fileName, "the file could not be opened - "+err.Error())
+		return
+	}
 	fileStat, err := filePtr.Stat()
-	goUtils.HandleErr(err, "While geting file stats")
-	modTime := fileStat.ModTime().UTC().Unix()
-	modTimeBytes := []byte(strconv.FormatInt(modTime, 10))
-	lockPtr.Write(modTimeBytes)
-	lockPtr.Close()
+	if err != nil || !fileStat.Mode().IsRegular() {
+		filePtr.Close()
+		peer.refuseFileReq(uniqueID, fileName, "the file is no longer a regular file")
+		return
+	}
 	fileSize := fileStat.Size()
+	if diffType == fileReqResume && offset > uint64(fileSize) {
+		filePtr.Close()
+		peer.flag("request to resume " + fileName + " from offset " + strconv.FormatUint(offset, 10) +
+			" beyond its size " + strconv.FormatInt(fileSize, 10))
+		peer.refuseFileReq(uniqueID, fileName, "the offset to resume from is beyond the end of the file")
+		return
+	}
 	transferFile := TransferFile{
 		filePath:        filePath,
+		fileName:        fileName,
+		folderPath:      folderPath,
 		filePtr:         filePtr,
 		fileSize:        uint64(fileSize),
 		transferredSize: 0,
 		uniqueID:        uniqueID,
+		pieceIndices:    pieceIndices,
+	}
+	if diffType == fileReqResume {
+		log.Println("Resuming sending", filePath, "from offset", offset)
+		_, err = filePtr.Seek(int64(offset), io.SeekStart)
+		if err != nil {
+			filePtr.Close()
+			peer.refuseFileReq(uniqueID, fileName, "the file could not be read from offset "+strconv.FormatUint(offset, 10))
+			return
+		}
+		transferFile.transferredSize = offset
+	}
+	peer.addTransfer(&peer.sendingFiles, transferFile)
+	if diffType == fileReqPieces {
+		go peer.sendPieces(transferFile)
+		return
 	}
-	peer.sendingFiles = append(peer.sendingFiles, transferFile)
 	go peer.sendFile(transferFile)
 }
 
-func (peer *Peer) syncReqHandler(syncReqMsg []byte) {
-	diffType, uniqueID, fileSizes, fileNames, md5Hashes, modTimes := extractSyncReqMsg(syncReqMsg)
+//refuseFileReq tells the peer that its request for fileName will not be answered, so that it does not keep waiting for
+//the file. Peers which cannot read the refusal are only logged about
+func (peer *Peer) refuseFileReq(uniqueID uint32, fileName string, reason string) {
+	log.Println("Refusing request from", peer.username, "for", fileName, "in folder", uniqueID, "-", reason)
+	if !peer.hasCapability(capFileRefuse) {
+		return
+	}
+	peer.sendMessage(encodeMessage(&FileRefuseMsg{FolderID: uniqueID, Name: fileName, Reason: reason}))
+}
+
+//fileRefuseHandler stops receiving a file which the peer refused to send. The progress made so far is kept, so that the
+//transfer can be resumed when the file is requested again
+func (peer *Peer) fileRefuseHandler(fileRefuseMsg *FileRefuseMsg) {
+	uniqueID, fileName := fileRefuseMsg.FolderID, fileRefuseMsg.Name
+	file, receiving := peer.getReceivingFile(uniqueID, fileName)
+	if !receiving {
+		log.Println(peer.username, "refused to send", fileName, "in folder", uniqueID, "which is not being received")
+		return
+	}
+	peer.removeTransfer(&peer.receivingFiles, file.filePath)
+	if file.tempPath != "" {
+		file.saveProgress()
+	}
+	os.Remove(getLockFilePath(file.folderPath, file.getFileName()))
+	peer.publishTransferEvent(eventTransferFailed, "receiving", file, errors.New("refused by "+peer.username+" - "+
+		fileRefuseMsg.Reason))
+}
+
+//pendingIndex is an index whose final chunk has not been received yet, along with the number of entries and the
+//estimated size buffered for it
+type pendingIndex struct {
+	IndexChunkMsg
+	entries int
+	size    int
+}
+
+//appendFiles adds the files in a chunk to the index, joining the parts of files whose piece hashes were split across
+//entries
+func (index *pendingIndex) appendFiles(files []FileEntry) error {
+	for i := range files {
+		if files[i].PieceOffset == 0 {
+			index.Files = append(index.Files, files[i])
+			continue
+		}
+		if len(index.Files) == 0 || index.Files[len(index.Files)-1].Name != files[i].Name ||
+			len(index.Files[len(index.Files)-1].PieceHashes) != int(files[i].PieceOffset) {
+			return errors.New("piece hashes of " + files[i].Name + " from " +
+				strconv.FormatUint(uint64(files[i].PieceOffset), 10) + " do not continue the previous entry")
+		}
+		previousFile := &index.Files[len(index.Files)-1]
+		previousFile.PieceHashes = append(previousFile.PieceHashes, files[i].PieceHashes...)
+	}
+	return nil
+}
+
+//dropPendingIndex discards the chunks of an index received so far
+func (peer *Peer) dropPendingIndex(uniqueID uint32) {
+	if index, exists := peer.pendingIndexes[uniqueID]; exists {
+		peer.pendingIndexEntries -= index.entries
+		peer.pendingIndexSize -= index.size
+		delete(peer.pendingIndexes, uniqueID)
+	}
+}
+
+//dropPendingIndexes discards the chunks of all the indexes being received
+func (peer *Peer) dropPendingIndexes() {
+	peer.pendingIndexes = make(map[uint32]*pendingIndex)
+	peer.pendingIndexEntries, peer.pendingIndexSize = 0, 0
+}
+
+//getIndexChunkSize returns the number of entries in an index chunk and their estimated size. Every chunk counts as an
+//entry, so that even empty chunks are bounded
+func getIndexChunkSize(chunk *IndexChunkMsg) (int, int) {
+	entries := 1 + len(chunk.Files) + len(chunk.Dirs) + len(chunk.Tombstones)
+	size := getIndexEntryLen("", 0, nil)
+	for i := range chunk.Files {
+		size += getIndexEntryLen(chunk.Files[i].Name, len(chunk.Files[i].PieceHashes), chunk.Files[i].Version)
+	}
+	for i := range chunk.Dirs {
+		size += getIndexEntryLen(chunk.Dirs[i], 0, nil)
+	}
+	for i := range chunk.Tombstones {
+		size += getIndexEntryLen(chunk.Tombstones[i].Name, 0, chunk.Tombstones[i].Version)
+	}
+	return entries, size
+}
+
+//indexChunkHandler collects the index_chunk messages announcing a folder, and handles the index once the final chunk
+//has been received. A chunk arriving out of sequence discards the chunks collected so far, and a chunk which takes the
+//indexes being received past the limits of the peer discards all of them
+func (peer *Peer) indexChunkHandler(chunk *IndexChunkMsg) {
+	index, exists := peer.pendingIndexes[chunk.FolderID]
+	if chunk.Sequence == 0 {
+		peer.dropPendingIndex(chunk.FolderID)
+		index = &pendingIndex{IndexChunkMsg: IndexChunkMsg{DiffType: chunk.DiffType, FolderID: chunk.FolderID}}
+	} else if !exists || chunk.Sequence != index.Sequence+1 {
+		peer.dropPendingIndex(chunk.FolderID)
+		peer.flag("index chunk " + strconv.FormatUint(chunk.Sequence, 10) + " of folder " +
+			strconv.FormatInt(int64(chunk.FolderID), 10) + " out of sequence")
+		return
+	}
+	chunkEntries, chunkSize := getIndexChunkSize(chunk)
+	if peer.pendingIndexEntries+chunkEntries > peer.limits.MaxIndexEntries ||
+		peer.pendingIndexSize+chunkSize > peer.limits.MaxIndexSize {
+		peer.dropPendingIndexes()
+		peer.flag("index chunk " + strconv.FormatUint(chunk.Sequence, 10) + " of folder " +
+			strconv.FormatInt(int64(chunk.FolderID), 10) + " beyond the limits on buffered indexes")
+		return
+	}
+	if err := index.appendFiles(chunk.Files); err != nil {
+		peer.dropPendingIndex(chunk.FolderID)
+		peer.flag("index chunk " + strconv.FormatUint(chunk.Sequence, 10) + " of folder " +
+			strconv.FormatInt(int64(chunk.FolderID), 10) + " - " + err.Error())
+		return
+	}
+	index.Sequence = chunk.Sequence
+	index.Dirs = append(index.Dirs, chunk.Dirs...)
+	index.Tombstones = append(index.Tombstones, chunk.Tombstones...)
+	index.entries += chunkEntries
+	index.size += chunkSize
+	peer.pendingIndexes[chunk.FolderID] = index
+	peer.pendingIndexEntries += chunkEntries
+	peer.pendingIndexSize += chunkSize
+	if !chunk.Final {
+		return
+	}
+	peer.dropPendingIndex(chunk.FolderID)
+	peerFiles := []SyncFile{}
+	for i := range index.Files {
+		peerFiles = append(peerFiles, index.Files[i].getSyncFile())
+	}
+	tombstones := []Tombstone{}
+	for i := range index.Tombstones {
+		tombstones = append(tombstones, index.Tombstones[i].getTombstone())
+	}
+	peer.indexHandler(index.DiffType, index.FolderID, peerFiles, index.Dirs, tombstones)
+}
+
+//indexHandler handles the index of a folder announced by the peer once all of its chunks have been received
+func (peer *Peer) indexHandler(diffType byte, uniqueID uint32, peerFiles []SyncFile, dirNames []string, tombstones []Tombstone) {
+	if dirNames == nil {
+		dirNames = []string{}
+	}
 	uniqueIDs := peer.folderManager.getAllUniqueIDs()
 	uniqueIDstring := strconv.FormatInt(int64(uniqueID), 10)
+	err := validatePeerFileNames(peer.folderManager.getFolderPath(uniqueID), peerFiles, dirNames, tombstones)
+	if err != nil {
+		peer.flag("sync request for folder " + uniqueIDstring + " - " + err.Error())
+		return
+	}
 	if goUtils.Pos(uniqueIDs, uniqueIDstring) == -1 {
-		peer.initNewFolderFromPeer(uniqueID, fileNames, md5Hashes, fileSizes)
+		//The offer can wait on the user indefinitely, during which the messages from the peer have to keep being read
+		go peer.initNewFolderFromPeer(uniqueID, peerFiles, dirNames)
 	} else {
 		//sync existing folder here
-		if diffType == 1 {
-			peer.syncExistingFolderFromPeer(uniqueID, fileNames, md5Hashes, fileSizes, modTimes)
-		}
-	}
-}
-
-func (peer Peer) initNewFolderFromPeer(uniqueID uint32, fileNames []string, md5Hashes []string, fileSizes []uint64) {
-	peer.cliController.print(peer.username + " wants to sync a folder with the following details\n" +
-		"uniqueid - " + string(uniqueID) + "\nFiles - " + strings.Join(fileNames, ", ") + "\n" +
-		"MD5 Hashes - " + strings.Join(md5Hashes, ", "))
-	userResponse := peer.cliController.getInput("Do you want to accept this folder?[y/n]")
-	if userResponse == "y" {
-		directory := peer.cliController.getInput("Enter the directory where you want to create this folder")
-		folderName := peer.cliController.getInput("Enter the name of the folder you want to create")
-		peer.folderManager.addPeerFolder(directory, folderName, uniqueID, fileNames)
-		for i := range fileNames {
-			fileReqMsg := getFileReqMsg(int64(uniqueID), fileNames[i], 1)
-			filePath := directory + "/" + folderName + "/" + fileNames[i]
-			filePtr, err := os.OpenFile(filePath, os.O_TRUNC|os.O_WRONLY, 0755)
-			goUtils.HandleErr(err, "While opening file for writing")
-			transferFile := TransferFile{
-				filePath:        filePath,
-				transferredSize: 0,
-				fileSize:        fileSizes[i],
-				filePtr:         filePtr,
-				uniqueID:        uniqueID,
-			}
-			peer.receivingFiles = append(peer.receivingFiles, transferFile)
-			peer.sendMessage(fileReqMsg)
+		if diffType != 1 {
+			return
+		}
+		if !peer.folderManager.isSharedWith(uniqueID, peer.deviceID) {
+			log.Println("Ignoring sync request from", peer.username, "for folder", uniqueIDstring, "which is not shared with it")
+			return
 		}
+		switch peer.folderManager.getFolderMode(uniqueID) {
+		case folderSendOnly:
+			log.Println("Ignoring changes made by", peer.username, "to send-only folder", uniqueIDstring)
+			return
+		case folderReceiveOnly:
+			peer.folderManager.saveRemoteIndex(uniqueID, RemoteIndex{DeviceID: peer.deviceID, Username: peer.username,
+				Files: peerFiles, Dirs: dirNames, Tombstones: tombstones})
+		}
+		peer.syncExistingFolderFromPeer(uniqueID, peerFiles, dirNames, tombstones)
 	}
 }
 
-func (peer Peer) syncExistingFolderFromPeer(uniqueID uint32, fileNames []string, md5Hashes []string, fileSizes []uint64, modTimes []uint32) {
+func (peer *Peer) initNewFolderFromPeer(uniqueID uint32, peerFiles []SyncFile, dirNames []string) {
+	offer := FolderOffer{Username: peer.username, DeviceID: peer.deviceID, UniqueID: uniqueID, Files: []string{},
+		Md5Hashes: []string{}, Dirs: dirNames}
+	for i := range peerFiles {
+		offer.Files = append(offer.Files, peerFiles[i].Name)
+		offer.Md5Hashes = append(offer.Md5Hashes, peerFiles[i].Md5)
+	}
+	events.publish(eventFolderOffered, peer.username+" offered folder "+strconv.FormatInt(int64(uniqueID), 10)+" with "+
+		strconv.Itoa(len(offer.Files))+" files", FolderEventData{FolderID: uniqueID, Username: peer.username,
+		Files: len(offer.Files), Dirs: len(dirNames)})
+	answer := peer.cliController.getFolderOfferAnswer(offer)
+	if !answer.Accepted {
+		return
+	}
+	peer.folderManager.addPeerFolder(answer.Directory, answer.Name, uniqueID, peer.deviceID, offer.Files, dirNames)
+	//The connection over which the folder was offered may have dropped while the offer was pending
+	connectedPeer, connected := peer.folderManager.peermanager.getDevicePeer(peer.deviceID)
+	if !connected {
+		log.Println("Receiving folder", uniqueID, "once", peer.username, "connects again")
+		return
+	}
+	folderPath := filepath.Join(answer.Directory, answer.Name)
+	for i := range peerFiles {
+		connectedPeer.startReceivingFile(uniqueID, folderPath, peerFiles[i], 1)
+	}
+}
+
+func (peer *Peer) syncExistingFolderFromPeer(uniqueID uint32, peerFiles []SyncFile, dirNames []string, tombstones []Tombstone) {
+	fileNames := []string{}
+	for i := range peerFiles {
+		fileNames = append(fileNames, peerFiles[i].Name)
+	}
 	log.Println("Received sync request for folder with details \n" +
-		"uniqueid - " + string(uniqueID) + "\nFiles - " + strings.Join(fileNames, ", ") + "\n")
+		"uniqueid - " + strconv.FormatInt(int64(uniqueID), 10) + "\nFiles - " + strings.Join(fileNames, ", ") + "\n")
 	syncData := peer.folderManager.updateAndGetSyncData(uniqueID)
-	currentMd5Hashes := make(map[string]string)
+	currentFiles := make(map[string]SyncFile)
 	for i := range syncData.Files {
-		currentMd5Hashes[syncData.Files[i].Name] = syncData.Files[i].Md5
+		currentFiles[syncData.Files[i].Name] = syncData.Files[i]
 	}
+	folderPath := peer.folderManager.getFolderPath(uniqueID)
+	peerFiles, dirNames, tombstones = filterIgnored(loadIgnoreMatcher(folderPath), peerFiles, dirNames, tombstones)
 
-	changedFileNames, changedFileSizes, changedModTimes := getChangedFileData(fileNames, md5Hashes, currentMd5Hashes, fileSizes, modTimes)
-	folderPath := peer.folderManager.backupExistingFiles(uniqueID, changedFileNames)
-	for i := range changedFileNames {
-		fileLocked := peer.isFileLocked(folderPath, uniqueID, changedFileNames[i], changedModTimes[i])
+	peer.applyPeerTombstones(uniqueID, syncData, tombstones)
+	changedFiles, mergedFiles := peer.getChangedFileData(peerFiles, currentFiles, syncData.getTombstones(),
+		syncData.Mode == folderReceiveOnly)
+	peer.folderManager.updateIndexedFiles(uniqueID, mergedFiles)
+	createDirs(folderPath, dirNames)
+	for i := range changedFiles {
+		fileLocked := peer.isFileLocked(folderPath, uniqueID, changedFiles[i])
 		if fileLocked {
 			continue
 		}
-		filePath := folderPath + "/" + changedFileNames[i]
-		filePtr, err := os.OpenFile(filePath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0755)
-		fileStat, err := filePtr.Stat()
-		goUtils.HandleErr(err, "While getting file stat for syncing existing folder from peer " + changedFileNames[i])
-		currentModTime := uint32(fileStat.ModTime().UTC().Unix())
-		if currentModTime > changedModTimes[i] {
+		lockFile := getLockFilePath(folderPath, changedFiles[i].Name)
+		err := os.MkdirAll(filepath.Dir(lockFile), 0755)
+		goUtils.HandleErr(err, "While creating parent directory for "+changedFiles[i].Name)
+		lockBytes, _ := json.Marshal(FileLock{ModTime: changedFiles[i].ModTime, Version: changedFiles[i].Version})
+		err = ioutil.WriteFile(lockFile, lockBytes, 0644)
+		goUtils.HandleErr(err, "While creating lock file for "+changedFiles[i].Name)
+		pieceIndices := getChangedPieces(currentFiles[changedFiles[i].Name].PieceHashes, changedFiles[i].PieceHashes)
+		if len(pieceIndices) == 0 || !peer.hasCapability(capDeltaTransfer) {
+			peer.startReceivingFile(uniqueID, folderPath, changedFiles[i], 1)
 			continue
 		}
-		lockFile := folderPath + "/." + changedFileNames[i] + ".lock"
-		lockPtr, err := os.Create(lockFile)
-		goUtils.HandleErr(err, "While creating lock file for "+changedFileNames[i])
-		lockPtr.Write([]byte(strconv.FormatInt(int64(changedModTimes[i]), 10)))
-		lockPtr.Close()
-		fileReqMsg := getFileReqMsg(int64(uniqueID), changedFileNames[i], 1)
-		goUtils.HandleErr(err, "While opening file for writing")
-		transferFile := TransferFile{
-			filePath:        filePath,
-			transferredSize: 0,
-			fileSize:        changedFileSizes[i],
-			filePtr:         filePtr,
-			uniqueID:        uniqueID,
-		}
-		peer.receivingFiles = append(peer.receivingFiles, transferFile)
-		peer.sendMessage(fileReqMsg)
-	}
-}
-
-func getChangedFileData(fileNames []string, md5Hashes []string, currentMd5Hashes map[string]string, fileSizes []uint64, modTimes []uint32) ([]string, []uint64, []uint32) {
-	changedFileNames := []string{}
-	changedFileSizes := []uint64{}
-	changedModTimes := []uint32{}
-	for i := range fileNames {
-		if md5Hashes[i] == currentMd5Hashes[fileNames[i]] {
-			log.Println(fileNames[i], "has not changed, continuing")
+		peer.startReceivingPieces(uniqueID, folderPath, changedFiles[i], pieceIndices)
+	}
+}
+
+//startReceivingFile requests the whole of a file from the peer, receiving it into a temp file under .syncIt. If an
+//earlier transfer of the same version of the file was interrupted, the prefix which was already received is verified
+//against the piece hashes and the file is requested from the end of that prefix
+func (peer *Peer) startReceivingFile(uniqueID uint32, folderPath string, file SyncFile, attempt int) {
+	tempPath := getPartialFilePath(folderPath, file.Name)
+	err := os.MkdirAll(filepath.Dir(tempPath), 0755)
+	goUtils.HandleErr(err, "While creating directory for partial file "+file.Name)
+	offset := uint64(0)
+	progress, err := loadTransferProgress(tempPath)
+	if err == nil && progress.Md5 == file.Md5 && progress.Size == file.Size && peer.hasCapability(capResume) {
+		offset = getVerifiedOffset(tempPath, file.PieceHashes)
+		log.Println("Resuming", file.Name, "from offset", offset, "of", file.Size)
+	}
+	filePtr, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE, 0755)
+	goUtils.HandleErr(err, "While opening partial file for writing")
+	err = filePtr.Truncate(int64(offset))
+	goUtils.HandleErr(err, "While truncating partial file "+file.Name)
+	_, err = filePtr.Seek(int64(offset), io.SeekStart)
+	goUtils.HandleErr(err, "While seeking in partial file "+file.Name)
+	transferFile := TransferFile{
+		filePath:        getLocalPath(folderPath, file.Name),
+		fileName:        file.Name,
+		folderPath:      folderPath,
+		tempPath:        tempPath,
+		transferredSize: offset,
+		fileSize:        file.Size,
+		md5:             file.Md5,
+		filePtr:         filePtr,
+		uniqueID:        uniqueID,
+		modTime:         file.ModTime,
+		attempt:         attempt,
+		version:         file.Version,
+		pieceHashes:     file.PieceHashes,
+	}
+	transferFile.saveProgress()
+	peer.publishTransferEvent(eventTransferStarted, "receiving", transferFile, nil)
+	if offset == file.Size {
+		//Nothing left to receive
+		filePtr.Close()
+		peer.finishReceivingFile(transferFile)
+		return
+	}
+	fileReqMsg := encodeMessage(&FileReqMsg{DiffType: fileReqWhole, FolderID: uniqueID, Name: file.Name})
+	if offset > 0 {
+		fileReqMsg = encodeMessage(&FileReqMsg{DiffType: fileReqResume, FolderID: uniqueID, Name: file.Name, Offset: offset})
+	}
+	peer.addTransfer(&peer.receivingFiles, transferFile)
+	peer.sendMessage(fileReqMsg)
+}
+
+//startReceivingPieces requests only the changed pieces of a file. They are written over a copy of the current file in
+//the same temp file used for whole file transfers, so the file in the folder is untouched until it has been verified
+func (peer *Peer) startReceivingPieces(uniqueID uint32, folderPath string, file SyncFile, pieceIndices []uint32) {
+	filePath := getLocalPath(folderPath, file.Name)
+	tempPath := getPartialFilePath(folderPath, file.Name)
+	err := os.MkdirAll(filepath.Dir(tempPath), 0755)
+	goUtils.HandleErr(err, "While creating directory for partial file "+file.Name)
+	err = copyFile(filePath, tempPath)
+	if err != nil {
+		log.Println("Could not copy", file.Name, "for receiving changed pieces, requesting the whole file", err)
+		peer.startReceivingFile(uniqueID, folderPath, file, 1)
+		return
+	}
+	filePtr, err := os.OpenFile(tempPath, os.O_WRONLY, 0755)
+	goUtils.HandleErr(err, "While opening partial file for writing")
+	err = filePtr.Truncate(int64(file.Size))
+	goUtils.HandleErr(err, "While resizing partial file "+file.Name)
+	fileReqMsg := encodeMessage(&FileReqMsg{DiffType: fileReqPieces, FolderID: uniqueID, Name: file.Name, PieceIndices: pieceIndices})
+	transferFile := TransferFile{
+		filePath:        filePath,
+		fileName:        file.Name,
+		folderPath:      folderPath,
+		tempPath:        tempPath,
+		transferredSize: 0,
+		fileSize:        file.Size,
+		md5:             file.Md5,
+		filePtr:         filePtr,
+		uniqueID:        uniqueID,
+		modTime:         file.ModTime,
+		pieceIndices:    pieceIndices,
+		attempt:         1,
+		version:         file.Version,
+		pieceHashes:     file.PieceHashes,
+	}
+	peer.publishTransferEvent(eventTransferStarted, "receiving", transferFile, nil)
+	peer.addTransfer(&peer.receivingFiles, transferFile)
+	peer.sendMessage(fileReqMsg)
+}
+
+//finishReceivingFile verifies a fully received file against the hash announced by the peer. A verified file replaces the
+//current copy, which is backed up first, while a file which does not match is requested again from scratch
+func (peer *Peer) finishReceivingFile(file TransferFile) {
+	peer.removeTransfer(&peer.receivingFiles, file.filePath)
+	err := file.verify()
+	if err == errHashMismatch && file.attempt < maxReceiveAttempts {
+		peer.publishTransferEvent(eventTransferFailed, "receiving", file, err)
+		peer.startReceivingFile(file.uniqueID, file.folderPath, file.getSyncFile(), file.attempt+1)
+		return
+	}
+	if err == nil {
+		localFile, indexed := peer.folderManager.getIndexedFile(file.uniqueID, file.getFileName())
+		receivedFile := file.getSyncFile()
+		receivedFile.Version = localFile.Version.merge(file.version)
+		if len(file.version) == 0 {
+			//Sent by a peer which does not track version vectors
+			receivedFile.Version = receivedFile.Version.increment(getLocalDeviceID())
+		}
+		if _, statErr := os.Stat(file.filePath); statErr == nil {
+			if indexed && localFile.Md5 != file.md5 && file.version.compare(localFile.Version) == versionConcurrent &&
+				peer.folderManager.getFolderMode(file.uniqueID) != folderReceiveOnly {
+				peer.keepConflictCopy(file)
+			} else {
+				peer.folderManager.backupExistingFiles(file.uniqueID, []string{file.getFileName()})
+			}
+		}
+		err = file.complete()
+		if err == nil {
+			peer.folderManager.updateIndexedFiles(file.uniqueID, []SyncFile{receivedFile})
+		}
+	}
+	goUtils.HandleErr(err, "While moving received file into place "+file.getFileName())
+	os.Remove(getLockFilePath(file.folderPath, file.getFileName()))
+	if err != nil {
+		peer.publishTransferEvent(eventTransferFailed, "receiving", file, err)
+		return
+	}
+	peer.publishTransferEvent(eventTransferFinished, "receiving", file, nil)
+}
+
+//keepConflictCopy renames the local copy of a file which was changed concurrently with the copy received from the
+//peer, so that both versions are kept in the folder
+func (peer *Peer) keepConflictCopy(file TransferFile) {
+	conflictName := getConflictFileName(file.getFileName(), getLocalDeviceID())
+	err := os.Rename(file.filePath, getLocalPath(file.folderPath, conflictName))
+	goUtils.HandleErr(err, "While keeping conflict copy of "+file.getFileName())
+	events.publish(eventConflictDetected, file.getFileName()+" was changed both locally and by "+peer.username+
+		", the local copy has been kept as "+conflictName, ConflictEventData{
+		FolderID:     file.uniqueID,
+		File:         file.getFileName(),
+		Username:     peer.username,
+		ConflictCopy: conflictName,
+	})
+}
+
+//filterIgnored drops the files, directories and deletions announced by a peer which are excluded by the local
+//.syncignore, so that ignored local files are never touched
+func filterIgnored(ignoreMatcher IgnoreMatcher, peerFiles []SyncFile, dirNames []string, tombstones []Tombstone) ([]SyncFile, []string, []Tombstone) {
+	filteredFiles := []SyncFile{}
+	for i := range peerFiles {
+		if !ignoreMatcher.isIgnored(peerFiles[i].Name, false) {
+			filteredFiles = append(filteredFiles, peerFiles[i])
+		}
+	}
+	filteredDirs := []string{}
+	for i := range dirNames {
+		if !ignoreMatcher.isIgnored(dirNames[i], true) {
+			filteredDirs = append(filteredDirs, dirNames[i])
+		}
+	}
+	filteredTombstones := []Tombstone{}
+	for i := range tombstones {
+		if !ignoreMatcher.isIgnored(tombstones[i].Name, false) {
+			filteredTombstones = append(filteredTombstones, tombstones[i])
+		}
+	}
+	return filteredFiles, filteredDirs, filteredTombstones
+}
+
+//getChangedFileData returns the files whose copy on the peer should replace the local one. When both devices track
+//version vectors, a peer's copy is taken if it has seen every local change, or if it wins a conflict with a local copy
+//changed concurrently. Otherwise the more recently modified copy is taken. Also returns the local files whose contents
+//match the peer's copy but whose version vectors differ, with the vectors merged. In receive-only folders the peer's copy
+//always wins a conflict, as the local changes are never sent anyway
+func (peer *Peer) getChangedFileData(peerFiles []SyncFile, currentFiles map[string]SyncFile, tombstones map[string]Tombstone, receiveOnly bool) ([]SyncFile, []SyncFile) {
+	changedFiles := []SyncFile{}
+	mergedFiles := []SyncFile{}
+	useVersions := peer.hasCapability(capVersionVectors)
+	for i := range peerFiles {
+		currentFile, exists := currentFiles[peerFiles[i].Name]
+		if exists && peerFiles[i].Md5 == currentFile.Md5 {
+			if useVersions && currentFile.Version.compare(peerFiles[i].Version) != versionEqual {
+				currentFile.Version = currentFile.Version.merge(peerFiles[i].Version)
+				mergedFiles = append(mergedFiles, currentFile)
+			}
+			log.Println(peerFiles[i].Name, "has not changed, continuing")
+			continue
+		}
+		if exists && !useVersions && currentFile.ModTime > peerFiles[i].ModTime {
+			log.Println(peerFiles[i].Name, "has been modified locally after the peer's copy, continuing")
+			continue
+		}
+		if exists && useVersions {
+			order := compareFileVersions(currentFile, peerFiles[i])
+			if order == versionOlder || order == versionEqual {
+				log.Println(peerFiles[i].Name, "already has all the changes of the peer's copy, continuing")
+				continue
+			}
+			if order == versionConcurrent && !receiveOnly && !peerWinsConflict(currentFile, peerFiles[i], getLocalDeviceID(), peer.deviceID) {
+				log.Println(peerFiles[i].Name, "was changed concurrently by", peer.username, "keeping the local copy")
+				continue
+			}
+		}
+		if tombstone, deleted := tombstones[peerFiles[i].Name]; deleted && compareDeletion(tombstone, peerFiles[i]) == versionNewer {
+			log.Println(peerFiles[i].Name, "was deleted after the last change to the peer's copy, continuing")
 			continue
 		}
-		changedFileNames = append(changedFileNames, fileNames[i])
-		changedFileSizes = append(changedFileSizes, fileSizes[i])
-		changedModTimes = append(changedModTimes, modTimes[i])
-	}
-	return changedFileNames, changedFileSizes, changedModTimes
-}
-
-func (peer Peer) isFileLocked(folderPath string, uniqueID uint32, fileName string, newModTime uint32) bool{
-	lockFile := folderPath + "/." + fileName + ".lock"
-	if _, err := os.Stat(lockFile); !os.IsNotExist(err) {
-		log.Println("Lock file for", fileName, "exists, continuing")
-		timeBytes, err := ioutil.ReadFile(lockFile)
-		goUtils.HandleErr(err, "While reading existing lock file "+lockFile)
-		timeInt, err := strconv.Atoi(string(timeBytes))
-		goUtils.HandleErr(err, "While converting lock file contents to int")
-		currentModTime := uint32(timeInt)
-		if currentModTime > newModTime {
-			peer.folderManager.restoreFile(uniqueID, fileName)
-			log.Println("This file is already being received with a higher mod time")
+		changedFiles = append(changedFiles, peerFiles[i])
+	}
+	return changedFiles, mergedFiles
+}
+
+//applyPeerTombstones removes the local copies of files deleted by the peer. As with changed files, the newer change
+//wins - a local file which was modified after the peer deleted it is kept. The accepted deletions are recorded in the
+//folder config
+func (peer *Peer) applyPeerTombstones(uniqueID uint32, syncData SyncData, tombstones []Tombstone) {
+	currentFiles := make(map[string]SyncFile)
+	for i := range syncData.Files {
+		currentFiles[syncData.Files[i].Name] = syncData.Files[i]
+	}
+	acceptedTombstones := []Tombstone{}
+	deletedFileNames := []string{}
+	for i := range tombstones {
+		currentFile, exists := currentFiles[tombstones[i].Name]
+		if !exists {
+			acceptedTombstones = append(acceptedTombstones, tombstones[i])
+			continue
+		}
+		if compareDeletion(tombstones[i], currentFile) != versionNewer {
+			log.Println(tombstones[i].Name, "was modified without", peer.username, "seeing the change before deleting it, keeping it")
+			continue
+		}
+		log.Println(tombstones[i].Name, "was deleted by", peer.username, "removing it")
+		acceptedTombstones = append(acceptedTombstones, tombstones[i])
+		deletedFileNames = append(deletedFileNames, tombstones[i].Name)
+	}
+	//Deleted files are moved to the backup area rather than being removed outright
+	peer.folderManager.backupExistingFiles(uniqueID, deletedFileNames)
+	peer.folderManager.addTombstones(uniqueID, acceptedTombstones)
+}
+
+//FileLock is written to the lock file of a file while it is being received, recording the version being received
+type FileLock struct {
+	ModTime uint32        `json:"mod_time"`
+	Version VersionVector `json:"version"`
+}
+
+//isFileLocked reports whether a version of file at least as new as the one announced by the peer is already being
+//received. An older transfer of the file is abandoned in favour of the new version. Versions from peers which do not
+//track version vectors are ordered by their mod times instead
+func (peer *Peer) isFileLocked(folderPath string, uniqueID uint32, file SyncFile) bool {
+	lockFile := getLockFilePath(folderPath, file.Name)
+	lockBytes, err := ioutil.ReadFile(lockFile)
+	if os.IsNotExist(err) {
+		return false
+	}
+	log.Println("Lock file for", file.Name, "exists, continuing")
+	fileLock := FileLock{}
+	if err == nil && json.Unmarshal(lockBytes, &fileLock) == nil {
+		locked := fileLock.ModTime > file.ModTime
+		if len(fileLock.Version) > 0 && len(file.Version) > 0 {
+			order := fileLock.Version.compare(file.Version)
+			locked = order == versionNewer || order == versionEqual
+		}
+		if locked {
+			log.Println("A newer version of", file.Name, "is already being received")
 			return true
-		} else {
-			filePath := folderPath + "/" + fileName
-			peer.receivingFiles = peer.receivingFiles.remove(filePath)
-			peer.sendingFiles = peer.sendingFiles.remove(filePath)
 		}
 	}
+	filePath := getLocalPath(folderPath, file.Name)
+	peer.removeTransfer(&peer.receivingFiles, filePath)
+	peer.removeTransfer(&peer.sendingFiles, filePath)
 	return false
 }
 
-func (peer Peer) sendPong() {
-	pongMessage := getPongMsg()
-	peer.Conn.Write(pongMessage)
+func (peer *Peer) sendPong(sentAt uint64) {
+	pongMessage := encodeMessage(&PongMsg{SentAt: sentAt})
+	peer.sendMessage(pongMessage)
 }
 
+//disConnect closes the connection with the peer and stops the transfers with it, handing the peer to the PeerManager
+//to be removed from the connected peers. Only the first call has any effect, however the connection was lost
 func (peer *Peer) disConnect() {
-	fmt.Println(peer.username, " disconnected")
-	peer.Conn.Close()
-	peer.connected = false
-	peer.closeChan <- *peer
-	close(peer.msgChan)
+	peer.disconnectOnce.Do(func() {
+		events.publish(eventPeerDisconnected, peer.username+" disconnected", peer.getPeerEventData())
+		peer.Conn.Close()
+		peer.connected = false
+		peer.transfersMutex.Lock()
+		receivingFiles := append(MultipleTransferFiles{}, peer.receivingFiles...)
+		peer.transfersMutex.Unlock()
+		for i := range receivingFiles {
+			peer.publishTransferEvent(eventTransferFailed, "receiving", receivingFiles[i], errPeerDisconnected)
+		}
+		peer.saveReceivingProgress()
+		peer.dropPendingIndexes()
+		peer.closeChan <- peer
+		close(peer.stopMsgChan)
+	})
 }
 
-func (peer Peer) getIPWithPort() string {
+//saveReceivingProgress persists the progress of all the files being received from the peer, so that their transfers can
+//be resumed once it is connected again
+func (peer *Peer) saveReceivingProgress() {
+	peer.transfersMutex.Lock()
+	defer peer.transfersMutex.Unlock()
+	for i := range peer.receivingFiles {
+		file := peer.receivingFiles[i]
+		file.filePtr.Close()
+		if file.tempPath != "" {
+			file.saveProgress()
+		}
+		os.Remove(getLockFilePath(file.folderPath, file.getFileName()))
+	}
+	peer.receivingFiles = []TransferFile{}
+}
+
+func (peer *Peer) getIPWithPort() string {
 	return peer.Conn.RemoteAddr().String()
 }
 
-func (peer Peer) getIPWithoutPort() string {
+func (peer *Peer) getIPWithoutPort() string {
 	return strings.Split(peer.Conn.RemoteAddr().String(), ":")[0]
 }
 
-func (peer Peer) printReceivingFiles() {
+func (peer *Peer) printReceivingFiles() {
 	allFileNames := peer.getAllRecevingFiles()
 	if len(allFileNames) == 0 {
 		return
@@ -340,7 +1140,7 @@ func (peer Peer) printReceivingFiles() {
 	peer.cliController.print("Files being received from " + peer.username + ":\n" + fileNamesConcatenated)
 }
 
-func (peer Peer) printSendingFiles() {
+func (peer *Peer) printSendingFiles() {
 	allFileNames := peer.getAllSendingFiles()
 	if len(allFileNames) == 0 {
 		return
@@ -349,7 +1149,9 @@ func (peer Peer) printSendingFiles() {
 	peer.cliController.print("Files being sent to " + peer.username + ":\n" + fileNamesConcatenated)
 }
 
-func (peer Peer) getAllRecevingFiles() []string {
+func (peer *Peer) getAllRecevingFiles() []string {
+	peer.transfersMutex.Lock()
+	defer peer.transfersMutex.Unlock()
 	fileNames := []string{}
 	for i := range peer.receivingFiles {
 		fileNames = append(fileNames, peer.receivingFiles[i].filePath)
@@ -357,10 +1159,130 @@ func (peer Peer) getAllRecevingFiles() []string {
 	return fileNames
 }
 
-func (peer Peer) getAllSendingFiles() []string {
+func (peer *Peer) getAllSendingFiles() []string {
+	peer.transfersMutex.Lock()
+	defer peer.transfersMutex.Unlock()
 	fileNames := []string{}
 	for i := range peer.sendingFiles {
 		fileNames = append(fileNames, peer.sendingFiles[i].filePath)
 	}
 	return fileNames
 }
+
+//PeerStatus describes a connected peer and the files being transferred with it
+type PeerStatus struct {
+	Username        string   `json:"username"`
+	DeviceID        string   `json:"device_id"`
+	Address         string   `json:"address"`
+	SoftwareVersion string   `json:"software_version"`
+	ConnectedAt     uint32   `json:"connected_at"`
+	ReceivingFiles  []string `json:"receiving_files"`
+	SendingFiles    []string `json:"sending_files"`
+	RejectedCount   int      `json:"rejected_count"`
+	LastRejection   string   `json:"last_rejection,omitempty"`
+	LastSeen        int64    `json:"last_seen"`
+	RTTMillis       float64  `json:"rtt_ms"`
+}
+
+//getRejections returns the number of requests from the peer which were rejected, and the reason for the last one
+func (peer *Peer) getRejections() (int, string) {
+	peer.flagMutex.Lock()
+	defer peer.flagMutex.Unlock()
+	return peer.rejectedCount, peer.lastRejection
+}
+
+func (peer *Peer) getStatus() PeerStatus {
+	lastSeen, rtt := peer.getKeepaliveStatus()
+	rejectedCount, lastRejection := peer.getRejections()
+	return PeerStatus{
+		Username:        peer.username,
+		DeviceID:        peer.deviceID,
+		Address:         peer.getIPWithPort(),
+		SoftwareVersion: peer.softwareVersion,
+		ConnectedAt:     peer.connectedAt,
+		ReceivingFiles:  peer.getAllRecevingFiles(),
+		SendingFiles:    peer.getAllSendingFiles(),
+		RejectedCount:   rejectedCount,
+		LastRejection:   lastRejection,
+		LastSeen:        lastSeen.Unix(),
+		RTTMillis:       float64(rtt) / float64(time.Millisecond),
+	}
+}
+
+//TransferStatus describes the progress of a file being sent to or received from a peer
+type TransferStatus struct {
+	Username    string `json:"username"`
+	DeviceID    string `json:"device_id"`
+	Direction   string `json:"direction"`
+	FolderID    uint32 `json:"folder_id"`
+	File        string `json:"file"`
+	Size        uint64 `json:"size"`
+	Transferred uint64 `json:"transferred"`
+}
+
+func (peer *Peer) getTransferStatuses() []TransferStatus {
+	peer.transfersMutex.Lock()
+	defer peer.transfersMutex.Unlock()
+	statuses := []TransferStatus{}
+	directions := []string{"receiving", "sending"}
+	for d, files := range []MultipleTransferFiles{peer.receivingFiles, peer.sendingFiles} {
+		for i := range files {
+			statuses = append(statuses, peer.getTransferStatus(directions[d], files[i]))
+		}
+	}
+	return statuses
+}
+
+func (peer *Peer) getTransferStatus(direction string, file TransferFile) TransferStatus {
+	return TransferStatus{
+		Username:    peer.username,
+		DeviceID:    peer.deviceID,
+		Direction:   direction,
+		FolderID:    file.uniqueID,
+		File:        file.getFileName(),
+		Size:        file.getTransferSize(),
+		Transferred: file.transferredSize,
+	}
+}
+
+func (peer *Peer) getPeerEventData() PeerEventData {
+	return PeerEventData{
+		Username:        peer.username,
+		DeviceID:        peer.deviceID,
+		Address:         peer.getIPWithPort(),
+		SoftwareVersion: peer.softwareVersion,
+	}
+}
+
+//publishTransferEvent publishes an event about file, which is being sent to or received from the peer depending on
+//direction. err is the reason for a failed transfer
+func (peer *Peer) publishTransferEvent(eventType string, direction string, file TransferFile, err error) {
+	data := TransferEventData{TransferStatus: peer.getTransferStatus(direction, file)}
+	preposition := map[string]string{"sending": " to ", "receiving": " from "}[direction]
+	verb := map[string]string{"sending": "Sending", "receiving": "Receiving"}[direction]
+	message := ""
+	switch eventType {
+	case eventTransferStarted:
+		message = verb + " " + file.getFileName() + preposition + peer.username
+		if len(file.pieceIndices) > 0 {
+			message = verb + " " + strconv.Itoa(len(file.pieceIndices)) + " changed pieces of " +
+				file.getFileName() + preposition + peer.username
+		}
+	case eventTransferProgress:
+		message = verb + " " + file.getFileName() + preposition + peer.username + " - " +
+			strconv.FormatUint(data.Transferred, 10) + " of " + strconv.FormatUint(data.Size, 10) + " bytes"
+	case eventTransferFinished:
+		message = "Finished " + direction + " " + file.getFileName() + preposition + peer.username
+	case eventTransferFailed:
+		data.Error = err.Error()
+		message = "Error while " + direction + " " + file.getFileName() + preposition + peer.username + " - " + data.Error
+	}
+	events.publish(eventType, message, data)
+}
+
+//publishTransferProgress publishes the progress of file every time another piece of it has been transferred
+func (peer *Peer) publishTransferProgress(direction string, file TransferFile, previousSize uint64) {
+	if file.transferredSize/pieceSize != previousSize/pieceSize {
+		peer.publishTransferEvent(eventTransferProgress, direction, file, nil)
+	}
+}
@@ -2,14 +2,26 @@ package main
 
 import (
 	"encoding/binary"
-	"fmt"
+	"errors"
+	"io"
+	"log"
 	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
+//PeerManager keeps track of the connected peers, keyed by their IP, and of the devices being redialed.
+//connectedPeers and reconnecting are shared between the goroutines accepting connections, handling disconnections and
+//serving commands, and are only accessed with peersMutex held
 type PeerManager struct {
-	closeChan      chan Peer
+	closeChan      chan *Peer
 	connectedPeers map[string]*Peer
+	reconnecting   map[string]bool
+	peersMutex     *sync.Mutex
+	identity       DeviceIdentity
+	limits         PeerLimits
+	username       string
 }
 
 func (peerManager PeerManager) IsConnected(IP string) bool {
@@ -20,56 +32,218 @@ func (peerManager PeerManager) GetAllIPs() []string {
 	return []string{}
 }
 
-func (peerManager PeerManager) addNewPeer(conn *net.TCPConn, currentTimestamp uint32, initiated bool, username string, cliController *CLIController) Peer {
+func (peerManager PeerManager) addNewPeer(conn net.Conn, currentTimestamp uint32, initiated bool, username string, cliController *CLIController) *Peer {
 	if initiated {
+		conn.SetWriteDeadline(time.Now().Add(peerManager.limits.KeepaliveTimeout))
 		conn.Write([]byte{1})
 		currentTimestampBytes := make([]byte, 4)
 		binary.BigEndian.PutUint32(currentTimestampBytes, currentTimestamp)
 		conn.Write(currentTimestampBytes)
 	}
-	usernameBytes := make([]byte, len(username)+2)
-	binary.BigEndian.PutUint16(usernameBytes[0:2], uint16(len(username)))
-	copy(usernameBytes[2:], username)
-	conn.Write(usernameBytes)
-	peerUsernameLenBytes := make([]byte, 2)
-	conn.Read(peerUsernameLenBytes)
-	peerUsernameLen := binary.BigEndian.Uint16(peerUsernameLenBytes)
-	peerUsername := make([]byte, peerUsernameLen)
-	conn.Read(peerUsername)
-	newPeer := Peer{Conn: conn, closeChan: peerManager.closeChan, connected: true, username: string(peerUsername), cliController: cliController}
-	fmt.Println("Connected to ", string(peerUsername))
-	peerAddress := conn.RemoteAddr().String()
-	peerIP := strings.Split(peerAddress, ":")[0]
-	peerManager.connectedPeers[peerIP] = &newPeer
+	result, err := peerManager.handshake(conn, initiated, username, cliController)
+	if err != nil {
+		log.Println("Refusing connection from", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return nil
+	}
+	if initiated {
+		setTrustedDeviceAddress(result.hello.DeviceID, conn.RemoteAddr().String())
+	}
+	newPeer := peerManager.startPeer(result, currentTimestamp, cliController)
+	events.publish(eventPeerConnected, "Connected to "+newPeer.username+" - "+newPeer.deviceID+" running syncIt "+
+		newPeer.softwareVersion, newPeer.getPeerEventData())
+	return newPeer
+}
+
+//startPeer adds the peer connected through a successful handshake to the connected peers, and starts exchanging
+//messages with it by announcing the folders shared with it
+func (peerManager PeerManager) startPeer(result handshakeResult, connectedAt uint32, cliController *CLIController) *Peer {
+	newPeer := &Peer{
+		Conn:            result.conn,
+		closeChan:       peerManager.closeChan,
+		connectedAt:     connectedAt,
+		connected:       true,
+		username:        result.hello.Username,
+		deviceID:        result.hello.DeviceID,
+		softwareVersion: result.hello.SoftwareVersion,
+		protocolVersion: result.protocolVersion,
+		capabilities:    result.capabilities,
+		maxFrameSize:    result.maxFrameSize,
+		limits:          peerManager.limits,
+		cliController:   cliController,
+		folderManager:   FolderManager{peermanager: peerManager, cliController: cliController},
+	}
+	peerIP := strings.Split(result.conn.RemoteAddr().String(), ":")[0]
+	peerManager.peersMutex.Lock()
+	peerManager.connectedPeers[peerIP] = newPeer
+	peerManager.peersMutex.Unlock()
 	newPeer.initPeer()
+	go newPeer.announceSharedFolders()
 	return newPeer
 }
 
-func (peerManager *PeerManager) compareTimestampAndUpdate(conn *net.TCPConn, newTimestamp uint32, IP string) {
+//getConnectedPeers returns the peers which are currently connected
+func (peerManager PeerManager) getConnectedPeers() []*Peer {
+	peerManager.peersMutex.Lock()
+	defer peerManager.peersMutex.Unlock()
+	peers := []*Peer{}
+	for _, peer := range peerManager.connectedPeers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+//getDevicePeer returns the connected peer of a device, if it is connected
+func (peerManager PeerManager) getDevicePeer(deviceID string) (*Peer, bool) {
+	for _, peer := range peerManager.getConnectedPeers() {
+		if peer.deviceID == deviceID {
+			return peer, true
+		}
+	}
+	return nil, false
+}
+
+//removeDisconnectedPeers removes every peer handed over by Peer.disConnect from the connected peers, unless it has
+//already been replaced by a newer connection from the same IP, and starts redialing the devices which are left
+//without a connection
+func (peerManager PeerManager) removeDisconnectedPeers() {
+	for peer := range peerManager.closeChan {
+		removed := false
+		peerManager.peersMutex.Lock()
+		for peerIP, connectedPeer := range peerManager.connectedPeers {
+			if connectedPeer == peer {
+				delete(peerManager.connectedPeers, peerIP)
+				removed = true
+			}
+		}
+		peerManager.peersMutex.Unlock()
+		if removed && !peerManager.isDeviceConnected(peer.deviceID) {
+			go peerManager.reconnect(peer.deviceID, peer.cliController)
+		}
+	}
+}
+
+//handshakeResult holds what was learnt about a peer while connecting to it
+type handshakeResult struct {
+	conn            net.Conn
+	hello           HelloMsg
+	protocolVersion uint32
+	capabilities    map[string]bool
+	maxFrameSize    uint32
+}
+
+//maxHelloLength bounds the hello message read from a peer before it has been accepted
+const maxHelloLength = 65536
+
+//handshake encrypts the connection with a newly connected peer, and then exchanges hello messages with it to agree on
+//the protocol version and capabilities. Unless both sides already trust each other's device, the connection is only
+//accepted once the users on both sides confirm the pairing code. The returned connection is to be used from then on
+func (peerManager PeerManager) handshake(conn net.Conn, initiated bool, username string, cliController *CLIController) (handshakeResult, error) {
+	result := handshakeResult{}
+	//A peer which goes silent during the handshake is given up on like a connected peer which goes silent
+	conn.SetDeadline(time.Now().Add(peerManager.limits.KeepaliveTimeout))
+	defer conn.SetDeadline(time.Time{})
+	secureConn, peerDeviceID, err := peerManager.identity.secureConnection(conn, initiated)
+	if err != nil {
+		return result, err
+	}
+	if bannedTill, banned := getBanExpiry(peerDeviceID); banned {
+		return result, errors.New("device " + peerDeviceID + " is banned till " + bannedTill.Format("15:04:05"))
+	}
+	ownHello := getOwnHello(peerManager.identity, username, peerManager.limits)
+	secureConn.Write(getHelloMsg(ownHello))
+	helloBytes, err := readFrame(secureConn, maxHelloLength)
+	if err == errFrameTooLarge || err == errEmptyFrame {
+		return result, errors.New("peer hello is invalid, the peer may be running an incompatible version")
+	}
+	if err != nil {
+		return result, err
+	}
+	peerHello, err := extractHelloMsg(helloBytes)
+	if err != nil {
+		return result, errors.New("could not read peer hello, the peer may be running an incompatible version")
+	}
+	version, capabilities, err := negotiateHello(ownHello, peerHello, peerDeviceID)
+	if err != nil {
+		return result, err
+	}
+	trusted := []byte{0}
+	if isTrustedDevice(peerDeviceID) {
+		trusted[0] = 1
+	}
+	secureConn.Write(trusted)
+	peerTrusted := make([]byte, 1)
+	_, err = io.ReadFull(secureConn, peerTrusted)
+	if err != nil {
+		return result, err
+	}
+	if trusted[0] != 1 || peerTrusted[0] != 1 {
+		pairingCode, err := getPairingCode(secureConn)
+		if err != nil {
+			return result, err
+		}
+		//Pairing waits on the users of both devices, each of whom has pairingTimeout to answer
+		conn.SetDeadline(time.Now().Add(pairingTimeout + peerManager.limits.KeepaliveTimeout))
+		err = confirmPairing(secureConn, cliController, peerHello.Username, peerDeviceID, pairingCode)
+		if err != nil {
+			return result, err
+		}
+	}
+	//Every peer has to accept frames of at least minMaxFrameSize, and messages are split to fit the frames of the peer
+	maxFrameSize := peerHello.MaxFrameSize
+	if maxFrameSize < minMaxFrameSize {
+		maxFrameSize = minMaxFrameSize
+	}
+	return handshakeResult{
+		conn:            secureConn,
+		hello:           peerHello,
+		protocolVersion: version,
+		capabilities:    capabilities,
+		maxFrameSize:    maxFrameSize,
+	}, nil
+}
+
+func (peerManager *PeerManager) compareTimestampAndUpdate(conn net.Conn, newTimestamp uint32, IP string, username string, cliController *CLIController) {
+	peerManager.peersMutex.Lock()
 	peer, exists := peerManager.connectedPeers[IP]
+	peerManager.peersMutex.Unlock()
 	if !exists {
-		fmt.Println("Peer to update not found", IP)
+		log.Println("Peer to update not found", IP)
+		conn.Close()
 		return
 	}
+	//The timestamps are compared before the handshake, so that the other side is not left with a peer on a connection
+	//which is then dropped
 	if peer.connectedAt < newTimestamp {
-		fmt.Println("current timestamp is older, not updating")
+		log.Println("current timestamp is older, not updating")
+		conn.Close()
 		return
 	}
-	fmt.Println("Updating existing peer")
+	result, err := peerManager.handshake(conn, false, username, cliController)
+	if err != nil || result.hello.DeviceID != peer.deviceID {
+		log.Println("Refusing duplicate connection from", IP, "which could not be authenticated as", peer.deviceID, err)
+		conn.Close()
+		return
+	}
+	log.Println("Updating existing peer")
 	peer.disConnect()
-	peer.Conn = conn
-	peer.connectedAt = newTimestamp
-	go peer.listenForMessages()
+	newPeer := peerManager.startPeer(result, newTimestamp, cliController)
+	events.publish(eventPeerConnected, "Reconnected to "+newPeer.username+" - "+newPeer.deviceID, newPeer.getPeerEventData())
 }
 
-func (peerManager PeerManager) sendToAllPeers(msg []byte) {
-	for _, peer := range peerManager.connectedPeers {
-		peer.sendMessage(msg)
+//sendSyncReqToSharedPeers announces a folder to every connected peer it is shared with, each getting a sync request
+//limited to what it supports
+func (peerManager PeerManager) sendSyncReqToSharedPeers(syncData SyncData) {
+	for _, peer := range peerManager.getConnectedPeers() {
+		if !syncData.isSharedWith(peer.deviceID) {
+			continue
+		}
+		peer.sendSyncReq(syncData)
 	}
 }
 
 func (peerManager PeerManager) printFileTransferStatus() {
-	for _, peer := range peerManager.connectedPeers {
+	for _, peer := range peerManager.getConnectedPeers() {
 		peer.printReceivingFiles()
 		peer.printSendingFiles()
 	}
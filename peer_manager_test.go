@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+//TestMain keeps the tests away from the config of the user, even when goroutines started by a test outlive it
+func TestMain(m *testing.M) {
+	configFolder, err := os.MkdirTemp("", "syncIt-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("SYNCIT_CONFIG_DIR", configFolder)
+	exitCode := m.Run()
+	os.RemoveAll(configFolder)
+	os.Exit(exitCode)
+}
+
+var testLimits = PeerLimits{
+	MaxFrameSize:      defaultMaxFrameSize,
+	MaxRejections:     defaultMaxRejections,
+	BanDuration:       time.Minute,
+	KeepaliveInterval: 100 * time.Millisecond,
+	KeepaliveTimeout:  time.Second,
+	MaxIndexEntries:   defaultMaxIndexEntries,
+	MaxIndexSize:      defaultMaxIndexSize,
+}
+
+//useTestConfigFolder keeps the config written by a test, including the trusted devices, in a temp dir
+func useTestConfigFolder(t *testing.T) {
+	t.Setenv("SYNCIT_CONFIG_DIR", t.TempDir())
+}
+
+func newTestPeerManager(t *testing.T, username string) PeerManager {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return PeerManager{
+		closeChan:      make(chan *Peer, 16),
+		connectedPeers: make(map[string]*Peer),
+		reconnecting:   make(map[string]bool),
+		peersMutex:     &sync.Mutex{},
+		identity:       newDeviceIdentity(privateKey),
+		limits:         testLimits,
+		username:       username,
+	}
+}
+
+//connectOnLoopback connects dialer to listener over a loopback TCP connection in the same way as discovery does,
+//returning the peers on both sides once their handshakes are done
+func connectOnLoopback(t *testing.T, dialer PeerManager, listener PeerManager) (*Peer, *Peer) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+	listenerPeer := make(chan *Peer, 1)
+	go func() {
+		conn, err := tcpListener.Accept()
+		if err != nil {
+			listenerPeer <- nil
+			return
+		}
+		//Discovery reads the byte marking the start of the connection before handing it over
+		conn.Read(make([]byte, 1))
+		handleDiscoveredConnection(listener, conn, "receiver", listener.username, newHeadlessCLIController())
+		peer, _ := listener.getDevicePeer(dialer.identity.deviceID)
+		listenerPeer <- peer
+	}()
+	conn, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialerPeer := dialer.addNewPeer(conn, uint32(time.Now().Unix()), true, dialer.username, newHeadlessCLIController())
+	return dialerPeer, <-listenerPeer
+}
+
+func TestHandshakeBetweenTrustedPeers(t *testing.T) {
+	useTestConfigFolder(t)
+	alice, bob := newTestPeerManager(t, "alice"), newTestPeerManager(t, "bob")
+	addTrustedDevice(alice.identity.deviceID, "alice")
+	addTrustedDevice(bob.identity.deviceID, "bob")
+	alicePeer, bobPeer := connectOnLoopback(t, alice, bob)
+	if alicePeer == nil || bobPeer == nil {
+		t.Fatal("trusted peers did not connect")
+	}
+	defer alicePeer.disConnect()
+	defer bobPeer.disConnect()
+	if alicePeer.deviceID != bob.identity.deviceID || alicePeer.username != "bob" {
+		t.Errorf("alice connected to %s - %s", alicePeer.username, alicePeer.deviceID)
+	}
+	if bobPeer.deviceID != alice.identity.deviceID || bobPeer.username != "alice" {
+		t.Errorf("bob connected to %s - %s", bobPeer.username, bobPeer.deviceID)
+	}
+	if getTrustedDevices()[bob.identity.deviceID].LastAddress == "" {
+		t.Error("address of the dialed device was not recorded")
+	}
+}
+
+func TestTrustedDevicesAreSavedConcurrently(t *testing.T) {
+	useTestConfigFolder(t)
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		waitGroup.Add(1)
+		go func(deviceID string) {
+			defer waitGroup.Done()
+			addTrustedDevice(deviceID, "user")
+			setTrustedDeviceAddress(deviceID, "127.0.0.1:8001")
+		}(strconv.Itoa(i))
+	}
+	waitGroup.Wait()
+	trustedDevices := getTrustedDevices()
+	for i := 0; i < 20; i++ {
+		if trustedDevices[strconv.Itoa(i)].LastAddress != "127.0.0.1:8001" {
+			t.Errorf("device %d was saved as %+v", i, trustedDevices[strconv.Itoa(i)])
+		}
+	}
+}
+
+func TestHandshakeRefusesRejectedPairing(t *testing.T) {
+	useTestConfigFolder(t)
+	alice, bob := newTestPeerManager(t, "alice"), newTestPeerManager(t, "bob")
+	aliceCLI, bobCLI := newHeadlessCLIController(), newHeadlessCLIController()
+	aliceConn, bobConn := getLoopbackConns(t)
+	results := make(chan error, 2)
+	go func() {
+		_, err := alice.handshake(aliceConn, true, "alice", aliceCLI)
+		results <- err
+	}()
+	go func() {
+		_, err := bob.handshake(bobConn, false, "bob", bobCLI)
+		results <- err
+	}()
+	answerPrompt(t, aliceCLI, "y")
+	answerPrompt(t, bobCLI, "n")
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != errUntrustedDevice {
+			t.Errorf("handshake returned %v, want %v", err, errUntrustedDevice)
+		}
+	}
+	if len(getTrustedDevices()) != 0 {
+		t.Error("devices were trusted without both users accepting")
+	}
+}
+
+func TestUnansweredPairingTimesOut(t *testing.T) {
+	useTestConfigFolder(t)
+	defer func(timeout time.Duration) { pairingTimeout = timeout }(pairingTimeout)
+	pairingTimeout = 200 * time.Millisecond
+	alice, bob := newTestPeerManager(t, "alice"), newTestPeerManager(t, "bob")
+	aliceCLI, bobCLI := newHeadlessCLIController(), newHeadlessCLIController()
+	aliceConn, bobConn := getLoopbackConns(t)
+	results := make(chan error, 2)
+	go func() {
+		_, err := alice.handshake(aliceConn, true, "alice", aliceCLI)
+		results <- err
+	}()
+	go func() {
+		_, err := bob.handshake(bobConn, false, "bob", bobCLI)
+		results <- err
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if err != errUntrustedDevice {
+				t.Errorf("handshake returned %v, want %v", err, errUntrustedDevice)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("pairing did not time out")
+		}
+	}
+	if len(aliceCLI.getPendingPrompts()) != 0 || len(bobCLI.getPendingPrompts()) != 0 {
+		t.Error("prompts which timed out are still pending")
+	}
+}
+
+func TestSilentConnectionDoesNotHoldUpHandshakes(t *testing.T) {
+	useTestConfigFolder(t)
+	alice, bob := newTestPeerManager(t, "alice"), newTestPeerManager(t, "bob")
+	addTrustedDevice(alice.identity.deviceID, "alice")
+	addTrustedDevice(bob.identity.deviceID, "bob")
+	silentConn, silentClient := net.Pipe()
+	defer silentClient.Close()
+	silentDone := make(chan bool)
+	go func() {
+		handleDiscoveredConnection(bob, silentConn, "receiver", "bob", newHeadlessCLIController())
+		silentDone <- true
+	}()
+	alicePeer, bobPeer := connectOnLoopback(t, alice, bob)
+	if alicePeer == nil || bobPeer == nil {
+		t.Fatal("peers did not connect while a silent connection was pending")
+	}
+	alicePeer.disConnect()
+	bobPeer.disConnect()
+	select {
+	case <-silentDone:
+	case <-time.After(3 * testLimits.KeepaliveTimeout):
+		t.Fatal("silent connection was not given up on")
+	}
+}
+
+//getLoopbackConns returns both ends of a loopback TCP connection. Unlike net.Pipe, writes are buffered, as both sides
+//of a handshake write before reading
+func getLoopbackConns(t *testing.T) (net.Conn, net.Conn) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+	dialedConn, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptedConn, err := tcpListener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialedConn.Close()
+		acceptedConn.Close()
+	})
+	return dialedConn, acceptedConn
+}
+
+//answerPrompt answers the next prompt raised by a headless CLIController
+func answerPrompt(t *testing.T, cliController *CLIController, answer string) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if prompts := cliController.getPendingPrompts(); len(prompts) > 0 {
+			cliController.answerPrompt(prompts[0].ID, answer)
+			return
+		}
+	}
+	t.Fatal("no prompt was raised")
+}
+
+func TestNewerDuplicateConnectionIsClosedBeforeHandshake(t *testing.T) {
+	useTestConfigFolder(t)
+	alice, bob := newTestPeerManager(t, "alice"), newTestPeerManager(t, "bob")
+	addTrustedDevice(alice.identity.deviceID, "alice")
+	addTrustedDevice(bob.identity.deviceID, "bob")
+	alicePeer, bobPeer := connectOnLoopback(t, alice, bob)
+	if alicePeer == nil || bobPeer == nil {
+		t.Fatal("trusted peers did not connect")
+	}
+	defer alicePeer.disConnect()
+	defer bobPeer.disConnect()
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+	go func() {
+		conn, err := tcpListener.Accept()
+		if err != nil {
+			return
+		}
+		conn.Read(make([]byte, 1))
+		handleDiscoveredConnection(bob, conn, "duplicate_receiver", "bob", newHeadlessCLIController())
+	}()
+	conn, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if alice.addNewPeer(conn, bobPeer.connectedAt+1, true, "alice", newHeadlessCLIController()) != nil {
+		t.Fatal("a newer duplicate connection was accepted")
+	}
+	if time.Since(start) >= testLimits.KeepaliveTimeout {
+		t.Error("the duplicate connection was left open till the handshake timed out")
+	}
+	if peer, _ := bob.getDevicePeer(alice.identity.deviceID); peer != bobPeer {
+		t.Error("the existing peer was replaced")
+	}
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//addTestFolder adds a folder holding the given files, shared with the given devices
+func addTestFolder(t *testing.T, folderManager FolderManager, files map[string][]byte, sharedWith ...string) (uint32, string) {
+	folderPath := t.TempDir()
+	for fileName, data := range files {
+		writeTestFile(t, folderPath, fileName, data)
+	}
+	uniqueID := folderManager.add(folderPath)
+	for _, deviceID := range sharedWith {
+		folderManager.shareFolder(uniqueID, deviceID)
+	}
+	return uniqueID, folderPath
+}
+
+func writeTestFile(t *testing.T, folderPath string, fileName string, data []byte) {
+	filePath := getLocalPath(folderPath, fileName)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestFolderManager(t *testing.T) FolderManager {
+	return FolderManager{peermanager: newTestPeerManager(t, "local"), cliController: newHeadlessCLIController()}
+}
+
+//startTestPeer starts a peer for the device remoteID on one end of a loopback connection, and returns the other end,
+//through which the test plays the remote device. The remote device is not required to send anything to stay connected
+func startTestPeer(t *testing.T, folderManager FolderManager, remoteID string) (*Peer, net.Conn) {
+	limits := testLimits
+	limits.KeepaliveTimeout = 10 * time.Second
+	return startTestPeerWithLimits(t, folderManager, remoteID, limits)
+}
+
+func startTestPeerWithLimits(t *testing.T, folderManager FolderManager, remoteID string, limits PeerLimits) (*Peer, net.Conn) {
+	localConn, remoteConn := getLoopbackConns(t)
+	capabilities := make(map[string]bool)
+	for _, capability := range supportedCapabilities {
+		capabilities[capability] = true
+	}
+	peer := &Peer{
+		Conn:          localConn,
+		closeChan:     make(chan *Peer, 1),
+		connected:     true,
+		username:      remoteID,
+		deviceID:      remoteID,
+		capabilities:  capabilities,
+		maxFrameSize:  defaultMaxFrameSize,
+		limits:        limits,
+		cliController: folderManager.cliController,
+		folderManager: folderManager,
+	}
+	peer.initPeer()
+	t.Cleanup(peer.disConnect)
+	return peer, remoteConn
+}
+
+//readTestMessage returns the next message sent to the remote end of a test peer, skipping keepalives and indexes
+func readTestMessage(t *testing.T, conn net.Conn) interface{} {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		frame, err := readFrame(conn, defaultMaxFrameSize)
+		if err != nil {
+			t.Fatal("no message was received - ", err)
+		}
+		message, err := decodeMessage(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch message.(type) {
+		case *PingMsg, *PongMsg, *IndexChunkMsg:
+			continue
+		}
+		return message
+	}
+}
+
+//readTestFile reads the data of fileName sent whole to the remote end of a test peer, until size bytes have arrived,
+//returning any refusals received along the way
+func readTestFile(t *testing.T, conn net.Conn, fileName string, size int) ([]byte, []*FileRefuseMsg) {
+	data := []byte{}
+	refusals := []*FileRefuseMsg{}
+	for len(data) < size {
+		switch message := readTestMessage(t, conn).(type) {
+		case *FileDataMsg:
+			if message.Name != fileName {
+				t.Fatalf("received data of %s, want %s", message.Name, fileName)
+			}
+			data = append(data, message.Data...)
+		case *FileRefuseMsg:
+			refusals = append(refusals, message)
+		default:
+			t.Fatalf("unexpected message %+v", message)
+		}
+	}
+	return data, refusals
+}
+
+//serveTestFiles answers the next len(files) file requests received by the remote end of a test peer with the whole of
+//the requested file
+func serveTestFiles(t *testing.T, conn net.Conn, files map[string][]byte) {
+	for range files {
+		request, ok := readTestMessage(t, conn).(*FileReqMsg)
+		if !ok {
+			t.Fatalf("received %+v, want a file request", request)
+		}
+		data, exists := files[request.Name]
+		if !exists {
+			t.Fatalf("received a request for %s", request.Name)
+		}
+		sendTestMessage(t, conn, &FileDataMsg{FolderID: request.FolderID, Name: request.Name, Data: data})
+	}
+}
+
+//waitForTestFile waits until the file fileName in folderPath holds data
+func waitForTestFile(t *testing.T, folderPath string, fileName string, data []byte) {
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if fileData, err := os.ReadFile(getLocalPath(folderPath, fileName)); err == nil && bytes.Equal(fileData, data) {
+			return
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%s does not hold %q", fileName, data)
+		}
+	}
+}
+
+func sendTestMessage(t *testing.T, conn net.Conn, message interface{}) {
+	if _, err := conn.Write(encodeMessage(message)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileIsSentToSeveralPeersAtOnce(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	data := bytes.Repeat([]byte("syncIt"), 200000)
+	uniqueID, _ := addTestFolder(t, folderManager, map[string][]byte{"a.txt": data}, "remote1", "remote2")
+	_, firstConn := startTestPeer(t, folderManager, "remote1")
+	_, secondConn := startTestPeer(t, folderManager, "remote2")
+	request := &FileReqMsg{DiffType: fileReqWhole, FolderID: uniqueID, Name: "a.txt"}
+	sendTestMessage(t, firstConn, request)
+	sendTestMessage(t, secondConn, request)
+	for _, conn := range []net.Conn{firstConn, secondConn} {
+		received, refusals := readTestFile(t, conn, "a.txt", len(data))
+		if len(refusals) != 0 || !bytes.Equal(received, data) {
+			t.Errorf("received %d bytes and refusals %+v, want the %d bytes of the file", len(received), refusals, len(data))
+		}
+	}
+}
+
+func TestRepeatedFileRequestIsRefused(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	data := bytes.Repeat([]byte("syncIt"), 1000000)
+	uniqueID, folderPath := addTestFolder(t, folderManager, map[string][]byte{"a.txt": data}, "remote")
+	_, conn := startTestPeer(t, folderManager, "remote")
+	request := &FileReqMsg{DiffType: fileReqWhole, FolderID: uniqueID, Name: "a.txt"}
+	sendTestMessage(t, conn, request)
+	sendTestMessage(t, conn, request)
+	received, refusals := readTestFile(t, conn, "a.txt", len(data))
+	if !bytes.Equal(received, data) {
+		t.Errorf("received %d bytes, want the %d bytes of the file", len(received), len(data))
+	}
+	if len(refusals) != 1 || refusals[0].Name != "a.txt" || refusals[0].FolderID != uniqueID {
+		t.Errorf("received refusals %+v, want one for a.txt", refusals)
+	}
+	//Once the first transfer is done, the file can be requested again
+	sendTestMessage(t, conn, request)
+	if received, refusals = readTestFile(t, conn, "a.txt", len(data)); len(refusals) != 0 {
+		t.Errorf("file was refused after its transfer finished - %+v", refusals)
+	}
+	if _, err := os.Stat(filepath.Join(folderPath, ".syncIt", "locks", "sending")); !os.IsNotExist(err) {
+		t.Error("lock files were written for sending")
+	}
+}
+
+func TestRefusedFileIsNoLongerReceived(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	uniqueID, folderPath := addTestFolder(t, folderManager, map[string][]byte{}, "remote")
+	peer, conn := startTestPeer(t, folderManager, "remote")
+	file := SyncFile{Name: "a.txt", Size: 10, Md5: "md5"}
+	peer.startReceivingFile(uniqueID, folderPath, file, 1)
+	request, ok := readTestMessage(t, conn).(*FileReqMsg)
+	if !ok || request.Name != "a.txt" {
+		t.Fatalf("received %+v, want a request for a.txt", request)
+	}
+	sendTestMessage(t, conn, &FileRefuseMsg{FolderID: uniqueID, Name: "a.txt", Reason: "test"})
+	for start := time.Now(); len(peer.getAllRecevingFiles()) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("refused file is still being received")
+		}
+	}
+	if _, err := os.Stat(getLockFilePath(folderPath, "a.txt")); !os.IsNotExist(err) {
+		t.Error("lock file of the refused file was left behind")
+	}
+}
+
+func TestRequestForDeletedFileIsRefused(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	uniqueID, folderPath := addTestFolder(t, folderManager, map[string][]byte{"a.txt": []byte("data")}, "remote")
+	os.Remove(getLocalPath(folderPath, "a.txt"))
+	_, conn := startTestPeer(t, folderManager, "remote")
+	sendTestMessage(t, conn, &FileReqMsg{DiffType: fileReqWhole, FolderID: uniqueID, Name: "a.txt"})
+	if refusal, ok := readTestMessage(t, conn).(*FileRefuseMsg); !ok || refusal.Name != "a.txt" {
+		t.Fatalf("received %+v, want a refusal for a.txt", refusal)
+	}
+}
+
+func TestFlagWhileStatusIsRead(t *testing.T) {
+	useTestConfigFolder(t)
+	peer, _ := startTestPeer(t, newTestFolderManager(t), "remote")
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 5; i++ {
+			peer.flag("test")
+		}
+		done <- true
+	}()
+	for i := 0; i < 5; i++ {
+		peer.getStatus()
+	}
+	<-done
+	if status := peer.getStatus(); status.RejectedCount != 5 || status.LastRejection != "test" {
+		t.Errorf("status has %d rejections, the last being %q", status.RejectedCount, status.LastRejection)
+	}
+}
+
+func TestPeerIsKeptWhileMessageIsHandled(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	uniqueID, _ := addTestFolder(t, folderManager, map[string][]byte{"a.txt": []byte("data")}, "remote")
+	peer, conn := startTestPeerWithLimits(t, folderManager, "remote", testLimits)
+	//Holding the transfers makes the request below take longer than the keepalive timeout to handle, as a large index
+	//does when the folder is hashed again. Pings from the remote device pile up unread meanwhile
+	func() {
+		peer.transfersMutex.Lock()
+		defer peer.transfersMutex.Unlock()
+		sendTestMessage(t, conn, &FileReqMsg{DiffType: fileReqWhole, FolderID: uniqueID, Name: "a.txt"})
+		for start := time.Now(); time.Since(start) < 3*testLimits.KeepaliveTimeout; time.Sleep(testLimits.KeepaliveInterval) {
+			sendTestMessage(t, conn, &PingMsg{})
+		}
+	}()
+	if data, ok := readTestMessage(t, conn).(*FileDataMsg); !ok || string(data.Data) != "data" {
+		t.Fatalf("received %+v, want the data of a.txt", data)
+	}
+}
+
+func TestPeerTombstones(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	uniqueID, folderPath := addTestFolder(t, folderManager, map[string][]byte{
+		"deleted.txt":  []byte("data"),
+		"modified.txt": []byte("data"),
+	}, "remote")
+	peer, _ := startTestPeer(t, folderManager, "remote")
+	tombstones := []Tombstone{}
+	for _, fileName := range []string{"deleted.txt", "modified.txt", "unknown.txt"} {
+		file, _ := folderManager.getIndexedFile(uniqueID, fileName)
+		tombstones = append(tombstones, Tombstone{Name: fileName, Md5: file.Md5, Version: file.Version.increment("remote")})
+	}
+	//The deletion of modified.txt is concurrent with this local change
+	writeTestFile(t, folderPath, "modified.txt", []byte("local change"))
+	peer.indexHandler(1, uniqueID, []SyncFile{}, nil, tombstones)
+	if _, err := os.Stat(getLocalPath(folderPath, "deleted.txt")); !os.IsNotExist(err) {
+		t.Error("deleted.txt was not deleted")
+	}
+	if versions := folderManager.getFileVersions(uniqueID, "deleted.txt"); len(versions) != 1 {
+		t.Errorf("%d versions of deleted.txt were archived, want 1", len(versions))
+	}
+	if data, err := os.ReadFile(getLocalPath(folderPath, "modified.txt")); err != nil || string(data) != "local change" {
+		t.Errorf("modified.txt holds %q - %v", data, err)
+	}
+	syncData := folderManager.updateAndGetSyncData(uniqueID)
+	kept := syncData.getTombstones()
+	for _, fileName := range []string{"deleted.txt", "unknown.txt"} {
+		if _, exists := kept[fileName]; !exists {
+			t.Errorf("deletion of %s was not recorded", fileName)
+		}
+	}
+	if _, exists := kept["modified.txt"]; exists {
+		t.Error("deletion of modified.txt was recorded")
+	}
+	if _, indexed := folderManager.getIndexedFile(uniqueID, "deleted.txt"); indexed {
+		t.Error("deleted.txt is still indexed")
+	}
+}
+
+func TestLocalDeletionIsRecorded(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	uniqueID, folderPath := addTestFolder(t, folderManager, map[string][]byte{"a.txt": []byte("data")})
+	file, _ := folderManager.getIndexedFile(uniqueID, "a.txt")
+	os.Remove(getLocalPath(folderPath, "a.txt"))
+	tombstone, exists := folderManager.updateAndGetSyncData(uniqueID).getTombstones()["a.txt"]
+	if !exists || tombstone.Md5 != file.Md5 || tombstone.Version.compare(file.Version) != versionNewer {
+		t.Fatalf("deletion of a.txt was recorded as %+v, want a tombstone newer than %+v", tombstone, file)
+	}
+	//A file created again continues from the version of its deletion
+	writeTestFile(t, folderPath, "a.txt", []byte("data"))
+	syncData := folderManager.updateAndGetSyncData(uniqueID)
+	if _, exists := syncData.getTombstones()["a.txt"]; exists {
+		t.Error("tombstone of a.txt was kept after it was created again")
+	}
+	if recreated, _ := folderManager.getIndexedFile(uniqueID, "a.txt"); recreated.Version.compare(tombstone.Version) != versionNewer {
+		t.Errorf("a.txt was created again with version %v, want one newer than %v", recreated.Version, tombstone.Version)
+	}
+}
+
+//getTestPieces returns data made of count pieces, the last of which is half full, and a copy with the piece at
+//changedIndex changed
+func getTestPieces(count int, changedIndex int) ([]byte, []byte) {
+	data := []byte{}
+	for i := 0; i < count; i++ {
+		piece := bytes.Repeat([]byte{byte('a' + i)}, pieceSize)
+		if i == count-1 {
+			piece = piece[:pieceSize/2]
+		}
+		data = append(data, piece...)
+	}
+	changedData := append([]byte{}, data...)
+	copy(changedData[changedIndex*pieceSize:], bytes.Repeat([]byte("z"), pieceSize))
+	return data, changedData
+}
+
+func TestChangedPiecesAreReceived(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	data, changedData := getTestPieces(4, 1)
+	uniqueID, folderPath := addTestFolder(t, folderManager, map[string][]byte{"a.txt": data}, "remote")
+	//The index of the changed file is taken from a copy of it in another directory
+	otherPath := t.TempDir()
+	writeTestFile(t, otherPath, "a.txt", changedData)
+	otherFiles, _ := indexFolder(otherPath, nil)
+	localFile, _ := folderManager.getIndexedFile(uniqueID, "a.txt")
+	changedFile := otherFiles[0]
+	changedFile.Version = localFile.Version.increment("remote")
+	peer, conn := startTestPeer(t, folderManager, "remote")
+	peer.indexHandler(1, uniqueID, []SyncFile{changedFile}, nil, nil)
+	request, ok := readTestMessage(t, conn).(*FileReqMsg)
+	if !ok || request.DiffType != fileReqPieces || !reflect.DeepEqual(request.PieceIndices, []uint32{1}) {
+		t.Fatalf("received %+v, want a request for piece 1 of a.txt", request)
+	}
+	for offset := pieceSize; offset < 2*pieceSize; offset += 4096 {
+		sendTestMessage(t, conn, &PieceDataMsg{FolderID: uniqueID, Name: "a.txt", Offset: uint64(offset),
+			Data: changedData[offset : offset+4096]})
+	}
+	waitForTestFile(t, folderPath, "a.txt", changedData)
+	if indexedFile, _ := folderManager.getIndexedFile(uniqueID, "a.txt"); indexedFile.Md5 != changedFile.Md5 {
+		t.Errorf("a.txt is indexed with md5 %s, want %s", indexedFile.Md5, changedFile.Md5)
+	}
+}
+
+func TestRequestedPiecesAreSent(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	data, _ := getTestPieces(4, 0)
+	uniqueID, _ := addTestFolder(t, folderManager, map[string][]byte{"a.txt": data}, "remote")
+	_, conn := startTestPeer(t, folderManager, "remote")
+	sendTestMessage(t, conn, &FileReqMsg{DiffType: fileReqPieces, FolderID: uniqueID, Name: "a.txt", PieceIndices: []uint32{1, 3}})
+	received := make([]byte, len(data))
+	receivedSize := 0
+	for receivedSize < pieceSize+pieceSize/2 {
+		piece, ok := readTestMessage(t, conn).(*PieceDataMsg)
+		if !ok || piece.Name != "a.txt" {
+			t.Fatalf("received %+v, want a piece of a.txt", piece)
+		}
+		if piece.Offset < pieceSize || (piece.Offset >= 2*pieceSize && piece.Offset < 3*pieceSize) {
+			t.Fatalf("received data at offset %d, which is outside the requested pieces", piece.Offset)
+		}
+		receivedSize += copy(received[piece.Offset:], piece.Data)
+	}
+	for _, pieceIndex := range []int{1, 3} {
+		start, end := pieceIndex*pieceSize, (pieceIndex+1)*pieceSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if !bytes.Equal(received[start:end], data[start:end]) {
+			t.Errorf("piece %d was received with different data", pieceIndex)
+		}
+	}
+}
+
+//waitForNoTransfers waits until the peer is no longer receiving any file
+func waitForNoTransfers(t *testing.T, peer *Peer) {
+	for start := time.Now(); len(peer.getAllRecevingFiles()) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("file is still being received")
+		}
+	}
+}
+
+func sendTestFileData(t *testing.T, conn net.Conn, uniqueID uint32, fileName string, data []byte) {
+	for start := 0; start < len(data); start += 65536 {
+		end := start + 65536
+		if end > len(data) {
+			end = len(data)
+		}
+		sendTestMessage(t, conn, &FileDataMsg{FolderID: uniqueID, Name: fileName, Data: data[start:end]})
+	}
+}
+
+func TestInterruptedTransferIsResumed(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	data, _ := getTestPieces(4, 0)
+	otherPath := t.TempDir()
+	writeTestFile(t, otherPath, "a.txt", data)
+	otherFiles, _ := indexFolder(otherPath, nil)
+	uniqueID, folderPath := addTestFolder(t, folderManager, map[string][]byte{}, "remote")
+	peer, conn := startTestPeer(t, folderManager, "remote")
+	peer.startReceivingFile(uniqueID, folderPath, otherFiles[0], 1)
+	if request, ok := readTestMessage(t, conn).(*FileReqMsg); !ok || request.DiffType != fileReqWhole {
+		t.Fatalf("received %+v, want a request for the whole of a.txt", request)
+	}
+	//The transfer is interrupted half way through the third piece, and the second piece is corrupted meanwhile
+	sendTestFileData(t, conn, uniqueID, "a.txt", data[:2*pieceSize+pieceSize/2])
+	sendTestMessage(t, conn, &FileRefuseMsg{FolderID: uniqueID, Name: "a.txt", Reason: "test"})
+	waitForNoTransfers(t, peer)
+	tempPath := getPartialFilePath(folderPath, "a.txt")
+	tempFile, err := os.OpenFile(tempPath, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempFile.WriteAt([]byte("corrupted"), pieceSize+10)
+	tempFile.Close()
+	peer.startReceivingFile(uniqueID, folderPath, otherFiles[0], 1)
+	request, ok := readTestMessage(t, conn).(*FileReqMsg)
+	if !ok || request.DiffType != fileReqResume || request.Offset != pieceSize {
+		t.Fatalf("received %+v, want a request to resume a.txt from the end of the first piece", request)
+	}
+	sendTestFileData(t, conn, uniqueID, "a.txt", data[pieceSize:])
+	waitForTestFile(t, folderPath, "a.txt", data)
+	if _, err := os.Stat(tempPath + ".progress"); !os.IsNotExist(err) {
+		t.Error("progress of a.txt was left behind")
+	}
+}
+
+func TestTransferIsResumedFromOffset(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	data := bytes.Repeat([]byte("syncIt"), 100000)
+	uniqueID, _ := addTestFolder(t, folderManager, map[string][]byte{"a.txt": data}, "remote")
+	peer, conn := startTestPeer(t, folderManager, "remote")
+	offset := len(data) - 1000
+	sendTestMessage(t, conn, &FileReqMsg{DiffType: fileReqResume, FolderID: uniqueID, Name: "a.txt", Offset: uint64(offset)})
+	if received, refusals := readTestFile(t, conn, "a.txt", len(data)-offset); len(refusals) != 0 ||
+		!bytes.Equal(received, data[offset:]) {
+		t.Errorf("received %d bytes and refusals %+v, want the last %d bytes of the file", len(received), refusals,
+			len(data)-offset)
+	}
+	//An offset past the end of the file is refused rather than sending nothing
+	sendTestMessage(t, conn, &FileReqMsg{DiffType: fileReqResume, FolderID: uniqueID, Name: "a.txt", Offset: uint64(len(data) + 1)})
+	if refusal, ok := readTestMessage(t, conn).(*FileRefuseMsg); !ok || refusal.Name != "a.txt" {
+		t.Fatalf("received %+v, want a refusal for a.txt", refusal)
+	}
+	if status := peer.getStatus(); status.RejectedCount != 1 {
+		t.Errorf("peer was flagged %d times, want once", status.RejectedCount)
+	}
+}
+
+func TestReceivedFileIsVerified(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	otherPath := t.TempDir()
+	writeTestFile(t, otherPath, "a.txt", []byte("new data"))
+	otherFiles, _ := indexFolder(otherPath, nil)
+	uniqueID, folderPath := addTestFolder(t, folderManager, map[string][]byte{"a.txt": []byte("old data")}, "remote")
+	peer, conn := startTestPeer(t, folderManager, "remote")
+	peer.startReceivingFile(uniqueID, folderPath, otherFiles[0], 1)
+	//A copy which does not match the announced hash is discarded and the file is requested again
+	for _, data := range []string{"bad data", "new data"} {
+		if request, ok := readTestMessage(t, conn).(*FileReqMsg); !ok || request.DiffType != fileReqWhole {
+			t.Fatalf("received %+v, want a request for the whole of a.txt", request)
+		}
+		sendTestMessage(t, conn, &FileDataMsg{FolderID: uniqueID, Name: "a.txt", Data: []byte(data)})
+		if data == "bad data" {
+			waitForTestFile(t, folderPath, "a.txt", []byte("old data"))
+		}
+	}
+	waitForTestFile(t, folderPath, "a.txt", []byte("new data"))
+	if versions := folderManager.getFileVersions(uniqueID, "a.txt"); len(versions) != 1 {
+		t.Errorf("%d versions of a.txt were archived, want 1", len(versions))
+	}
+}
+
+func TestFileIsKeptWhenVerificationFails(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	uniqueID, folderPath := addTestFolder(t, folderManager, map[string][]byte{"a.txt": []byte("old data")}, "remote")
+	peer, conn := startTestPeer(t, folderManager, "remote")
+	localFile, _ := folderManager.getIndexedFile(uniqueID, "a.txt")
+	peerFile := SyncFile{Name: "a.txt", Md5: "md5", Size: 8, Version: localFile.Version.increment("remote")}
+	peer.indexHandler(1, uniqueID, []SyncFile{peerFile}, nil, nil)
+	if _, err := os.Stat(getLockFilePath(folderPath, "a.txt")); err != nil {
+		t.Fatal("a.txt was not locked while it is received - ", err)
+	}
+	for attempt := 1; attempt <= maxReceiveAttempts; attempt++ {
+		if request, ok := readTestMessage(t, conn).(*FileReqMsg); !ok || request.Name != "a.txt" {
+			t.Fatalf("received %+v on attempt %d, want a request for a.txt", request, attempt)
+		}
+		sendTestMessage(t, conn, &FileDataMsg{FolderID: uniqueID, Name: "a.txt", Data: []byte("bad data")})
+	}
+	//The lock file is removed last
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(getLockFilePath(folderPath, "a.txt")); os.IsNotExist(err) {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("a.txt is still locked")
+		}
+	}
+	waitForNoTransfers(t, peer)
+	tempPath := getPartialFilePath(folderPath, "a.txt")
+	for _, path := range []string{tempPath, tempPath + ".progress"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind", path)
+		}
+	}
+	if data, err := os.ReadFile(getLocalPath(folderPath, "a.txt")); err != nil || string(data) != "old data" {
+		t.Errorf("a.txt holds %q - %v", data, err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+)
+
+//This file is the schema of the messages exchanged with peers after the handshake. Every message is a struct
+//registered in messageSchema under the byte identifying its type, and every field sent on the wire carries its tag in a
+//wire struct tag. Tags are never reused - a field which is dropped leaves its tag unused, and new fields get new tags,
+//which older peers skip. message.go encodes and decodes the messages from these definitions
+
+//Types of messages. Type 2 was the sync_req message which announced a whole folder at once, replaced by index_chunk
+const (
+	msgPing       byte = 0
+	msgPong       byte = 1
+	msgFileReq    byte = 3
+	msgFileData   byte = 4
+	msgPieceData  byte = 5
+	msgIndexChunk byte = 6
+	msgFileRefuse byte = 7
+)
+
+//Kinds of file requests
+const (
+	fileReqWhole  byte = 1
+	fileReqPieces byte = 2
+	fileReqResume byte = 3
+)
+
+//maxIndexChunkLength is roughly how large each index_chunk message is allowed to grow before the rest of the index is
+//sent in the next chunk
+const maxIndexChunkLength = 256 * 1024
+
+//PingMsg is sent every keepalive interval. SentAt is when it was sent, in nanoseconds on the clock of the sender
+type PingMsg struct {
+	SentAt uint64 `wire:"1"`
+}
+
+//PongMsg answers a ping, echoing its SentAt so that the sender of the ping can measure the round trip time
+type PongMsg struct {
+	SentAt uint64 `wire:"1"`
+}
+
+//FileReqMsg asks the peer to send a file. PieceIndices lists the pieces wanted by a fileReqPieces request, and Offset
+//is where a fileReqResume request picks up from
+type FileReqMsg struct {
+	DiffType     byte     `wire:"1"`
+	FolderID     uint32   `wire:"2"`
+	Name         string   `wire:"3"`
+	PieceIndices []uint32 `wire:"4"`
+	Offset       uint64   `wire:"5"`
+}
+
+//FileDataMsg carries the next chunk of a file being sent whole
+type FileDataMsg struct {
+	FolderID uint32 `wire:"1"`
+	Name     string `wire:"2"`
+	Data     []byte `wire:"3"`
+}
+
+//PieceDataMsg carries a chunk of a file to be written at Offset
+type PieceDataMsg struct {
+	FolderID uint32 `wire:"1"`
+	Name     string `wire:"2"`
+	Offset   uint64 `wire:"3"`
+	Data     []byte `wire:"4"`
+}
+
+//FileRefuseMsg tells the peer that its request for a file will not be answered, so that it stops waiting for the file.
+//It is only sent to peers which declare the file_refuse capability
+type FileRefuseMsg struct {
+	FolderID uint32 `wire:"1"`
+	Name     string `wire:"2"`
+	Reason   string `wire:"3"`
+}
+
+//IndexChunkMsg is one of the messages which together announce the contents of a folder. Chunks are numbered from 0,
+//and the last one is marked as final
+type IndexChunkMsg struct {
+	DiffType   byte             `wire:"1"`
+	FolderID   uint32           `wire:"2"`
+	Sequence   uint64           `wire:"3"`
+	Final      bool             `wire:"4"`
+	Files      []FileEntry      `wire:"5"`
+	Dirs       []string         `wire:"6"`
+	Tombstones []TombstoneEntry `wire:"7"`
+}
+
+//FileEntry is a file in an index_chunk. A file with more piece hashes than fit in a chunk is announced in parts - the
+//first part carries the details of the file, and every following part only its name and the next piece hashes, starting
+//at PieceOffset
+type FileEntry struct {
+	Name        string        `wire:"1"`
+	Size        uint64        `wire:"2"`
+	Md5         string        `wire:"3"`
+	ModTime     uint32        `wire:"4"`
+	PieceHashes []string      `wire:"5"`
+	Version     VersionVector `wire:"6"`
+	PieceOffset uint32        `wire:"7"`
+}
+
+//TombstoneEntry is a deleted file in an index_chunk
+type TombstoneEntry struct {
+	Name      string        `wire:"1"`
+	Md5       string        `wire:"2"`
+	DeletedAt uint32        `wire:"3"`
+	Version   VersionVector `wire:"4"`
+}
+
+//messageSchema maps the type of every message to its name and the struct it is decoded into
+var messageSchema = map[byte]struct {
+	name    string
+	msgType reflect.Type
+}{
+	msgPing:       {"ping", reflect.TypeOf(PingMsg{})},
+	msgPong:       {"pong", reflect.TypeOf(PongMsg{})},
+	msgFileReq:    {"file_req", reflect.TypeOf(FileReqMsg{})},
+	msgFileData:   {"file_data", reflect.TypeOf(FileDataMsg{})},
+	msgPieceData:  {"piece_data", reflect.TypeOf(PieceDataMsg{})},
+	msgIndexChunk: {"index_chunk", reflect.TypeOf(IndexChunkMsg{})},
+	msgFileRefuse: {"file_refuse", reflect.TypeOf(FileRefuseMsg{})},
+}
+
+func getFileEntry(file SyncFile) FileEntry {
+	return FileEntry{
+		Name:        file.Name,
+		Size:        file.Size,
+		Md5:         file.Md5,
+		ModTime:     file.ModTime,
+		PieceHashes: file.PieceHashes,
+		Version:     file.Version,
+	}
+}
+
+func (entry FileEntry) getSyncFile() SyncFile {
+	file := SyncFile{
+		Name:        entry.Name,
+		Size:        entry.Size,
+		Md5:         entry.Md5,
+		ModTime:     entry.ModTime,
+		PieceHashes: entry.PieceHashes,
+		PieceCount:  uint32(len(entry.PieceHashes)),
+		Version:     entry.Version,
+	}
+	if file.PieceHashes == nil {
+		file.PieceHashes = []string{}
+	}
+	if file.Version == nil {
+		file.Version = VersionVector{}
+	}
+	return file
+}
+
+func getTombstoneEntry(tombstone Tombstone) TombstoneEntry {
+	return TombstoneEntry{
+		Name:      tombstone.Name,
+		Md5:       tombstone.Md5,
+		DeletedAt: tombstone.DeletedAt,
+		Version:   tombstone.Version,
+	}
+}
+
+func (entry TombstoneEntry) getTombstone() Tombstone {
+	return Tombstone{
+		Name:      entry.Name,
+		Md5:       entry.Md5,
+		DeletedAt: entry.DeletedAt,
+		Version:   entry.Version,
+	}
+}
+
+//getIndexEntryLen estimates how many bytes an entry of the index takes up in an index_chunk message at most, to decide
+//when to start the next chunk
+func getIndexEntryLen(name string, numPieces int, version VersionVector) int {
+	entryLen := len(name) + 32 + 8*binary.MaxVarintLen64 + numPieces*(40+2*binary.MaxVarintLen64)
+	for deviceID := range version {
+		entryLen += len(deviceID) + 6*binary.MaxVarintLen64
+	}
+	return entryLen
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+//Bounds of the delay between attempts to redial a device whose connection dropped. The delay doubles with every failed
+//attempt, up to reconnectMaxBackoff. These are variables so that tests can redial without waiting
+var (
+	reconnectMinBackoff  = time.Second
+	reconnectMaxBackoff  = 5 * time.Minute
+	reconnectDialTimeout = 10 * time.Second
+)
+
+//getReconnectBackoff returns how long to wait before the given attempt to redial a device, counting from 0. The delay
+//is picked at random from the upper half of the exponential backoff, so that devices which dropped together do not
+//keep redialing in step
+func getReconnectBackoff(attempt int) time.Duration {
+	backoff := reconnectMaxBackoff
+	if attempt < 16 && reconnectMinBackoff<<uint(attempt) < reconnectMaxBackoff {
+		backoff = reconnectMinBackoff << uint(attempt)
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+//reconnect redials a trusted device whose connection dropped at the address it was last dialed at, with exponential
+//backoff, till it is connected again either by this or by discovery. Devices which were only ever connected by dialing
+//this one are not redialed, as their listening address is not known - they redial this one instead
+func (peerManager PeerManager) reconnect(deviceID string, cliController *CLIController) {
+	if !peerManager.startReconnecting(deviceID) {
+		return
+	}
+	defer peerManager.stopReconnecting(deviceID)
+	for attempt := 0; ; attempt++ {
+		time.Sleep(getReconnectBackoff(attempt))
+		if bannedTill, banned := getBanExpiry(deviceID); banned {
+			time.Sleep(time.Until(bannedTill))
+		}
+		trustedDevice, trusted := getTrustedDevices()[deviceID]
+		if !trusted || trustedDevice.LastAddress == "" || peerManager.isDeviceConnected(deviceID) {
+			return
+		}
+		log.Println("Redialing", trustedDevice.Username, "at", trustedDevice.LastAddress, "attempt", attempt+1)
+		conn, err := net.DialTimeout("tcp", trustedDevice.LastAddress, reconnectDialTimeout)
+		if err != nil {
+			log.Println("Could not redial", trustedDevice.Username, err)
+			continue
+		}
+		peer := peerManager.addNewPeer(conn, uint32(time.Now().UTC().Unix()), true, peerManager.username, cliController)
+		if peer != nil && peer.deviceID == deviceID {
+			return
+		}
+	}
+}
+
+//startReconnecting marks deviceID as being redialed, returning false if it already is
+func (peerManager PeerManager) startReconnecting(deviceID string) bool {
+	peerManager.peersMutex.Lock()
+	defer peerManager.peersMutex.Unlock()
+	if peerManager.reconnecting[deviceID] {
+		return false
+	}
+	peerManager.reconnecting[deviceID] = true
+	return true
+}
+
+func (peerManager PeerManager) stopReconnecting(deviceID string) {
+	peerManager.peersMutex.Lock()
+	delete(peerManager.reconnecting, deviceID)
+	peerManager.peersMutex.Unlock()
+}
+
+func (peerManager PeerManager) isDeviceConnected(deviceID string) bool {
+	_, connected := peerManager.getDevicePeer(deviceID)
+	return connected
+}
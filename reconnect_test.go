@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	tests := []struct {
+		attempt    int
+		minBackoff time.Duration
+		maxBackoff time.Duration
+	}{
+		{0, reconnectMinBackoff / 2, reconnectMinBackoff},
+		{1, reconnectMinBackoff, 2 * reconnectMinBackoff},
+		{5, 16 * reconnectMinBackoff, 32 * reconnectMinBackoff},
+		{9, reconnectMaxBackoff / 2, reconnectMaxBackoff},
+		{100, reconnectMaxBackoff / 2, reconnectMaxBackoff},
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			backoff := getReconnectBackoff(test.attempt)
+			if backoff < test.minBackoff || backoff > test.maxBackoff {
+				t.Fatalf("backoff of attempt %d is %v, want between %v and %v", test.attempt, backoff, test.minBackoff,
+					test.maxBackoff)
+			}
+		}
+	}
+}
+
+//useFastReconnect shortens the delays between redials for the duration of a test
+func useFastReconnect(t *testing.T) {
+	minBackoff, maxBackoff := reconnectMinBackoff, reconnectMaxBackoff
+	reconnectMinBackoff, reconnectMaxBackoff = 20*time.Millisecond, 100*time.Millisecond
+	t.Cleanup(func() {
+		reconnectMinBackoff, reconnectMaxBackoff = minBackoff, maxBackoff
+	})
+}
+
+//listenOnLoopback accepts connections for peerManager on address in the same way as discovery does, till the returned
+//listener is closed
+func listenOnLoopback(t *testing.T, peerManager PeerManager, address string) net.Listener {
+	tcpListener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Read(make([]byte, 1))
+				handleDiscoveredConnection(peerManager, conn, "receiver", peerManager.username, newHeadlessCLIController())
+			}()
+		}
+	}()
+	return tcpListener
+}
+
+//waitForDevicePeer waits for peerManager to be connected to deviceID through a peer other than previousPeer
+func waitForDevicePeer(t *testing.T, peerManager PeerManager, deviceID string, previousPeer *Peer) *Peer {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if peer, connected := peerManager.getDevicePeer(deviceID); connected && peer != previousPeer {
+			return peer
+		}
+	}
+	t.Fatal("not connected to", deviceID)
+	return nil
+}
+
+func TestReconnectAfterConnectionDrops(t *testing.T) {
+	useTestConfigFolder(t)
+	useFastReconnect(t)
+	alice, bob := newTestPeerManager(t, "alice"), newTestPeerManager(t, "bob")
+	addTrustedDevice(alice.identity.deviceID, "alice")
+	addTrustedDevice(bob.identity.deviceID, "bob")
+	go alice.removeDisconnectedPeers()
+	go bob.removeDisconnectedPeers()
+	listener := listenOnLoopback(t, bob, "127.0.0.1:0")
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	alicePeer := alice.addNewPeer(conn, uint32(time.Now().Unix()), true, "alice", newHeadlessCLIController())
+	if alicePeer == nil {
+		t.Fatal("peers did not connect")
+	}
+	alicePeer.Conn.Close()
+	waitForDevicePeer(t, alice, bob.identity.deviceID, alicePeer)
+	waitForDevicePeer(t, bob, alice.identity.deviceID, nil)
+	listener.Close()
+	stopPeers(t, alice, bob)
+}
+
+func TestReconnectOnceDeviceIsBack(t *testing.T) {
+	useTestConfigFolder(t)
+	useFastReconnect(t)
+	alice, bob := newTestPeerManager(t, "alice"), newTestPeerManager(t, "bob")
+	addTrustedDevice(alice.identity.deviceID, "alice")
+	addTrustedDevice(bob.identity.deviceID, "bob")
+	go alice.removeDisconnectedPeers()
+	go bob.removeDisconnectedPeers()
+	listener := listenOnLoopback(t, bob, "127.0.0.1:0")
+	address := listener.Addr().String()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alicePeer := alice.addNewPeer(conn, uint32(time.Now().Unix()), true, "alice", newHeadlessCLIController())
+	if alicePeer == nil {
+		t.Fatal("peers did not connect")
+	}
+	//Bob goes away, and alice keeps failing to redial it till it listens again
+	listener.Close()
+	bobPeer := waitForDevicePeer(t, bob, alice.identity.deviceID, nil)
+	bobPeer.Conn.Close()
+	time.Sleep(5 * reconnectMaxBackoff)
+	if _, connected := alice.getDevicePeer(bob.identity.deviceID); connected {
+		t.Fatal("connected to a device which is not listening")
+	}
+	listener = listenOnLoopback(t, bob, address)
+	waitForDevicePeer(t, alice, bob.identity.deviceID, alicePeer)
+	listener.Close()
+	stopPeers(t, alice, bob)
+}
+
+//stopPeers disconnects the peers of every peerManager without letting them be redialed, and waits for the redials in
+//progress to give up, so that nothing is left running once the test ends
+func stopPeers(t *testing.T, peerManagers ...PeerManager) {
+	saveTrustedDevices(map[string]TrustedDevice{})
+	for _, peerManager := range peerManagers {
+		for _, peer := range peerManager.getConnectedPeers() {
+			peer.disConnect()
+		}
+	}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		stopped := true
+		for _, peerManager := range peerManagers {
+			peerManager.peersMutex.Lock()
+			stopped = stopped && len(peerManager.connectedPeers) == 0 && len(peerManager.reconnecting) == 0
+			peerManager.peersMutex.Unlock()
+		}
+		if stopped {
+			return
+		}
+	}
+	t.Fatal("peers were still connected or being redialed")
+}
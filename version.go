@@ -0,0 +1,115 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//VersionVector counts the changes made to a file on every device, keyed by device ID. Comparing the vectors of two
+//copies of a file tells whether one of them has seen every change made to the other, or whether they were changed
+//concurrently on different devices
+type VersionVector map[string]uint64
+
+//Results of comparing two version vectors
+const (
+	versionEqual = iota
+	versionNewer
+	versionOlder
+	versionConcurrent
+)
+
+//increment returns a copy of the vector recording one more change made on deviceID
+func (version VersionVector) increment(deviceID string) VersionVector {
+	incremented := version.merge(VersionVector{})
+	incremented[deviceID]++
+	return incremented
+}
+
+//merge returns a vector which has seen every change seen by either version or otherVersion
+func (version VersionVector) merge(otherVersion VersionVector) VersionVector {
+	merged := VersionVector{}
+	for deviceID, counter := range version {
+		merged[deviceID] = counter
+	}
+	for deviceID, counter := range otherVersion {
+		if counter > merged[deviceID] {
+			merged[deviceID] = counter
+		}
+	}
+	return merged
+}
+
+//compare tells whether version is newer than, older than, equal to or concurrent with otherVersion
+func (version VersionVector) compare(otherVersion VersionVector) int {
+	hasNewer, hasOlder := false, false
+	for deviceID, counter := range version.merge(otherVersion) {
+		if version[deviceID] < counter {
+			hasOlder = true
+		}
+		if otherVersion[deviceID] < counter {
+			hasNewer = true
+		}
+	}
+	switch {
+	case hasNewer && hasOlder:
+		return versionConcurrent
+	case hasNewer:
+		return versionNewer
+	case hasOlder:
+		return versionOlder
+	}
+	return versionEqual
+}
+
+//compareFileVersions tells whether the peer's copy of a file is newer than, older than, the same as or concurrent with
+//the local copy. Copies with different contents but equal vectors can only come from indexes created before version
+//vectors were tracked, and are ordered by their mod times instead
+func compareFileVersions(localFile SyncFile, peerFile SyncFile) int {
+	if localFile.Md5 == peerFile.Md5 {
+		return versionEqual
+	}
+	order := peerFile.Version.compare(localFile.Version)
+	if order != versionEqual {
+		return order
+	}
+	if peerFile.ModTime > localFile.ModTime {
+		return versionNewer
+	}
+	return versionOlder
+}
+
+//compareDeletion tells whether the deletion recorded in tombstone is newer than, older than or concurrent with a copy of
+//the deleted file. Only a deletion which has seen every change to the copy is newer. Deletions and files from devices
+//which do not track version vectors are ordered by comparing the deletion time with the mod time instead
+func compareDeletion(tombstone Tombstone, file SyncFile) int {
+	if len(tombstone.Version) > 0 && len(file.Version) > 0 {
+		return tombstone.Version.compare(file.Version)
+	}
+	if tombstone.Md5 == file.Md5 || tombstone.DeletedAt >= file.ModTime {
+		return versionNewer
+	}
+	return versionOlder
+}
+
+//peerWinsConflict decides which of two concurrently changed copies of a file keeps the original name, in the same way
+//on both devices - the copy modified more recently wins, and ties go to the device with the greater ID. The other copy
+//is kept as a conflict copy
+func peerWinsConflict(localFile SyncFile, peerFile SyncFile, localDeviceID string, peerDeviceID string) bool {
+	if peerFile.ModTime != localFile.ModTime {
+		return peerFile.ModTime > localFile.ModTime
+	}
+	return peerDeviceID > localDeviceID
+}
+
+//getConflictFileName returns the name under which the losing copy of a conflicting file is kept, in the form
+//name.sync-conflict-<date>-<time>-<device>.ext, where device is the first part of the ID of the device it came from
+func getConflictFileName(fileName string, deviceID string) string {
+	ext := filepath.Ext(fileName)
+	if strings.HasPrefix(filepath.Base(fileName), ".") && filepath.Base(fileName) == ext {
+		ext = ""
+	}
+	shortDeviceID := strings.Split(deviceID, "-")[0]
+	return strings.TrimSuffix(fileName, ext) + ".sync-conflict-" + time.Now().Format("20060102-150405") + "-" +
+		shortDeviceID + ext
+}
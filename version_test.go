@@ -0,0 +1,147 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestVersionCompare(t *testing.T) {
+	tests := []struct {
+		name         string
+		version      VersionVector
+		otherVersion VersionVector
+		want         int
+	}{
+		{"both empty", VersionVector{}, nil, versionEqual},
+		{"equal", VersionVector{"a": 1, "b": 2}, VersionVector{"a": 1, "b": 2}, versionEqual},
+		{"missing counters are zero", VersionVector{"a": 1, "b": 0}, VersionVector{"a": 1}, versionEqual},
+		{"dominates", VersionVector{"a": 2, "b": 2}, VersionVector{"a": 1, "b": 2}, versionNewer},
+		{"dominates with another device", VersionVector{"a": 1, "b": 1}, VersionVector{"a": 1}, versionNewer},
+		{"dominates empty", VersionVector{"a": 1}, VersionVector{}, versionNewer},
+		{"dominated", VersionVector{"a": 1, "b": 2}, VersionVector{"a": 1, "b": 3}, versionOlder},
+		{"dominated by another device", VersionVector{"a": 1}, VersionVector{"a": 1, "c": 1}, versionOlder},
+		{"concurrent", VersionVector{"a": 2, "b": 1}, VersionVector{"a": 1, "b": 2}, versionConcurrent},
+		{"concurrent on different devices", VersionVector{"a": 1}, VersionVector{"b": 1}, versionConcurrent},
+	}
+	opposites := map[int]int{
+		versionEqual:      versionEqual,
+		versionNewer:      versionOlder,
+		versionOlder:      versionNewer,
+		versionConcurrent: versionConcurrent,
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.version.compare(test.otherVersion); got != test.want {
+				t.Errorf("compare gave %d, want %d", got, test.want)
+			}
+			if got := test.otherVersion.compare(test.version); got != opposites[test.want] {
+				t.Errorf("reversed compare gave %d, want %d", got, opposites[test.want])
+			}
+		})
+	}
+}
+
+func TestVersionMerge(t *testing.T) {
+	version := VersionVector{"a": 3, "b": 1}
+	otherVersion := VersionVector{"b": 2, "c": 1}
+	merged := version.merge(otherVersion)
+	if want := (VersionVector{"a": 3, "b": 2, "c": 1}); !reflect.DeepEqual(merged, want) {
+		t.Errorf("merged %v, want %v", merged, want)
+	}
+	for _, mergedFrom := range []VersionVector{version, otherVersion} {
+		if order := merged.compare(mergedFrom); order != versionNewer {
+			t.Errorf("merged vector compares as %d with %v, want newer", order, mergedFrom)
+		}
+	}
+	if !reflect.DeepEqual(version, VersionVector{"a": 3, "b": 1}) {
+		t.Errorf("merge changed the vector to %v", version)
+	}
+}
+
+func TestVersionIncrement(t *testing.T) {
+	var version VersionVector
+	incremented := version.increment("a").increment("a").increment("b")
+	if want := (VersionVector{"a": 2, "b": 1}); !reflect.DeepEqual(incremented, want) {
+		t.Errorf("incremented to %v, want %v", incremented, want)
+	}
+	if order := incremented.increment("c").compare(incremented); order != versionNewer {
+		t.Errorf("incremented vector compares as %d, want newer", order)
+	}
+	if len(version) != 0 {
+		t.Errorf("increment changed the vector to %v", version)
+	}
+}
+
+func TestCompareFileVersions(t *testing.T) {
+	tests := []struct {
+		name      string
+		localFile SyncFile
+		peerFile  SyncFile
+		want      int
+	}{
+		{"same contents", SyncFile{Md5: "x", Version: VersionVector{"a": 1}}, SyncFile{Md5: "x", Version: VersionVector{"b": 1}}, versionEqual},
+		{"peer dominates", SyncFile{Md5: "x", Version: VersionVector{"a": 1}}, SyncFile{Md5: "y", Version: VersionVector{"a": 1, "b": 1}}, versionNewer},
+		{"peer dominated", SyncFile{Md5: "x", Version: VersionVector{"a": 2}}, SyncFile{Md5: "y", Version: VersionVector{"a": 1}}, versionOlder},
+		{"concurrent", SyncFile{Md5: "x", Version: VersionVector{"a": 1}}, SyncFile{Md5: "y", Version: VersionVector{"b": 1}}, versionConcurrent},
+		{"unversioned newer", SyncFile{Md5: "x", ModTime: 1}, SyncFile{Md5: "y", ModTime: 2}, versionNewer},
+		{"unversioned older", SyncFile{Md5: "x", ModTime: 2}, SyncFile{Md5: "y", ModTime: 2}, versionOlder},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := compareFileVersions(test.localFile, test.peerFile); got != test.want {
+				t.Errorf("compareFileVersions gave %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPeerWinsConflict(t *testing.T) {
+	localFile, peerFile := SyncFile{ModTime: 1}, SyncFile{ModTime: 2}
+	if !peerWinsConflict(localFile, peerFile, "b", "a") || peerWinsConflict(peerFile, localFile, "a", "b") {
+		t.Error("the copy modified more recently did not win")
+	}
+	if !peerWinsConflict(localFile, localFile, "a", "b") || peerWinsConflict(localFile, localFile, "b", "a") {
+		t.Error("a tie did not go to the device with the greater ID")
+	}
+}
+
+func TestGetConflictFileName(t *testing.T) {
+	tests := []struct {
+		fileName string
+		pattern  string
+	}{
+		{"a.txt", `^a\.sync-conflict-\d{8}-\d{6}-ABCD\.txt$`},
+		{"dir/a.tar.gz", `^dir/a\.tar\.sync-conflict-\d{8}-\d{6}-ABCD\.gz$`},
+		{".bashrc", `^\.bashrc\.sync-conflict-\d{8}-\d{6}-ABCD$`},
+		{"Makefile", `^Makefile\.sync-conflict-\d{8}-\d{6}-ABCD$`},
+	}
+	for _, test := range tests {
+		if got := getConflictFileName(test.fileName, "ABCD-EFGH"); !regexp.MustCompile(test.pattern).MatchString(got) {
+			t.Errorf("conflict copy of %s is named %s", test.fileName, got)
+		}
+	}
+}
+
+func TestCompareDeletion(t *testing.T) {
+	tests := []struct {
+		name      string
+		tombstone Tombstone
+		file      SyncFile
+		want      int
+	}{
+		{"deletion has seen the file", Tombstone{Version: VersionVector{"a": 1, "b": 1}}, SyncFile{Version: VersionVector{"a": 1}}, versionNewer},
+		{"file changed after the deletion", Tombstone{Version: VersionVector{"a": 1}}, SyncFile{Version: VersionVector{"a": 2}}, versionOlder},
+		{"file changed concurrently", Tombstone{Version: VersionVector{"a": 1, "b": 1}}, SyncFile{Version: VersionVector{"a": 2}}, versionConcurrent},
+		{"unversioned with the same contents", Tombstone{Md5: "x", DeletedAt: 1}, SyncFile{Md5: "x", ModTime: 2}, versionNewer},
+		{"unversioned deleted later", Tombstone{Md5: "x", DeletedAt: 2}, SyncFile{Md5: "y", ModTime: 2}, versionNewer},
+		{"unversioned modified later", Tombstone{Md5: "x", DeletedAt: 1}, SyncFile{Md5: "y", ModTime: 2}, versionOlder},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := compareDeletion(test.tombstone, test.file); got != test.want {
+				t.Errorf("compareDeletion gave %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"github.com/akshay1713/goUtils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//versionTimeFormat is the format of the timestamp added to the name of an archived version of a file, which also
+//identifies the version when restoring it
+const versionTimeFormat = "20060102-150405"
+
+//Types of retention policies. retentionLast keeps the latest versions of a file, retentionAge keeps the versions
+//younger than a maximum age, and retentionStaggered keeps fewer versions the older they get
+const (
+	retentionLast      = "last"
+	retentionAge       = "age"
+	retentionStaggered = "staggered"
+)
+
+//RetentionPolicy decides which archived versions of a file are kept. KeepLast is used by retentionLast, and MaxAgeDays
+//by retentionAge and retentionStaggered
+type RetentionPolicy struct {
+	Type       string `json:"type"`
+	KeepLast   int    `json:"keep_last,omitempty"`
+	MaxAgeDays int    `json:"max_age_days,omitempty"`
+}
+
+var defaultRetentionPolicy = RetentionPolicy{Type: retentionLast, KeepLast: 5}
+
+//staggeredIntervals are the minimum gaps between the versions kept by retentionStaggered - every version from the last
+//30 seconds, one every 30 seconds for the first hour, one an hour for the first day, one a day for the first 30 days
+//and one a week after that
+var staggeredIntervals = []struct {
+	maxAge   time.Duration
+	interval time.Duration
+}{
+	{30 * time.Second, 0},
+	{time.Hour, 30 * time.Second},
+	{24 * time.Hour, time.Hour},
+	{30 * 24 * time.Hour, 24 * time.Hour},
+}
+
+//FileVersion is an archived version of a file in a synced folder
+type FileVersion struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	SavedAt int64  `json:"saved_at"`
+	Size    int64  `json:"size"`
+	path    string
+}
+
+//getRetentionPolicy validates a policy given by the user. value is the number of versions for retentionLast, and the
+//maximum age in days for the other types, which is optional for retentionStaggered
+func getRetentionPolicy(policyType string, value string) (RetentionPolicy, error) {
+	number := 0
+	if value != "" {
+		parsedNumber, err := strconv.Atoi(value)
+		if err != nil || parsedNumber <= 0 {
+			return RetentionPolicy{}, errors.New("invalid retention value " + value)
+		}
+		number = parsedNumber
+	}
+	switch policyType {
+	case retentionLast:
+		if number == 0 {
+			return RetentionPolicy{}, errors.New("the last retention policy needs the number of versions to keep")
+		}
+		return RetentionPolicy{Type: retentionLast, KeepLast: number}, nil
+	case retentionAge:
+		if number == 0 {
+			return RetentionPolicy{}, errors.New("the age retention policy needs the number of days to keep versions for")
+		}
+		return RetentionPolicy{Type: retentionAge, MaxAgeDays: number}, nil
+	case retentionStaggered:
+		if number == 0 {
+			number = 365
+		}
+		return RetentionPolicy{Type: retentionStaggered, MaxAgeDays: number}, nil
+	}
+	return RetentionPolicy{}, errors.New("unknown retention policy " + policyType + ", use last, age or staggered")
+}
+
+func (policy RetentionPolicy) orDefault() RetentionPolicy {
+	if policy.Type == "" {
+		return defaultRetentionPolicy
+	}
+	return policy
+}
+
+func (policy RetentionPolicy) String() string {
+	switch policy.Type {
+	case retentionLast:
+		return "keep the last " + strconv.Itoa(policy.KeepLast) + " versions"
+	case retentionAge:
+		return "keep versions for " + strconv.Itoa(policy.MaxAgeDays) + " days"
+	case retentionStaggered:
+		return "keep staggered versions for " + strconv.Itoa(policy.MaxAgeDays) + " days"
+	}
+	return policy.orDefault().String()
+}
+
+//getExpiredVersions returns the versions which policy does not keep at the time now. versions have to be sorted with
+//the newest first
+func (policy RetentionPolicy) getExpiredVersions(versions []FileVersion, now time.Time) []FileVersion {
+	policy = policy.orDefault()
+	expiredVersions := []FileVersion{}
+	maxAge := time.Duration(policy.MaxAgeDays) * 24 * time.Hour
+	lastKept := now.Add(time.Hour)
+	for i, version := range versions {
+		savedAt := time.Unix(version.SavedAt, 0)
+		age := now.Sub(savedAt)
+		expired := false
+		switch policy.Type {
+		case retentionLast:
+			expired = i >= policy.KeepLast
+		case retentionAge:
+			expired = age > maxAge
+		case retentionStaggered:
+			interval := 7 * 24 * time.Hour
+			for _, staggered := range staggeredIntervals {
+				if age < staggered.maxAge {
+					interval = staggered.interval
+					break
+				}
+			}
+			expired = age > maxAge || lastKept.Sub(savedAt) < interval
+		}
+		if expired {
+			expiredVersions = append(expiredVersions, version)
+			continue
+		}
+		lastKept = savedAt
+	}
+	return expiredVersions
+}
+
+func getVersionsPath(folderPath string) string {
+	return folderPath + "/.syncIt/versions"
+}
+
+//getVersionFilePath returns the path at which the version of fileName saved at savedAt is archived. The timestamp is
+//added before the extension, so that the archived file can still be opened by the same programs
+func getVersionFilePath(folderPath string, fileName string, savedAt time.Time) string {
+	ext := getVersionExt(fileName)
+	versionName := strings.TrimSuffix(fileName, ext) + "~" + savedAt.Format(versionTimeFormat) + ext
+	return getLocalPath(getVersionsPath(folderPath), versionName)
+}
+
+//archiveFile moves fileName out of the folder into the archived versions, and then removes the versions of it which
+//policy no longer keeps
+func archiveFile(folderPath string, fileName string, policy RetentionPolicy) error {
+	savedAt := time.Now()
+	versionPath := getVersionFilePath(folderPath, fileName, savedAt)
+	for {
+		//Versions archived within the same second are told apart by moving the later ones ahead
+		if _, err := os.Stat(versionPath); os.IsNotExist(err) {
+			break
+		}
+		savedAt = savedAt.Add(time.Second)
+		versionPath = getVersionFilePath(folderPath, fileName, savedAt)
+	}
+	err := os.MkdirAll(filepath.Dir(versionPath), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(getLocalPath(folderPath, fileName), versionPath)
+	if err != nil {
+		return err
+	}
+	removeExpiredVersions(folderPath, fileName, policy)
+	return nil
+}
+
+func removeExpiredVersions(folderPath string, fileName string, policy RetentionPolicy) {
+	for _, version := range policy.getExpiredVersions(getFileVersions(folderPath, fileName), time.Now()) {
+		err := os.Remove(version.path)
+		goUtils.HandleErr(err, "While removing expired version "+version.path)
+	}
+}
+
+//pruneVersions removes the archived versions of every file in the folder which policy no longer keeps
+func pruneVersions(folderPath string, policy RetentionPolicy) {
+	versionsPath := getVersionsPath(folderPath)
+	fileNames := make(map[string]bool)
+	filepath.Walk(versionsPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		relativePath, _ := filepath.Rel(versionsPath, path)
+		versionName := filepath.ToSlash(relativePath)
+		ext := getVersionExt(versionName)
+		separator := strings.LastIndex(versionName, "~")
+		if separator == -1 {
+			return nil
+		}
+		fileNames[versionName[:separator]+ext] = true
+		return nil
+	})
+	for fileName := range fileNames {
+		removeExpiredVersions(folderPath, fileName, policy)
+	}
+}
+
+//getVersionExt returns the extension of fileName which is kept at the end of the names of its versions. Names like
+//.bashrc are treated as having no extension
+func getVersionExt(fileName string) string {
+	ext := filepath.Ext(fileName)
+	if filepath.Base(fileName) == ext {
+		return ""
+	}
+	return ext
+}
+
+//getFileVersions returns the archived versions of fileName, newest first
+func getFileVersions(folderPath string, fileName string) []FileVersion {
+	versions := []FileVersion{}
+	ext := getVersionExt(fileName)
+	prefix := strings.TrimSuffix(filepath.Base(fileName), ext) + "~"
+	versionsDir := filepath.Dir(getLocalPath(getVersionsPath(folderPath), fileName))
+	fileInfos, err := ioutil.ReadDir(versionsDir)
+	if err != nil {
+		return versions
+	}
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if fileInfo.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		versionID := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		savedAt, err := time.ParseInLocation(versionTimeFormat, versionID, time.Local)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, FileVersion{
+			Name:    fileName,
+			Version: versionID,
+			SavedAt: savedAt.Unix(),
+			Size:    fileInfo.Size(),
+			path:    filepath.Join(versionsDir, name),
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].SavedAt > versions[j].SavedAt
+	})
+	return versions
+}
+
+//restoreFileVersion puts the archived version of fileName identified by versionID back in the folder. The current
+//copy of the file, if any, is archived first so that restoring can be undone
+func restoreFileVersion(folderPath string, fileName string, versionID string, policy RetentionPolicy) error {
+	var restoredVersion *FileVersion
+	versions := getFileVersions(folderPath, fileName)
+	for i := range versions {
+		if versions[i].Version == versionID {
+			restoredVersion = &versions[i]
+		}
+	}
+	if restoredVersion == nil {
+		return errors.New("no version " + versionID + " of " + fileName)
+	}
+	tempPath := getPartialFilePath(folderPath, fileName)
+	err := os.MkdirAll(filepath.Dir(tempPath), 0755)
+	if err != nil {
+		return err
+	}
+	err = copyFile(restoredVersion.path, tempPath)
+	if err != nil {
+		return err
+	}
+	filePath := getLocalPath(folderPath, fileName)
+	if _, err := os.Stat(filePath); err == nil {
+		err = archiveFile(folderPath, fileName, policy)
+		if err != nil {
+			os.Remove(tempPath)
+			return err
+		}
+	}
+	err = os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, filePath)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetExpiredVersions(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	tests := []struct {
+		name    string
+		policy  RetentionPolicy
+		ages    []time.Duration
+		expired []int
+	}{
+		{"last keeps the newest", RetentionPolicy{Type: retentionLast, KeepLast: 2}, []time.Duration{time.Minute, time.Hour, day, 2 * day}, []int{2, 3}},
+		{"last with fewer versions", RetentionPolicy{Type: retentionLast, KeepLast: 5}, []time.Duration{time.Minute, day}, nil},
+		{"default keeps the last 5", RetentionPolicy{}, []time.Duration{1, 2, 3, 4, 5, 6, 7}, []int{5, 6}},
+		{"age", RetentionPolicy{Type: retentionAge, MaxAgeDays: 7}, []time.Duration{day, 6 * day, 7*day + time.Second, 30 * day}, []int{2, 3}},
+		{"age keeps everything younger", RetentionPolicy{Type: retentionAge, MaxAgeDays: 7}, []time.Duration{0, 7 * day}, nil},
+		{
+			"staggered",
+			RetentionPolicy{Type: retentionStaggered, MaxAgeDays: 365},
+			[]time.Duration{
+				10 * time.Second,             //0 every version from the last 30 seconds is kept
+				20 * time.Second,             //1
+				40 * time.Second,             //2 within 30 seconds of the one before
+				time.Minute,                  //3
+				5 * time.Minute,              //4
+				2 * time.Hour,                //5
+				2*time.Hour + 30*time.Minute, //6 within an hour of the one before
+				3 * day,                      //7
+				3*day + 12*time.Hour,         //8 within a day of the one before
+				40 * day,                     //9
+				43 * day,                     //10 within a week of the one before
+				400 * day,                    //11 older than the maximum age
+			},
+			[]int{2, 6, 8, 10, 11},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			versions := []FileVersion{}
+			for i, age := range test.ages {
+				versions = append(versions, FileVersion{Name: "a.txt", Version: string(rune('a' + i)), SavedAt: now.Add(-age).Unix()})
+			}
+			want := []FileVersion{}
+			for _, i := range test.expired {
+				want = append(want, versions[i])
+			}
+			if got := test.policy.getExpiredVersions(versions, now); !reflect.DeepEqual(got, want) {
+				t.Errorf("expired %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestGetRetentionPolicy(t *testing.T) {
+	tests := []struct {
+		policyType string
+		value      string
+		want       RetentionPolicy
+		valid      bool
+	}{
+		{retentionLast, "3", RetentionPolicy{Type: retentionLast, KeepLast: 3}, true},
+		{retentionLast, "", RetentionPolicy{}, false},
+		{retentionAge, "30", RetentionPolicy{Type: retentionAge, MaxAgeDays: 30}, true},
+		{retentionAge, "0", RetentionPolicy{}, false},
+		{retentionStaggered, "", RetentionPolicy{Type: retentionStaggered, MaxAgeDays: 365}, true},
+		{retentionStaggered, "-1", RetentionPolicy{}, false},
+		{"forever", "1", RetentionPolicy{}, false},
+	}
+	for _, test := range tests {
+		policy, err := getRetentionPolicy(test.policyType, test.value)
+		if (err == nil) != test.valid || policy != test.want {
+			t.Errorf("getRetentionPolicy(%q, %q) gave %+v, %v", test.policyType, test.value, policy, err)
+		}
+	}
+}
+
+func TestPruneVersions(t *testing.T) {
+	folderPath := t.TempDir()
+	now := time.Now()
+	day := 24 * time.Hour
+	for _, fileName := range []string{"a.txt", "dir/.bashrc"} {
+		for _, age := range []time.Duration{day, 2*day - time.Hour, 3 * day} {
+			versionPath := getVersionFilePath(folderPath, fileName, now.Add(-age))
+			if err := os.MkdirAll(filepath.Dir(versionPath), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(versionPath, []byte(fileName), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	pruneVersions(folderPath, RetentionPolicy{Type: retentionAge, MaxAgeDays: 2})
+	for _, fileName := range []string{"a.txt", "dir/.bashrc"} {
+		versions := getFileVersions(folderPath, fileName)
+		if len(versions) != 2 {
+			t.Fatalf("%d versions of %s were kept, want 2", len(versions), fileName)
+		}
+		if versions[0].Version != now.Add(-day).Format(versionTimeFormat) || versions[0].SavedAt < versions[1].SavedAt {
+			t.Errorf("versions of %s are %+v, want the newest first", fileName, versions)
+		}
+	}
+}
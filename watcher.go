@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+//watchDebounce is how long a folder has to go without changes before it is synced, so that a burst of changes results
+//in a single sync
+const watchDebounce = 2 * time.Second
+
+//rescanInterval is how often every folder is rescanned in full, in case any changes were missed by the watcher
+const rescanInterval = 5 * time.Minute
+
+//FolderWatcher watches all the folders in the global config for changes, and syncs a folder with the connected peers
+//once the changes to it have settled
+type FolderWatcher struct {
+	folderManager FolderManager
+	//changedFolders holds the folders changed since the watch loop last looked, and changed is signalled when one is
+	//added to it
+	changesMutex   sync.Mutex
+	changedFolders map[string]bool
+	changed        chan bool
+	timerMutex     sync.Mutex
+	pendingSyncs   map[string]*time.Timer
+	watchedFolders map[string]bool
+	ignoreMutex    sync.Mutex
+	ignoreMatchers map[string]IgnoreMatcher
+}
+
+func newFolderWatcher(folderManager FolderManager) *FolderWatcher {
+	return &FolderWatcher{
+		folderManager:  folderManager,
+		changedFolders: make(map[string]bool),
+		changed:        make(chan bool, 1),
+		pendingSyncs:   make(map[string]*time.Timer),
+		watchedFolders: make(map[string]bool),
+		ignoreMatchers: make(map[string]IgnoreMatcher),
+	}
+}
+
+//start watches all the folders which have been added so far, and keeps handling changes and running the periodic
+//rescans. Folders added later are watched as soon as they are added
+func (watcher *FolderWatcher) start() {
+	subscriber, _ := events.subscribe(math.MaxUint64)
+	watcher.watchNewFolders()
+	rescanTicker := time.NewTicker(rescanInterval)
+	for {
+		select {
+		case <-watcher.changed:
+			for _, folderPath := range watcher.takeChangedFolders() {
+				watcher.scheduleSync(folderPath)
+			}
+		case event, subscribed := <-subscriber:
+			if !subscribed {
+				//Dropped for falling behind, the global config is checked for any folders added meanwhile
+				subscriber, _ = events.subscribe(math.MaxUint64)
+				watcher.watchNewFolders()
+				continue
+			}
+			if event.Type == eventFolderAdded {
+				watcher.watchNewFolders()
+			}
+		case <-rescanTicker.C:
+			watcher.rescan()
+		}
+	}
+}
+
+//folderChanged records a change to folderPath for the watch loop. It never blocks, so that events keep being read
+//while the loop is busy with a rescan, and repeated changes to a folder meanwhile are handled once
+func (watcher *FolderWatcher) folderChanged(folderPath string) {
+	watcher.changesMutex.Lock()
+	watcher.changedFolders[folderPath] = true
+	watcher.changesMutex.Unlock()
+	select {
+	case watcher.changed <- true:
+	default:
+	}
+}
+
+//takeChangedFolders returns the folders changed since it was last called
+func (watcher *FolderWatcher) takeChangedFolders() []string {
+	watcher.changesMutex.Lock()
+	defer watcher.changesMutex.Unlock()
+	folderPaths := []string{}
+	for folderPath := range watcher.changedFolders {
+		folderPaths = append(folderPaths, folderPath)
+	}
+	watcher.changedFolders = make(map[string]bool)
+	return folderPaths
+}
+
+//watchNewFolders starts watching the folders in the global config which are not being watched yet
+func (watcher *FolderWatcher) watchNewFolders() {
+	for _, folderPath := range watcher.folderManager.getAllFolders() {
+		if watcher.watchedFolders[folderPath] {
+			continue
+		}
+		err := watcher.watchFolder(folderPath)
+		if err != nil {
+			log.Println("Error while watching folder", folderPath, err)
+			continue
+		}
+		watcher.watchedFolders[folderPath] = true
+	}
+}
+
+//scheduleSync syncs folderPath once watchDebounce has passed without any further changes to it
+func (watcher *FolderWatcher) scheduleSync(folderPath string) {
+	watcher.timerMutex.Lock()
+	defer watcher.timerMutex.Unlock()
+	if timer, exists := watcher.pendingSyncs[folderPath]; exists {
+		timer.Reset(watchDebounce)
+		return
+	}
+	watcher.pendingSyncs[folderPath] = time.AfterFunc(watchDebounce, func() {
+		watcher.timerMutex.Lock()
+		delete(watcher.pendingSyncs, folderPath)
+		watcher.timerMutex.Unlock()
+		watcher.folderManager.syncIfChanged(folderPath)
+	})
+}
+
+func (watcher *FolderWatcher) rescan() {
+	watcher.ignoreMutex.Lock()
+	watcher.ignoreMatchers = make(map[string]IgnoreMatcher)
+	watcher.ignoreMutex.Unlock()
+	watcher.watchNewFolders()
+	for folderPath := range watcher.watchedFolders {
+		watcher.folderManager.syncIfChanged(folderPath)
+	}
+}
+
+//isIgnoredChange filters out changes to paths excluded by the .syncignore of the folder. relPath is relative to
+//folderPath. Changes made by syncIt itself, such as to lock files, are all under .syncIt and never reach this
+func (watcher *FolderWatcher) isIgnoredChange(folderPath string, relPath string, isDir bool) bool {
+	watcher.ignoreMutex.Lock()
+	defer watcher.ignoreMutex.Unlock()
+	if relPath == ".syncignore" {
+		delete(watcher.ignoreMatchers, folderPath)
+		return false
+	}
+	ignoreMatcher, exists := watcher.ignoreMatchers[folderPath]
+	if !exists {
+		ignoreMatcher = loadIgnoreMatcher(folderPath)
+		watcher.ignoreMatchers[folderPath] = ignoreMatcher
+	}
+	return ignoreMatcher.isIgnored(relPath, isDir)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const watchEvents = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+
+//watchedDir is a directory watched with inotify, along with the synced folder which contains it
+type watchedDir struct {
+	folderPath string
+	dirPath    string
+}
+
+var inotify struct {
+	sync.Mutex
+	fd      int
+	watches map[int]watchedDir
+}
+
+//watchFolder adds inotify watches for folderPath and every directory inside it except .syncIt. All the watches share a
+//single inotify instance, whose events are read by a goroutine started with the first watch
+func (watcher *FolderWatcher) watchFolder(folderPath string) error {
+	inotify.Lock()
+	if inotify.watches == nil {
+		fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+		if err != nil {
+			inotify.Unlock()
+			return err
+		}
+		inotify.fd = fd
+		inotify.watches = make(map[int]watchedDir)
+		go watcher.readEvents()
+	}
+	inotify.Unlock()
+	return addWatches(folderPath, folderPath)
+}
+
+//addWatches adds a watch for dirPath and all the directories under it, recording that they belong to folderPath.
+//Directories excluded by .syncignore are not watched
+func addWatches(folderPath string, dirPath string) error {
+	ignoreMatcher := loadIgnoreMatcher(folderPath)
+	return filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		relPath, _ := filepath.Rel(folderPath, path)
+		relPath = filepath.ToSlash(relPath)
+		if relPath == ".syncIt" || (relPath != "." && ignoreMatcher.isIgnored(relPath, true)) {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(inotify.fd, path, watchEvents)
+		if err != nil {
+			return err
+		}
+		inotify.Lock()
+		inotify.watches[wd] = watchedDir{folderPath: folderPath, dirPath: path}
+		inotify.Unlock()
+		return nil
+	})
+}
+
+func (watcher *FolderWatcher) readEvents() {
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		readSize, err := syscall.Read(inotify.fd, buffer)
+		if err != nil || readSize < syscall.SizeofInotifyEvent {
+			if err == syscall.EINTR {
+				continue
+			}
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= readSize; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameBytes := buffer[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+			fileName := string(nameBytes[:clen(nameBytes)])
+			watcher.handleEvent(int(event.Wd), event.Mask, fileName)
+		}
+	}
+}
+
+func (watcher *FolderWatcher) handleEvent(wd int, mask uint32, fileName string) {
+	inotify.Lock()
+	dir, exists := inotify.watches[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(inotify.watches, wd)
+	}
+	inotify.Unlock()
+	if !exists {
+		return
+	}
+	relPath, _ := filepath.Rel(dir.folderPath, filepath.Join(dir.dirPath, fileName))
+	relPath = filepath.ToSlash(relPath)
+	if relPath == ".syncIt" || watcher.isIgnoredChange(dir.folderPath, relPath, mask&syscall.IN_ISDIR != 0) {
+		return
+	}
+	if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		//Directories created after the folder was first watched need watches of their own
+		addWatches(dir.folderPath, filepath.Join(dir.dirPath, fileName))
+	}
+	watcher.folderChanged(dir.folderPath)
+}
+
+//clen returns the length of the null terminated name in an inotify event
+func clen(nameBytes []byte) int {
+	for i := range nameBytes {
+		if nameBytes[i] == 0 {
+			return i
+		}
+	}
+	return len(nameBytes)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddedFolderIsWatched(t *testing.T) {
+	useTestConfigFolder(t)
+	folderManager := newTestFolderManager(t)
+	subscriber, _ := events.subscribe(math.MaxUint64)
+	defer events.unsubscribe(subscriber)
+	subscriberCount := getSubscriberCount()
+	go newFolderWatcher(folderManager).start()
+	//The folder has to be added after the watcher has started watching the folders added before it
+	for start := time.Now(); getSubscriberCount() <= subscriberCount; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("watcher did not start")
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, folderPath := addTestFolder(t, folderManager, map[string][]byte{})
+	//The folder is watched shortly after it has been added, so the file is written again, after the changes have had
+	//time to settle, until the change is noticed
+	time.Sleep(100 * time.Millisecond)
+	writeTestFile(t, folderPath, "a.txt", []byte("data"))
+	writeTicker := time.NewTicker(watchDebounce + time.Second)
+	defer writeTicker.Stop()
+	timeout := time.After(3*watchDebounce + 5*time.Second)
+	for {
+		select {
+		case <-writeTicker.C:
+			writeTestFile(t, folderPath, "a.txt", []byte(time.Now().String()))
+		case event := <-subscriber:
+			if data, isFolder := event.Data.(FolderEventData); event.Type == eventIndexUpdated && isFolder &&
+				data.Path == folderPath && strings.HasPrefix(event.Message, "Changes found") {
+				return
+			}
+		case <-timeout:
+			t.Fatal("change to the added folder was not synced")
+		}
+	}
+}
+
+func getSubscriberCount() int {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	return len(events.subscribers)
+}
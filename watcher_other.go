@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "log"
+
+//watchFolder does nothing on platforms without inotify, where changes are only found by the periodic rescans
+func (watcher *FolderWatcher) watchFolder(folderPath string) error {
+	log.Println("Watching is not supported on this platform, relying on rescans for", folderPath)
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestFolderChangesAreCoalesced(t *testing.T) {
+	watcher := newFolderWatcher(FolderManager{})
+	//Nothing takes the changes meanwhile, as when the watch loop is busy with a rescan
+	for i := 0; i < 100; i++ {
+		watcher.folderChanged("/a")
+		watcher.folderChanged("/b")
+	}
+	<-watcher.changed
+	folderPaths := watcher.takeChangedFolders()
+	sort.Strings(folderPaths)
+	if want := []string{"/a", "/b"}; !reflect.DeepEqual(folderPaths, want) {
+		t.Errorf("changed folders are %v, want %v", folderPaths, want)
+	}
+	select {
+	case <-watcher.changed:
+		t.Error("changes were signalled again after being taken")
+	default:
+	}
+	if folderPaths = watcher.takeChangedFolders(); len(folderPaths) != 0 {
+		t.Errorf("changed folders are %v after being taken", folderPaths)
+	}
+}